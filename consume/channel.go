@@ -0,0 +1,456 @@
+package consume
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrChannelExiting is returned by a Channel once it is deleted or its
+	// Topic is closed
+	ErrChannelExiting = errors.New("channel exiting")
+	// ErrNotInFlight is returned by Finish, Requeue and Touch for a message
+	// the consumer does not hold, e.g. one that timed out and was requeued
+	ErrNotInFlight = errors.New("message not in flight")
+)
+
+// Channel receives a copy of every message committed to its Topic after it
+// was created and hands each to one of its consumers, NSQ style: a message
+// stays in flight until the consumer finishes it, and is requeued if the
+// consumer requeues it, closes, or lets it time out.
+//topic下的channel，每个channel都收到topic的全部消息，由其中一个消费者处理
+type Channel struct {
+	sync.Mutex
+	topic      *Topic
+	name       string
+	msgTimeout time.Duration
+
+	queue     []*Message                 //待投递的消息
+	deferred  deferredQueue              //延迟重新投递的消息
+	inFlight  map[MessageID]*inFlightMsg //已投递未完成的消息
+	consumers []*ChannelConsumer         //订阅的消费者
+	next      int                        //轮询投递的下一个消费者
+	notify    chan struct{}              //唤醒投递循环
+	exitChan  chan struct{}
+	exitFlag  bool
+	wg        sync.WaitGroup
+
+	requeueCount uint64
+	timeoutCount uint64
+}
+
+// ChannelConsumer is a subscription to a Channel holding at most its
+// max-in-flight messages at a time
+//channel的消费者
+type ChannelConsumer struct {
+	ch          *Channel
+	maxInFlight int
+	inFlight    int
+	msgChan     chan *Message
+	closed      bool
+}
+
+type inFlightMsg struct {
+	msg      *Message
+	consumer *ChannelConsumer
+	deadline time.Time
+}
+
+type deferredMsg struct {
+	msg *Message
+	at  time.Time
+}
+
+// deferredQueue is a min-heap of requeued messages by due time
+type deferredQueue []deferredMsg
+
+func (q deferredQueue) Len() int            { return len(q) }
+func (q deferredQueue) Less(i, j int) bool  { return q[i].at.Before(q[j].at) }
+func (q deferredQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *deferredQueue) Push(x interface{}) { *q = append(*q, x.(deferredMsg)) }
+func (q *deferredQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	x := old[n-1]
+	old[n-1] = deferredMsg{}
+	*q = old[:n-1]
+	return x
+}
+
+// GetChannel returns the named channel, creating it if necessary. A new
+// channel only receives messages committed from then on.
+//获取channel，不存在时创建
+func (t *Topic) GetChannel(name string) (*Channel, error) {
+	if name == "" {
+		return nil, fmt.Errorf("invalid channel name %q", name)
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	select {
+	case <-t.quitChan:
+		return nil, ErrExiting
+	default:
+	}
+
+	if c, ok := t.channels[name]; ok {
+		return c, nil
+	}
+	c := &Channel{
+		topic:      t,
+		name:       name,
+		msgTimeout: t.msgTimeout,
+		inFlight:   make(map[MessageID]*inFlightMsg),
+		notify:     make(chan struct{}, 1),
+		exitChan:   make(chan struct{}),
+	}
+	c.wg.Add(1)
+	go c.messagePump()
+	t.channels[name] = c
+	return c, nil
+}
+
+// DeleteChannel stops the named channel, dropping whatever it holds
+func (t *Topic) DeleteChannel(name string) error {
+	t.Lock()
+	c, ok := t.channels[name]
+	delete(t.channels, name)
+	t.Unlock()
+
+	if !ok {
+		return fmt.Errorf("channel %q not found", name)
+	}
+	c.exit()
+	return nil
+}
+
+// fanOut gives every channel its own copy of the committed messages
+func (t *Topic) fanOut(msgs []*Message) {
+	t.Lock()
+	defer t.Unlock()
+	for _, c := range t.channels {
+		c.put(msgs)
+	}
+}
+
+// closeChannels stops every channel once the topic is closed
+func (t *Topic) closeChannels() {
+	t.Lock()
+	channels := t.channels
+	t.channels = make(map[string]*Channel)
+	t.Unlock()
+
+	for _, c := range channels {
+		c.exit()
+	}
+}
+
+func (c *Channel) Name() string {
+	return c.name
+}
+
+// Depth returns the number of messages waiting to be delivered, including
+// requeued ones waiting for their delay
+func (c *Channel) Depth() int64 {
+	c.Lock()
+	defer c.Unlock()
+	return int64(len(c.queue) + len(c.deferred))
+}
+
+// InFlight returns the number of messages delivered but not yet finished
+func (c *Channel) InFlight() int64 {
+	c.Lock()
+	defer c.Unlock()
+	return int64(len(c.inFlight))
+}
+
+// RequeueCount returns the number of messages requeued by consumers
+func (c *Channel) RequeueCount() uint64 {
+	c.Lock()
+	defer c.Unlock()
+	return c.requeueCount
+}
+
+// TimeoutCount returns the number of messages requeued after timing out
+func (c *Channel) TimeoutCount() uint64 {
+	c.Lock()
+	defer c.Unlock()
+	return c.timeoutCount
+}
+
+// Subscribe adds a consumer receiving at most maxInFlight unfinished
+// messages at a time
+//订阅channel，maxInFlight为同时处理的最大消息数
+func (c *Channel) Subscribe(maxInFlight int) (*ChannelConsumer, error) {
+	if maxInFlight <= 0 {
+		return nil, fmt.Errorf("invalid max in flight %d", maxInFlight)
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	if c.exitFlag {
+		return nil, ErrChannelExiting
+	}
+	cc := &ChannelConsumer{
+		ch:          c,
+		maxInFlight: maxInFlight,
+		msgChan:     make(chan *Message, maxInFlight),
+	}
+	c.consumers = append(c.consumers, cc)
+	c.wake()
+	return cc, nil
+}
+
+func (c *Channel) put(msgs []*Message) {
+	c.Lock()
+	defer c.Unlock()
+	if c.exitFlag {
+		return
+	}
+	for _, m := range msgs {
+		cp := *m
+		cp.attempts = 0
+		c.queue = append(c.queue, &cp)
+	}
+	c.wake()
+}
+
+// wake makes the message pump look at the channel again
+func (c *Channel) wake() {
+	select {
+	case c.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (c *Channel) exit() {
+	c.Lock()
+	if c.exitFlag {
+		c.Unlock()
+		return
+	}
+	c.exitFlag = true
+	close(c.exitChan)
+	c.Unlock()
+
+	c.wg.Wait()
+
+	c.Lock()
+	for _, cc := range c.consumers {
+		cc.closed = true
+		close(cc.msgChan)
+	}
+	c.consumers = nil
+	c.Unlock()
+}
+
+// messagePump delivers ready messages to consumers with room, and requeues
+// deferred messages once due and in-flight ones once they time out
+func (c *Channel) messagePump() {
+	defer c.wg.Done()
+
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+	for {
+		wait := c.process(time.Now())
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		var tc <-chan time.Time
+		if wait > 0 {
+			timer.Reset(wait)
+			tc = timer.C
+		}
+
+		select {
+		case <-c.notify:
+		case <-tc:
+		case <-c.exitChan:
+			return
+		}
+	}
+}
+
+// process does whatever is due by now and returns how long until something
+// else is, or zero if nothing is pending
+func (c *Channel) process(now time.Time) time.Duration {
+	c.Lock()
+	defer c.Unlock()
+
+	//到期的延迟消息放回队列
+	for len(c.deferred) > 0 && !c.deferred[0].at.After(now) {
+		d := heap.Pop(&c.deferred).(deferredMsg)
+		c.queue = append(c.queue, d.msg)
+	}
+
+	//超时的消息重新投递
+	var next time.Time
+	for id, f := range c.inFlight {
+		if !f.deadline.After(now) {
+			delete(c.inFlight, id)
+			f.consumer.inFlight--
+			c.timeoutCount++
+			c.queue = append(c.queue, f.msg)
+			continue
+		}
+		if next.IsZero() || f.deadline.Before(next) {
+			next = f.deadline
+		}
+	}
+
+	//轮询投递给还有余量的消费者
+	for len(c.queue) > 0 {
+		cc := c.nextConsumer()
+		if cc == nil {
+			break
+		}
+		m := c.queue[0]
+		c.queue[0] = nil
+		c.queue = c.queue[1:]
+
+		m.attempts++
+		c.inFlight[m.ID] = &inFlightMsg{msg: m, consumer: cc, deadline: now.Add(c.msgTimeout)}
+		cc.inFlight++
+		if next.IsZero() || now.Add(c.msgTimeout).Before(next) {
+			next = now.Add(c.msgTimeout)
+		}
+		// consumers get a copy, as the message may time out and be
+		// delivered again while they still look at it
+		// never blocks, nextConsumer made sure there is room
+		cp := *m
+		cc.msgChan <- &cp
+	}
+
+	if len(c.deferred) > 0 && (next.IsZero() || c.deferred[0].at.Before(next)) {
+		next = c.deferred[0].at
+	}
+	if next.IsZero() {
+		return 0
+	}
+	if wait := next.Sub(now); wait > 0 {
+		return wait
+	}
+	return time.Nanosecond
+}
+
+// nextConsumer returns the next consumer in turn with room for a message
+func (c *Channel) nextConsumer() *ChannelConsumer {
+	for i := 0; i < len(c.consumers); i++ {
+		cc := c.consumers[(c.next+i)%len(c.consumers)]
+		// a consumer that has not read messages which timed out meanwhile
+		// may have a full buffer despite its in-flight count
+		if cc.inFlight < cc.maxInFlight && len(cc.msgChan) < cap(cc.msgChan) {
+			c.next = (c.next + i + 1) % len(c.consumers)
+			return cc
+		}
+	}
+	return nil
+}
+
+// take removes a message the consumer holds from the in-flight set
+func (c *Channel) take(cc *ChannelConsumer, id MessageID) (*Message, error) {
+	if c.exitFlag {
+		return nil, ErrChannelExiting
+	}
+	f, ok := c.inFlight[id]
+	if !ok || f.consumer != cc {
+		return nil, ErrNotInFlight
+	}
+	delete(c.inFlight, id)
+	cc.inFlight--
+	return f.msg, nil
+}
+
+// Messages returns the channel messages are delivered on. It is closed
+// once the consumer or its Channel is closed.
+func (cc *ChannelConsumer) Messages() <-chan *Message {
+	return cc.msgChan
+}
+
+// Finish marks a message as successfully processed
+//处理完成
+func (cc *ChannelConsumer) Finish(id MessageID) error {
+	c := cc.ch
+	c.Lock()
+	defer c.Unlock()
+	_, err := c.take(cc, id)
+	if err != nil {
+		return err
+	}
+	c.wake()
+	return nil
+}
+
+// Requeue gives a message back to be delivered again, to any consumer,
+// after delay
+//重新入队，delay后再投递
+func (cc *ChannelConsumer) Requeue(id MessageID, delay time.Duration) error {
+	c := cc.ch
+	c.Lock()
+	defer c.Unlock()
+	m, err := c.take(cc, id)
+	if err != nil {
+		return err
+	}
+	c.requeueCount++
+	if delay > 0 {
+		heap.Push(&c.deferred, deferredMsg{msg: m, at: time.Now().Add(delay)})
+	} else {
+		c.queue = append(c.queue, m)
+	}
+	c.wake()
+	return nil
+}
+
+// Touch resets the timeout of a message still being processed
+func (cc *ChannelConsumer) Touch(id MessageID) error {
+	c := cc.ch
+	c.Lock()
+	defer c.Unlock()
+	if c.exitFlag {
+		return ErrChannelExiting
+	}
+	f, ok := c.inFlight[id]
+	if !ok || f.consumer != cc {
+		return ErrNotInFlight
+	}
+	f.deadline = time.Now().Add(c.msgTimeout)
+	return nil
+}
+
+// Close unsubscribes the consumer, requeueing the messages it holds,
+// including any still buffered in Messages
+func (cc *ChannelConsumer) Close() error {
+	c := cc.ch
+	c.Lock()
+	defer c.Unlock()
+	if cc.closed {
+		return nil
+	}
+	cc.closed = true
+
+	for i, o := range c.consumers {
+		if o == cc {
+			c.consumers = append(c.consumers[:i], c.consumers[i+1:]...)
+			break
+		}
+	}
+	for id, f := range c.inFlight {
+		if f.consumer == cc {
+			delete(c.inFlight, id)
+			c.queue = append(c.queue, f.msg)
+		}
+	}
+	cc.inFlight = 0
+	close(cc.msgChan)
+	c.wake()
+	return nil
+}
@@ -0,0 +1,168 @@
+package consume
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func receive(t *testing.T, cc *ChannelConsumer) *Message {
+	t.Helper()
+	select {
+	case m := <-cc.Messages():
+		return m
+	case <-time.After(time.Second):
+		t.Fatal("no message received")
+	}
+	return nil
+}
+
+func nothing(t *testing.T, cc *ChannelConsumer, wait time.Duration) {
+	t.Helper()
+	select {
+	case m := <-cc.Messages():
+		t.Fatalf("unexpected message %s", m.Body)
+	case <-time.After(wait):
+	}
+}
+
+func TestChannelFanOut(t *testing.T) {
+	topic := NewTopic("test", "test-full", SinkFunc(func(string, []*Message) error { return nil }))
+	defer topic.Close()
+
+	a, err := topic.GetChannel("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := topic.GetChannel("b")
+	ca, _ := a.Subscribe(10)
+	cb, _ := b.Subscribe(10)
+
+	for i := 0; i < 3; i++ {
+		if err := topic.Publish([]byte(fmt.Sprintf("msg %d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// every channel sees every message, in order
+	for i := 0; i < 3; i++ {
+		want := fmt.Sprintf("msg %d", i)
+		for _, cc := range []*ChannelConsumer{ca, cb} {
+			m := receive(t, cc)
+			if string(m.Body) != want || m.Attempts() != 1 {
+				t.Fatalf("got %s attempt %d, want %s attempt 1", m.Body, m.Attempts(), want)
+			}
+			if err := cc.Finish(m.ID); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if a.InFlight() != 0 || b.Depth() != 0 {
+		t.Fatalf("in flight %d, depth %d", a.InFlight(), b.Depth())
+	}
+}
+
+func TestChannelInFlight(t *testing.T) {
+	topic := NewTopic("test", "test-full", nil, WithMsgTimeout(50*time.Millisecond))
+	defer topic.Close()
+	ch, _ := topic.GetChannel("ch")
+	cc, _ := ch.Subscribe(1)
+
+	msgs := []*Message{NewMessage(0, []byte("one")), NewMessage(0, []byte("two"))}
+	if err := topic.PublishMulti(msgs); err != nil {
+		t.Fatal(err)
+	}
+
+	// max in flight holds back the second message
+	m := receive(t, cc)
+	if string(m.Body) != "one" {
+		t.Fatalf("got %s", m.Body)
+	}
+	nothing(t, cc, 20*time.Millisecond)
+
+	// requeued with a delay, it comes back after the other one
+	if err := cc.Requeue(m.ID, 30*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	m2 := receive(t, cc)
+	if string(m2.Body) != "two" {
+		t.Fatalf("got %s", m2.Body)
+	}
+	cc.Finish(m2.ID)
+	m = receive(t, cc)
+	if string(m.Body) != "one" || m.Attempts() != 2 {
+		t.Fatalf("got %s attempt %d", m.Body, m.Attempts())
+	}
+
+	// left alone, it times out and is delivered once more
+	m = receive(t, cc)
+	if m.Attempts() != 3 || ch.TimeoutCount() != 1 {
+		t.Fatalf("attempt %d, %d timeouts", m.Attempts(), ch.TimeoutCount())
+	}
+	if err := cc.Touch(m.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := cc.Finish(m.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := cc.Finish(m.ID); err != ErrNotInFlight {
+		t.Fatalf("got %v, want %v", err, ErrNotInFlight)
+	}
+}
+
+func TestChannelDuplicateIDs(t *testing.T) {
+	topic := NewTopic("test", "test-full", nil)
+	defer topic.Close()
+	ch, _ := topic.GetChannel("ch")
+	cc, _ := ch.Subscribe(2)
+
+	// the topic gives every message its own ID, whatever the caller set
+	m := NewMessage(7, []byte("one"))
+	if err := topic.PublishMulti([]*Message{m, NewMessage(7, []byte("two")), m}); err != nil {
+		t.Fatal(err)
+	}
+	a, b := receive(t, cc), receive(t, cc)
+	if a.ID == b.ID || a.ID == 7 || m.ID != 7 || ch.InFlight() != 2 {
+		t.Fatalf("IDs %d and %d, %d in flight", a.ID, b.ID, ch.InFlight())
+	}
+	if err := cc.Finish(a.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := cc.Finish(b.ID); err != nil {
+		t.Fatal(err)
+	}
+	c := receive(t, cc)
+	if c.ID == a.ID || c.ID == b.ID {
+		t.Fatalf("ID %d delivered twice", c.ID)
+	}
+	cc.Finish(c.ID)
+	if ch.InFlight() != 0 {
+		t.Fatalf("%d in flight", ch.InFlight())
+	}
+}
+
+func TestChannelConsumerClose(t *testing.T) {
+	topic := NewTopic("test", "test-full", nil)
+	ch, _ := topic.GetChannel("ch")
+	c1, _ := ch.Subscribe(1)
+
+	if err := topic.Publish([]byte("one")); err != nil {
+		t.Fatal(err)
+	}
+	receive(t, c1)
+	c2, _ := ch.Subscribe(1)
+	c1.Close()
+
+	// what the closed consumer held goes to the other one
+	m := receive(t, c2)
+	if string(m.Body) != "one" || m.Attempts() != 2 {
+		t.Fatalf("got %s attempt %d", m.Body, m.Attempts())
+	}
+
+	topic.Close()
+	if _, ok := <-c2.Messages(); ok {
+		t.Fatal("messages channel open after the topic closed")
+	}
+	if err := c2.Finish(m.ID); err != ErrChannelExiting {
+		t.Fatalf("got %v, want %v", err, ErrChannelExiting)
+	}
+}
@@ -0,0 +1,231 @@
+package consume
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Handler processes messages received by a Consumer. A nil error finishes
+// the message (FIN), any other requeues it (REQ) to be delivered again after
+// Config.RequeueDelay times its attempts.
+//消息处理函数
+type Handler interface {
+	HandleMessage(m *Message) error
+}
+
+// HandlerFunc adapts a function to a Handler
+type HandlerFunc func(m *Message) error
+
+func (f HandlerFunc) HandleMessage(m *Message) error {
+	return f(m)
+}
+
+// Consumer subscribes to a channel of a topic on a single nsqd over TCP and
+// hands every message to its Handler. It is a service JobTaskFunc: each
+// thread of the job runs its own connection in RunTask until it receives
+// its stop sign, reconnecting after errors.
+//NSQ消费者，可作为service.JobTask的TaskFunc
+type Consumer struct {
+	// 64bit atomic vars need to be first for proper alignment on 32bit platforms
+	received uint64
+	finished uint64
+	requeued uint64
+
+	addr    string
+	topic   string
+	channel string
+	handler Handler
+	config  *Config
+}
+
+// NewConsumer returns a Consumer of channel on topic at the nsqd at addr
+func NewConsumer(addr, topic, channel string, handler Handler, config *Config) (*Consumer, error) {
+	if topic == "" || channel == "" {
+		return nil, fmt.Errorf("invalid topic %q or channel %q", topic, channel)
+	}
+	if handler == nil {
+		return nil, errors.New("nil handler")
+	}
+	if config == nil {
+		config = NewConfig()
+	}
+	if config.MaxInFlight <= 0 {
+		return nil, fmt.Errorf("invalid max in flight %d", config.MaxInFlight)
+	}
+	return &Consumer{
+		addr:    addr,
+		topic:   topic,
+		channel: channel,
+		handler: handler,
+		config:  config,
+	}, nil
+}
+
+// Received returns the number of messages received
+func (c *Consumer) Received() uint64 {
+	return atomic.LoadUint64(&c.received)
+}
+
+// Finished returns the number of messages finished
+func (c *Consumer) Finished() uint64 {
+	return atomic.LoadUint64(&c.finished)
+}
+
+// Requeued returns the number of messages requeued
+func (c *Consumer) Requeued() uint64 {
+	return atomic.LoadUint64(&c.requeued)
+}
+
+// RunTask consumes until a sign is received on stop
+func (c *Consumer) RunTask(stop chan struct{}) {
+	for {
+		err := c.consume(stop)
+		if err == nil {
+			return
+		}
+		log.Printf("consumer %s/%s of %s: %v, reconnecting", c.topic, c.channel, c.addr, err)
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(c.config.ReconnectInterval):
+		}
+	}
+}
+
+// consume runs one connection, returning nil once stopped
+func (c *Consumer) consume(stop chan struct{}) error {
+	conn, err := dialNSQ(c.addr, c.config)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	err = conn.command(nil, "SUB", c.topic, c.channel)
+	if err == nil {
+		var resp []byte
+		resp, err = conn.readResponse()
+		if err == nil && !bytes.Equal(resp, respOK) {
+			err = fmt.Errorf("unexpected response %q", resp)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	err = conn.command(nil, "RDY", strconv.Itoa(c.config.MaxInFlight))
+	if err != nil {
+		return err
+	}
+
+	msgChan := make(chan *Message, c.config.MaxInFlight)
+	errChan := make(chan error, 1)
+	closeWait := make(chan struct{})
+	done := make(chan struct{})
+	defer close(done)
+	go c.readLoop(conn, msgChan, errChan, closeWait, done)
+
+	for {
+		select {
+		case m := <-msgChan:
+			err = c.handle(conn, m)
+			if err != nil {
+				return err
+			}
+		case err = <-errChan:
+			return err
+		case <-stop:
+			// nsqd requeues whatever is still in flight once we are gone
+			//退出时未处理完的消息由nsqd重新投递
+			err = conn.command(nil, "CLS")
+			if err == nil {
+				select {
+				case <-closeWait:
+				case <-errChan:
+				case <-time.After(c.config.ReadTimeout):
+				}
+			}
+			return nil
+		}
+	}
+}
+
+// readLoop reads frames until the connection fails, nsqd acknowledges CLS
+// or consume returns, answering heartbeats and passing messages on
+func (c *Consumer) readLoop(conn *nsqConn, msgChan chan<- *Message, errChan chan<- error, closeWait, done chan struct{}) {
+	for {
+		frameType, data, err := conn.readFrame()
+		if err != nil {
+			errChan <- err
+			return
+		}
+		switch frameType {
+		case FrameTypeResponse:
+			switch {
+			case bytes.Equal(data, respHeartbeat):
+				err = conn.command(nil, "NOP")
+				if err != nil {
+					errChan <- err
+					return
+				}
+			case bytes.Equal(data, respCloseWait):
+				close(closeWait)
+				return
+			}
+		case FrameTypeError:
+			// errors of FIN, REQ and TOUCH, e.g. for a message that timed
+			// out meanwhile, do not break the connection
+			log.Printf("consumer %s/%s of %s: nsqd error %s", c.topic, c.channel, c.addr, data)
+		case FrameTypeMessage:
+			m, err := DecodeMessage(data)
+			if err != nil {
+				errChan <- err
+				return
+			}
+			m.conn = conn
+			atomic.AddUint64(&c.received, 1)
+			select {
+			case msgChan <- m:
+			case <-done:
+				return
+			}
+		default:
+			errChan <- fmt.Errorf("unexpected frame type %d", frameType)
+			return
+		}
+	}
+}
+
+// handle processes a message and answers FIN or REQ
+func (c *Consumer) handle(conn *nsqConn, m *Message) error {
+	id := m.ID.Hex()
+	if c.config.MaxAttempts > 0 && m.attempts > uint32(c.config.MaxAttempts) {
+		log.Printf("consumer %s/%s: message %s gave up after %d attempts", c.topic, c.channel, id[:], m.attempts)
+		atomic.AddUint64(&c.finished, 1)
+		return conn.command(nil, "FIN", string(id[:]))
+	}
+
+	err := c.handler.HandleMessage(m)
+	if err == nil {
+		atomic.AddUint64(&c.finished, 1)
+		return conn.command(nil, "FIN", string(id[:]))
+	}
+	atomic.AddUint64(&c.requeued, 1)
+	delay := c.config.RequeueDelay * time.Duration(m.attempts)
+	return conn.command(nil, "REQ", string(id[:]), millis(delay))
+}
+
+// Touch resets the server side timeout of a message received by a Consumer
+// that is still being processed (TOUCH). It does nothing for other messages.
+//延长消息的处理超时
+func (m *Message) Touch() error {
+	if m.conn == nil {
+		return nil
+	}
+	id := m.ID.Hex()
+	return m.conn.command(nil, "TOUCH", string(id[:]))
+}
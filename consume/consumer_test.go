@@ -0,0 +1,585 @@
+package consume
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"twist/service"
+)
+
+var _ service.JobTaskFunc = (*Consumer)(nil)
+
+// fakeNSQD speaks enough of the V2 protocol to test the clients: one channel
+// per topic, no persistence, a heartbeat sent right after SUB and others on
+// demand, see heartbeat
+type fakeNSQD struct {
+	sync.Mutex
+	ln       net.Listener
+	ids      idGenerator
+	queues   map[string][]*Message
+	subs     map[string][]*fakeClient
+	inFlight map[MessageID]fakeInFlight
+	clients  map[*fakeClient]bool
+	cmds     []string
+	wg       sync.WaitGroup
+}
+
+type fakeInFlight struct {
+	msg    *Message
+	client *fakeClient
+}
+
+type fakeClient struct {
+	sync.Mutex
+	conn     net.Conn
+	topic    string
+	rdy      int
+	inFlight int
+	missed   bool // nothing read since the last heartbeat
+}
+
+func newFakeNSQD(t *testing.T) *fakeNSQD {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &fakeNSQD{
+		ln:       ln,
+		queues:   make(map[string][]*Message),
+		subs:     make(map[string][]*fakeClient),
+		inFlight: make(map[MessageID]fakeInFlight),
+		clients:  make(map[*fakeClient]bool),
+	}
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			d.wg.Add(1)
+			go func() {
+				defer d.wg.Done()
+				d.serve(conn)
+			}()
+		}
+	}()
+	return d
+}
+
+func (d *fakeNSQD) addr() string {
+	return d.ln.Addr().String()
+}
+
+func (d *fakeNSQD) close() {
+	d.ln.Close()
+	d.dropClients()
+	d.wg.Wait()
+}
+
+// heartbeat sends a heartbeat to every client, first closing those that sent
+// nothing since the previous one, as nsqd does
+func (d *fakeNSQD) heartbeat() {
+	d.Lock()
+	defer d.Unlock()
+	for c := range d.clients {
+		if c.missed {
+			c.conn.Close()
+			continue
+		}
+		c.missed = true
+		c.send(FrameTypeResponse, respHeartbeat)
+	}
+}
+
+// dropClients closes every client connection
+func (d *fakeNSQD) dropClients() {
+	d.Lock()
+	defer d.Unlock()
+	for c := range d.clients {
+		c.conn.Close()
+	}
+}
+
+func (d *fakeNSQD) commands(name string) []string {
+	d.Lock()
+	defer d.Unlock()
+	var cmds []string
+	for _, c := range d.cmds {
+		if strings.HasPrefix(c, name+" ") || c == name {
+			cmds = append(cmds, c)
+		}
+	}
+	return cmds
+}
+
+func (d *fakeNSQD) depth(topic string) int {
+	d.Lock()
+	defer d.Unlock()
+	return len(d.queues[topic])
+}
+
+func (c *fakeClient) send(frameType int32, data []byte) {
+	c.Lock()
+	defer c.Unlock()
+	var header [8]byte
+	binary.BigEndian.PutUint32(header[:4], uint32(len(data)+4))
+	binary.BigEndian.PutUint32(header[4:], uint32(frameType))
+	c.conn.Write(append(header[:], data...))
+}
+
+func readBody(r *bufio.Reader) ([]byte, error) {
+	var size [4]byte
+	_, err := io.ReadFull(r, size[:])
+	if err != nil {
+		return nil, err
+	}
+	body := make([]byte, binary.BigEndian.Uint32(size[:]))
+	_, err = io.ReadFull(r, body)
+	return body, err
+}
+
+func (d *fakeNSQD) serve(conn net.Conn) {
+	c := &fakeClient{conn: conn}
+	d.Lock()
+	d.clients[c] = true
+	d.Unlock()
+	defer func() {
+		d.Lock()
+		delete(d.clients, c)
+		d.Unlock()
+		conn.Close()
+	}()
+	r := bufio.NewReader(conn)
+
+	magic := make([]byte, len(protocolMagic))
+	_, err := io.ReadFull(r, magic)
+	if err != nil || string(magic) != string(protocolMagic) {
+		return
+	}
+	defer d.unsubscribe(c)
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		params := strings.Split(strings.TrimSuffix(line, "\n"), " ")
+		d.Lock()
+		d.cmds = append(d.cmds, strings.Join(params, " "))
+		c.missed = false
+		d.Unlock()
+
+		var resp []byte
+		switch params[0] {
+		case "IDENTIFY":
+			_, err = readBody(r)
+			resp = respOK
+		case "PUB", "DPUB":
+			var body []byte
+			body, err = readBody(r)
+			if err == nil {
+				resp, err = d.pub(params, [][]byte{body})
+			}
+		case "MPUB":
+			var body []byte
+			body, err = readBody(r)
+			if err == nil {
+				n := binary.BigEndian.Uint32(body[:4])
+				bodies := make([][]byte, 0, n)
+				for p := body[4:]; len(p) > 0; {
+					size := binary.BigEndian.Uint32(p[:4])
+					bodies = append(bodies, p[4:4+size])
+					p = p[4+size:]
+				}
+				resp, err = d.pub(params, bodies)
+			}
+		case "SUB":
+			c.topic = params[1]
+			d.Lock()
+			d.subs[c.topic] = append(d.subs[c.topic], c)
+			d.Unlock()
+			c.send(FrameTypeResponse, respOK)
+			c.send(FrameTypeResponse, respHeartbeat)
+			continue
+		case "RDY":
+			d.Lock()
+			c.rdy, _ = strconv.Atoi(params[1])
+			d.pump(c.topic)
+			d.Unlock()
+			continue
+		case "FIN", "REQ", "TOUCH":
+			err = d.ack(c, params)
+			if err != nil {
+				c.send(FrameTypeError, []byte(err.Error()))
+			}
+			continue
+		case "NOP":
+			continue
+		case "CLS":
+			d.unsubscribe(c)
+			resp = respCloseWait
+		default:
+			err = fmt.Errorf("E_INVALID unknown command %s", params[0])
+		}
+		if err != nil {
+			c.send(FrameTypeError, []byte(err.Error()))
+			continue
+		}
+		c.send(FrameTypeResponse, resp)
+	}
+}
+
+func (d *fakeNSQD) pub(params []string, bodies [][]byte) ([]byte, error) {
+	if len(params) < 2 || params[1] == "" {
+		return nil, errors.New("E_BAD_TOPIC")
+	}
+	topic := params[1]
+	var delay time.Duration
+	if params[0] == "DPUB" {
+		ms, err := strconv.Atoi(params[2])
+		if err != nil {
+			return nil, errors.New("E_INVALID")
+		}
+		delay = time.Duration(ms) * time.Millisecond
+	}
+
+	d.Lock()
+	defer d.Unlock()
+	for _, b := range bodies {
+		m := NewMessage(d.ids.next(), b)
+		m.Timestamp = time.Now().UnixNano()
+		d.requeue(topic, m, delay)
+	}
+	return respOK, nil
+}
+
+// requeue queues m after delay, called with d locked
+func (d *fakeNSQD) requeue(topic string, m *Message, delay time.Duration) {
+	if delay > 0 {
+		time.AfterFunc(delay, func() {
+			d.Lock()
+			defer d.Unlock()
+			d.requeue(topic, m, 0)
+		})
+		return
+	}
+	d.queues[topic] = append(d.queues[topic], m)
+	d.pump(topic)
+}
+
+// pump sends queued messages to subscribers with room, called with d locked
+func (d *fakeNSQD) pump(topic string) {
+	for _, c := range d.subs[topic] {
+		for c.inFlight < c.rdy && len(d.queues[topic]) > 0 {
+			m := d.queues[topic][0]
+			d.queues[topic] = d.queues[topic][1:]
+			m.attempts++
+			c.inFlight++
+			d.inFlight[m.ID] = fakeInFlight{msg: m, client: c}
+			var frame strings.Builder
+			m.WriteTo(&frame)
+			c.send(FrameTypeMessage, []byte(frame.String()))
+		}
+	}
+}
+
+func (d *fakeNSQD) ack(c *fakeClient, params []string) error {
+	id, err := ParseMessageID([]byte(params[1]))
+	if err != nil {
+		return errors.New("E_INVALID")
+	}
+	d.Lock()
+	defer d.Unlock()
+	f, ok := d.inFlight[id]
+	if !ok || f.client != c {
+		return fmt.Errorf("E_%s_FAILED", params[0])
+	}
+	switch params[0] {
+	case "FIN":
+		delete(d.inFlight, id)
+		c.inFlight--
+	case "REQ":
+		ms, err := strconv.Atoi(params[2])
+		if err != nil {
+			return errors.New("E_INVALID")
+		}
+		delete(d.inFlight, id)
+		c.inFlight--
+		d.requeue(c.topic, f.msg, time.Duration(ms)*time.Millisecond)
+	}
+	d.pump(c.topic)
+	return nil
+}
+
+// unsubscribe stops sending to c and requeues the messages it holds
+func (d *fakeNSQD) unsubscribe(c *fakeClient) {
+	d.Lock()
+	defer d.Unlock()
+	subs := d.subs[c.topic]
+	for i, o := range subs {
+		if o == c {
+			d.subs[c.topic] = append(subs[:i], subs[i+1:]...)
+			break
+		}
+	}
+	for id, f := range d.inFlight {
+		if f.client == c {
+			delete(d.inFlight, id)
+			c.inFlight--
+			d.requeue(c.topic, f.msg, 0)
+		}
+	}
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func testConfig() *Config {
+	config := NewConfig()
+	config.ReadTimeout = 5 * time.Second
+	config.ReconnectInterval = 10 * time.Millisecond
+	config.RequeueDelay = 10 * time.Millisecond
+	return config
+}
+
+func TestProducer(t *testing.T) {
+	d := newFakeNSQD(t)
+	defer d.close()
+	p := NewProducer(d.addr(), testConfig())
+
+	if err := p.Publish("t", []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.MultiPublish("t", [][]byte{[]byte("b"), []byte("c")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.DeferredPublish("t", 50*time.Millisecond, []byte("d")); err != nil {
+		t.Fatal(err)
+	}
+	if n := d.depth("t"); n != 3 {
+		t.Fatalf("depth %d, want 3 before the deferred message is due", n)
+	}
+	waitFor(t, "deferred message", func() bool { return d.depth("t") == 4 })
+
+	// an error frame leaves the connection usable
+	//错误帧不影响连接
+	var perr *ErrProtocol
+	if err := p.Publish("", []byte("x")); !errors.As(err, &perr) || perr.Message != "E_BAD_TOPIC" {
+		t.Fatalf("publish to invalid topic: %v", err)
+	}
+
+	// heartbeats are answered while idle, so nsqd keeps the connection
+	//空闲时也回应心跳
+	for i := 1; i <= 3; i++ {
+		d.heartbeat()
+		waitFor(t, "NOP", func() bool { return len(d.commands("NOP")) == i })
+	}
+	if err := p.Publish("t", []byte("e")); err != nil {
+		t.Fatal(err)
+	}
+	if cmds := d.commands("IDENTIFY"); len(cmds) != 1 {
+		t.Fatalf("identified %d times, want 1", len(cmds))
+	}
+	if cmds := d.commands("DPUB"); len(cmds) != 1 || cmds[0] != "DPUB t 50" {
+		t.Fatalf("DPUB commands %q", cmds)
+	}
+
+	// a broken connection is replaced by the next publish
+	d.dropClients()
+	if err := p.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	p.Publish("t", []byte("f"))
+	if err := p.Publish("t", []byte("g")); err != nil {
+		t.Fatal(err)
+	}
+	if cmds := d.commands("IDENTIFY"); len(cmds) != 2 {
+		t.Fatalf("identified %d times, want 2", len(cmds))
+	}
+
+	p.Stop()
+	if err := p.Publish("t", []byte("h")); err != ErrExiting {
+		t.Fatalf("publish after stop: %v", err)
+	}
+}
+
+func TestConsumerJobTask(t *testing.T) {
+	d := newFakeNSQD(t)
+	defer d.close()
+	p := NewProducer(d.addr(), testConfig())
+	defer p.Stop()
+
+	var mu sync.Mutex
+	handled := make(map[string]int)
+	handler := HandlerFunc(func(m *Message) error {
+		mu.Lock()
+		handled[string(m.Body)]++
+		mu.Unlock()
+		switch string(m.Body) {
+		case "fail":
+			if m.Attempts() == 1 {
+				return errors.New("try again")
+			}
+		case "slow":
+			return m.Touch()
+		}
+		return nil
+	})
+	config := testConfig()
+	config.MaxInFlight = 2
+	c, err := NewConsumer(d.addr(), "t", "ch", handler, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	job := &service.JobTask{
+		JobName:   "nsq",
+		TaskFunc:  c,
+		ThreadNum: 2,
+		StopChan:  make(chan struct{}, 2),
+	}
+	done := make(chan struct{})
+	go func() {
+		job.Run()
+		close(done)
+	}()
+
+	err = p.MultiPublish("t", [][]byte{[]byte("a"), []byte("fail"), []byte("slow")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "messages finished", func() bool { return c.Finished() == 3 })
+
+	mu.Lock()
+	if handled["a"] != 1 || handled["fail"] != 2 || handled["slow"] != 1 {
+		t.Fatalf("handled %v", handled)
+	}
+	mu.Unlock()
+	if c.Received() != 4 || c.Requeued() != 1 {
+		t.Fatalf("received %d, requeued %d", c.Received(), c.Requeued())
+	}
+	if cmds := d.commands("REQ"); len(cmds) != 1 || !strings.HasSuffix(cmds[0], " 10") {
+		t.Fatalf("REQ commands %q", cmds)
+	}
+	if cmds := d.commands("TOUCH"); len(cmds) != 1 {
+		t.Fatalf("TOUCH commands %q", cmds)
+	}
+	if cmds := d.commands("SUB"); len(cmds) != 2 || cmds[0] != "SUB t ch" {
+		t.Fatalf("SUB commands %q", cmds)
+	}
+	if cmds := d.commands("RDY"); len(cmds) != 2 || cmds[0] != "RDY 2" {
+		t.Fatalf("RDY commands %q", cmds)
+	}
+	// every connection answered its heartbeat
+	waitFor(t, "heartbeats answered", func() bool { return len(d.commands("NOP")) == 2 })
+
+	for i := 0; i < job.ThreadNum; i++ {
+		job.StopChan <- struct{}{}
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("job did not stop")
+	}
+	if cmds := d.commands("CLS"); len(cmds) != 2 {
+		t.Fatalf("CLS commands %q", cmds)
+	}
+}
+
+func TestConsumerMaxAttempts(t *testing.T) {
+	d := newFakeNSQD(t)
+	defer d.close()
+	p := NewProducer(d.addr(), testConfig())
+	defer p.Stop()
+
+	var calls int32
+	var mu sync.Mutex
+	handler := HandlerFunc(func(m *Message) error {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+		return errors.New("always failing")
+	})
+	config := testConfig()
+	config.MaxAttempts = 2
+	c, err := NewConsumer(d.addr(), "t", "ch", handler, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan struct{}, 1)
+	done := make(chan struct{})
+	go func() {
+		c.RunTask(stop)
+		close(done)
+	}()
+
+	if err := p.Publish("t", []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "message given up", func() bool { return c.Finished() == 1 })
+	mu.Lock()
+	if calls != 2 {
+		t.Fatalf("handled %d times, want 2", calls)
+	}
+	mu.Unlock()
+	if c.Received() != 3 || c.Requeued() != 2 {
+		t.Fatalf("received %d, requeued %d", c.Received(), c.Requeued())
+	}
+
+	stop <- struct{}{}
+	<-done
+}
+
+func TestConsumerReconnect(t *testing.T) {
+	d := newFakeNSQD(t)
+	defer d.close()
+	p := NewProducer(d.addr(), testConfig())
+	defer p.Stop()
+
+	c, err := NewConsumer(d.addr(), "t", "ch", HandlerFunc(func(m *Message) error { return nil }), testConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan struct{}, 1)
+	done := make(chan struct{})
+	go func() {
+		c.RunTask(stop)
+		close(done)
+	}()
+
+	if err := p.Publish("t", []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "first message", func() bool { return c.Finished() == 1 })
+
+	d.dropClients()
+	waitFor(t, "resubscribe", func() bool { return len(d.commands("SUB")) == 2 })
+	// the producer lost its connection too and finds out on next use
+	p.Publish("t", []byte("b"))
+	if err := p.Publish("t", []byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "second message", func() bool { return c.Finished() >= 2 })
+
+	stop <- struct{}{}
+	<-done
+}
@@ -0,0 +1,230 @@
+package consume
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+// Wire format
+//
+// WriteTo encodes a message as the body of an NSQ V2 message frame:
+//
+//	[8 byte timestamp][2 byte attempts][16 byte ID][body]
+//
+// with the nanosecond timestamp and attempts big-endian and the ID as 16
+// lowercase hex digits, as nsqd sends it. The trace ID and extension header
+// do not fit that layout, so WriteExtTo extends it the way ext-enabled nsqd
+// forks do, with a binary ID and trace ID and a versioned header before the
+// body:
+//
+//	[8 byte timestamp][2 byte attempts][8 byte ID][8 byte trace ID]
+//	[1 byte ext version][2 byte ext length][ext][body]
+//消息的二进制编码，兼容NSQ的消息帧格式
+const (
+	MsgIDLength       = 16
+	minValidMsgLength = MsgIDLength + 8 + 2 // Timestamp + Attempts
+	minValidExtLength = minValidMsgLength + 3
+
+	// extension header versions
+	noExtVer   = 0
+	jsonExtVer = 4
+
+	maxExtLength = 1<<16 - 1
+)
+
+var errShortMessage = errors.New("message too short")
+
+// ExtHeader is the key/value extension header of a message, stored JSON
+// encoded in ExtBytes
+//消息的扩展头
+type ExtHeader map[string]string
+
+// SetExt stores h in the message's ExtBytes
+func (m *Message) SetExt(h ExtHeader) error {
+	if len(h) == 0 {
+		m.ExtBytes = nil
+		return nil
+	}
+	b, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+	if len(b) > maxExtLength {
+		return fmt.Errorf("extension header of %d bytes too long", len(b))
+	}
+	m.ExtBytes = b
+	return nil
+}
+
+// Ext returns the extension header stored in the message's ExtBytes
+func (m *Message) Ext() (ExtHeader, error) {
+	if len(m.ExtBytes) == 0 {
+		return nil, nil
+	}
+	var h ExtHeader
+	err := json.Unmarshal(m.ExtBytes, &h)
+	return h, err
+}
+
+// Attempts returns how many times the message has been delivered
+func (m *Message) Attempts() uint32 {
+	return m.attempts
+}
+
+// Hex returns the ID as nsqd writes it
+func (id MessageID) Hex() [MsgIDLength]byte {
+	var b [8]byte
+	var h [MsgIDLength]byte
+	binary.BigEndian.PutUint64(b[:], uint64(id))
+	hex.Encode(h[:], b[:])
+	return h
+}
+
+// ParseMessageID parses an ID as written by Hex
+func ParseMessageID(h []byte) (MessageID, error) {
+	if len(h) != MsgIDLength {
+		return 0, fmt.Errorf("invalid message ID %q", h)
+	}
+	id, err := strconv.ParseUint(string(h), 16, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid message ID %q", h)
+	}
+	return MessageID(id), nil
+}
+
+// WriteTo writes the message in the NSQ message frame layout
+func (m *Message) WriteTo(w io.Writer) (int64, error) {
+	var buf [minValidMsgLength]byte
+	binary.BigEndian.PutUint64(buf[:8], uint64(m.Timestamp))
+	binary.BigEndian.PutUint16(buf[8:10], uint16(m.attempts))
+	id := m.ID.Hex()
+	copy(buf[10:], id[:])
+
+	n, err := w.Write(buf[:])
+	total := int64(n)
+	if err != nil {
+		return total, err
+	}
+	n, err = w.Write(m.Body)
+	total += int64(n)
+	return total, err
+}
+
+// WriteExtTo writes the message in the extended layout, keeping its trace
+// ID and extension header
+func (m *Message) WriteExtTo(w io.Writer) (int64, error) {
+	if len(m.ExtBytes) > maxExtLength {
+		return 0, fmt.Errorf("extension header of %d bytes too long", len(m.ExtBytes))
+	}
+	var buf [minValidExtLength]byte
+	binary.BigEndian.PutUint64(buf[:8], uint64(m.Timestamp))
+	binary.BigEndian.PutUint16(buf[8:10], uint16(m.attempts))
+	binary.BigEndian.PutUint64(buf[10:18], uint64(m.ID))
+	binary.BigEndian.PutUint64(buf[18:26], m.TraceID)
+	buf[26] = noExtVer
+	if len(m.ExtBytes) > 0 {
+		buf[26] = jsonExtVer
+	}
+	binary.BigEndian.PutUint16(buf[27:29], uint16(len(m.ExtBytes)))
+
+	total := int64(0)
+	for _, b := range [][]byte{buf[:], m.ExtBytes, m.Body} {
+		n, err := w.Write(b)
+		total += int64(n)
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// DecodeMessage decodes a message written by WriteTo, or sent by nsqd. The
+// body refers to b.
+func DecodeMessage(b []byte) (*Message, error) {
+	if len(b) < minValidMsgLength {
+		return nil, errShortMessage
+	}
+	id, err := ParseMessageID(b[10:minValidMsgLength])
+	if err != nil {
+		return nil, err
+	}
+	return &Message{
+		ID:        id,
+		Timestamp: int64(binary.BigEndian.Uint64(b[:8])),
+		attempts:  uint32(binary.BigEndian.Uint16(b[8:10])),
+		Body:      b[minValidMsgLength:],
+	}, nil
+}
+
+// DecodeMessageExt decodes a message written by WriteExtTo. The body and
+// extension header refer to b.
+func DecodeMessageExt(b []byte) (*Message, error) {
+	if len(b) < minValidExtLength {
+		return nil, errShortMessage
+	}
+	m := &Message{
+		Timestamp: int64(binary.BigEndian.Uint64(b[:8])),
+		attempts:  uint32(binary.BigEndian.Uint16(b[8:10])),
+		ID:        MessageID(binary.BigEndian.Uint64(b[10:18])),
+		TraceID:   binary.BigEndian.Uint64(b[18:26]),
+	}
+	extVer := b[26]
+	extLen := int(binary.BigEndian.Uint16(b[27:29]))
+	if len(b) < minValidExtLength+extLen {
+		return nil, errShortMessage
+	}
+	switch extVer {
+	case noExtVer:
+		if extLen != 0 {
+			return nil, fmt.Errorf("extension header without version")
+		}
+	case jsonExtVer:
+		m.ExtBytes = b[minValidExtLength : minValidExtLength+extLen]
+	default:
+		return nil, fmt.Errorf("unknown extension header version %d", extVer)
+	}
+	m.Body = b[minValidExtLength+extLen:]
+	return m, nil
+}
+
+// idGenerator hands out the message IDs of a topic: the millisecond time in
+// the high bits and a sequence number in the low 22, so that they increase
+// monotonically and stay unique across restarts.
+//消息ID生成器，单调递增
+type idGenerator struct {
+	last uint64
+}
+
+const sequenceBits = 22
+
+func (g *idGenerator) next() MessageID {
+	id := uint64(time.Now().UnixNano()/int64(time.Millisecond)) << sequenceBits
+	if id <= g.last {
+		// same millisecond, or the clock went back
+		id = g.last + 1
+	}
+	g.last = id
+	return MessageID(id)
+}
+
+type traceIDKey struct{}
+
+// WithTraceID returns a context carrying a trace ID, which PublishContext
+// and PublishMultiContext set on the messages they publish
+//在context中携带trace id
+func WithTraceID(ctx context.Context, traceID uint64) context.Context {
+	return context.WithValue(ctx, traceIDKey{}, traceID)
+}
+
+// TraceIDFromContext returns the trace ID carried by ctx, if any
+func TraceIDFromContext(ctx context.Context) (uint64, bool) {
+	traceID, ok := ctx.Value(traceIDKey{}).(uint64)
+	return traceID, ok
+}
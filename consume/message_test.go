@@ -0,0 +1,103 @@
+package consume
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"testing"
+)
+
+func TestMessageWireFormat(t *testing.T) {
+	m := NewMessage(0x0123456789abcdef, []byte("hello"))
+	m.attempts = 3
+
+	var buf bytes.Buffer
+	n, err := m.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(buf.Len()) || buf.Len() != minValidMsgLength+5 {
+		t.Fatalf("wrote %d bytes, buffer has %d", n, buf.Len())
+	}
+	// nsqd sends the ID as hex digits
+	if got := string(buf.Bytes()[10:26]); got != "0123456789abcdef" {
+		t.Fatalf("ID encoded as %q", got)
+	}
+	d, err := DecodeMessage(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.ID != m.ID || d.Timestamp != m.Timestamp || d.Attempts() != 3 || string(d.Body) != "hello" {
+		t.Fatalf("decoded %+v, want %+v", d, m)
+	}
+
+	m.TraceID = 42
+	if err := m.SetExt(ExtHeader{"tag": "a", "from": "test"}); err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	if _, err := m.WriteExtTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	d, err = DecodeMessageExt(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.ID != m.ID || d.TraceID != 42 || d.Attempts() != 3 || string(d.Body) != "hello" {
+		t.Fatalf("decoded %+v, want %+v", d, m)
+	}
+	ext, err := d.Ext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ext["tag"] != "a" || ext["from"] != "test" {
+		t.Fatalf("ext header %v", ext)
+	}
+
+	if _, err := DecodeMessage(buf.Bytes()[:10]); err == nil {
+		t.Fatal("decoded a truncated message")
+	}
+}
+
+func TestMessageIDs(t *testing.T) {
+	var g idGenerator
+	last := g.next()
+	for i := 0; i < 100000; i++ {
+		id := g.next()
+		if id <= last {
+			t.Fatalf("ID %d after %d", id, last)
+		}
+		last = id
+	}
+}
+
+func TestTopicMessageMetadata(t *testing.T) {
+	var mu sync.Mutex
+	var got []*Message
+	topic := NewTopic("test", "test-full", SinkFunc(func(topic string, msgs []*Message) error {
+		mu.Lock()
+		defer mu.Unlock()
+		got = append(got, msgs...)
+		return nil
+	}))
+	defer topic.Close()
+
+	ctx := WithTraceID(context.Background(), 7)
+	if err := topic.PublishContext(ctx, []byte("one")); err != nil {
+		t.Fatal(err)
+	}
+	if err := topic.PublishMultiContext(ctx, []*Message{NewMessage(0, []byte("two")), NewMessage(0, []byte("three"))}); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 3 {
+		t.Fatalf("committed %d messages", len(got))
+	}
+	for i, m := range got {
+		if m.TraceID != 7 {
+			t.Fatalf("message %d has trace ID %d", i, m.TraceID)
+		}
+		if i > 0 && m.ID <= got[i-1].ID {
+			t.Fatalf("message %d has ID %d after %d", i, m.ID, got[i-1].ID)
+		}
+	}
+}
@@ -1,17 +1,18 @@
-package main
+package consume
 
 import (
+	"context"
 	"errors"
 	"log"
 	"sync"
 	"sync/atomic"
 	"time"
-	core "twist/core/json"
 )
 
 type PubInfo struct {
 	Done     chan struct{}
 	MsgBody  []byte
+	TraceID  uint64
 	StartPub time.Time
 	Err      error
 }
@@ -19,14 +20,105 @@ type PubInfo struct {
 type PubInfoChan chan *PubInfo
 type MPubInfoChan chan *MPubInfo
 
+var (
+	// ErrExiting is returned to publishers when the Topic is closed before
+	// their message is committed
+	ErrExiting = errors.New("exiting")
+	// ErrOverloaded is returned when the wait queue stays full for longer
+	// than the topic allows a publisher to wait for room
+	ErrOverloaded = errors.New("pub to wait channel timeout")
+	// ErrPubTimeout is returned when a message spends longer than the pub
+	// wait timeout in the wait queue before the pub loop gets to it
+	ErrPubTimeout = errors.New("pub timeout while pop wait queue")
+)
+
+// Sink commits the batches of messages published to a Topic. The error it
+// returns is handed to every publisher of the batch.
+//批量提交消息的接口，返回的错误会交给这一批的所有发布者
+type Sink interface {
+	Commit(topic string, msgs []*Message) error
+}
+
+// SinkFunc adapts an ordinary function to a Sink
+type SinkFunc func(topic string, msgs []*Message) error
+
+func (f SinkFunc) Commit(topic string, msgs []*Message) error {
+	return f(topic, msgs)
+}
+
+// logSink only logs each batch, it is used when a Topic has no Sink
+type logSink struct{}
+
+func (logSink) Commit(topic string, msgs []*Message) error {
+	log.Printf("%s success import db, %d messages", topic, len(msgs))
+	return nil
+}
+
+// Topic gathers messages published concurrently into batches, commits each
+// batch to its Sink in one go, and releases the publishers of the batch with
+// the result (group commit).
+//按批提交消息的topic
 type Topic struct {
+	// 64bit atomic vars need to be first for proper alignment on 32bit platforms
+	pubFailedCnt int64
+
 	sync.Mutex
 	tname           string
 	fullName        string
 	pubWaitingChan  PubInfoChan
 	mpubWaitingChan MPubInfoChan
 	quitChan        chan struct{}
-	pubFailedCnt    int64
+	exitChan        chan struct{} // closed once the pub loop has finished
+
+	sink           Sink
+	maxBatchSize   int           //每批最多的消息数
+	maxBatchBytes  int           //每批最多的字节数，0不限制
+	maxLinger      time.Duration //等待凑批的最长时间
+	pubWaitTimeout time.Duration //在等待队列中的超时时间
+	waitQueueSize  int           //等待队列的长度
+	queueWait      time.Duration //等待队列满时最多等多久
+	ids            idGenerator   //消息ID生成器，只在pub loop中使用
+	msgTimeout     time.Duration //channel中消息的处理超时
+
+	channels map[string]*Channel // guarded by the embedded Mutex
+
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+// NewTopic creates a topic committing to sink, configured by opts, and
+// starts its pub loop
+//创建topic并启动提交循环
+func NewTopic(name string, fullName string, sink Sink, opts ...Option) *Topic {
+	if sink == nil {
+		sink = logSink{}
+	}
+	t := &Topic{
+		tname:          name,
+		fullName:       fullName,
+		quitChan:       make(chan struct{}),
+		exitChan:       make(chan struct{}),
+		sink:           sink,
+		maxBatchSize:   defaultMaxBatchSize,
+		pubWaitTimeout: defaultPubWaitTimeout,
+		queueWait:      defaultPubWaitTimeout,
+		msgTimeout:     defaultMsgTimeout,
+		channels:       make(map[string]*Channel),
+	}
+	for _, opt := range opts {
+		opt(t)
+	}
+	t.pubWaitingChan = make(PubInfoChan, t.waitQueueSize)
+	t.mpubWaitingChan = make(MPubInfoChan, t.waitQueueSize)
+
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		defer close(t.exitChan)
+		internalPubLoop(t)
+		t.closeChannels()
+	}()
+	return t
 }
 
 func (t *Topic) GetWaitChan() PubInfoChan {
@@ -57,48 +149,181 @@ func (t *Topic) GetMWaitChan() MPubInfoChan {
 	return t.mpubWaitingChan
 }
 
+// Publish publishes a message and waits for the batch it went into to be
+// committed, returning the Sink's result
+//发布一条消息，等待所在的批次提交完成
+func (t *Topic) Publish(msgBody []byte) error {
+	return t.PublishContext(context.Background(), msgBody)
+}
+
+// PublishContext is Publish giving up when ctx is done. The message gets
+// the trace ID carried by ctx, see WithTraceID. A message already
+// in the wait queue by then cannot be withdrawn, so it may still be
+// committed even though ctx.Err() is returned.
+//带context发布消息
+func (t *Topic) PublishContext(ctx context.Context, msgBody []byte) error {
+	return internalPubAsync(ctx, nil, msgBody, t)
+}
+
+// PublishMulti publishes msgs as one unit: they all go into the same batch,
+// so they are committed together or not at all, and it returns the result
+// of that batch. The topic publishes copies of msgs, each given a new ID,
+// whatever ID it had, so that IDs stay unique within the topic.
+//批量发布消息，同一批提交，要么全部成功要么全部失败
+func (t *Topic) PublishMulti(msgs []*Message) error {
+	return t.PublishMultiContext(context.Background(), msgs)
+}
+
+// PublishMultiContext is PublishMulti giving up when ctx is done, with the
+// same caveat as PublishContext
+func (t *Topic) PublishMultiContext(ctx context.Context, msgs []*Message) error {
+	if len(msgs) == 0 {
+		return nil
+	}
+	return internalMPubAsync(ctx, nil, msgs, t)
+}
+
+// Close stops the pub loop and waits for it to finish. Publishers whose
+// messages are not committed yet, or still waiting for room in the wait
+// queue, fail with ErrExiting. Its channels are closed too.
+//关闭topic，没提交的发布者都返回ErrExiting
+func (t *Topic) Close() error {
+	t.closeOnce.Do(func() {
+		close(t.quitChan)
+	})
+	t.wg.Wait()
+	return nil
+}
+
 var serverPubFailedCnt int64
 
 func incrServerPubFailed() {
 	atomic.AddInt64(&serverPubFailedCnt, 1)
 }
 
-func internalPubAsync(clientTimer *time.Timer, msgBody []byte, topic *Topic) error {
+// ServerPubFailed returns the number of failed publishes across all topics
+func ServerPubFailed() int64 {
+	return atomic.LoadInt64(&serverPubFailedCnt)
+}
+
+func internalPubAsync(ctx context.Context, clientTimer *time.Timer, msgBody []byte, topic *Topic) error {
 	info := &PubInfo{
 		Done:     make(chan struct{}),
 		MsgBody:  msgBody,
 		StartPub: time.Now(),
 	}
+	info.TraceID, _ = TraceIDFromContext(ctx)
+
+	select {
+	case <-topic.QuitChan():
+		return ErrExiting
+	default:
+	}
 
 	select {
 	case topic.GetWaitChan() <- info:
 	default:
-		//if clientTimer == nil {
-		//	clientTimer = time.NewTimer(pubWaitTimeout)
-		//} else {
-		//	if !clientTimer.Stop() {
-		//		select {
-		//		case <-clientTimer.C:
-		//		default:
-		//		}
-		//	}
-		//	clientTimer.Reset(pubWaitTimeout)
-		//}
-		//defer clientTimer.Stop()
-		//select {
-		//case topic.GetWaitChan() <- info:
-		//case <-topic.QuitChan():
-		//	log.Printf("topic %v put messages failed at exiting", topic.GetFullName())
-		//	return errors.New("exiting")
-		//case <-clientTimer.C:
-		//	log.Printf("topic %v put messages timeout ", topic.GetFullName())
-		//	topic.IncrPubFailed()
-		//	incrServerPubFailed()
-		//	return errors.New("pub to wait channel timeout")
-		//}
+		//等待队列满了，最多等待queueWait
+		if topic.queueWait <= 0 {
+			topic.overloaded()
+			return ErrOverloaded
+		}
+		clientTimer = topic.resetTimer(clientTimer)
+		defer clientTimer.Stop()
+		select {
+		case topic.GetWaitChan() <- info:
+		case <-topic.QuitChan():
+			log.Printf("topic %v put messages failed at exiting", topic.GetFullName())
+			return ErrExiting
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-clientTimer.C:
+			topic.overloaded()
+			return ErrOverloaded
+		}
+	}
+	return topic.waitDone(ctx, info.Done, &info.Err)
+}
+
+func internalMPubAsync(ctx context.Context, clientTimer *time.Timer, msgs []*Message, topic *Topic) error {
+	info := &MPubInfo{
+		Done:     make(chan struct{}),
+		Msgs:     msgs,
+		StartPub: time.Now(),
+	}
+	info.TraceID, _ = TraceIDFromContext(ctx)
+
+	select {
+	case <-topic.QuitChan():
+		return ErrExiting
+	default:
+	}
+
+	select {
+	case topic.GetMWaitChan() <- info:
+	default:
+		if topic.queueWait <= 0 {
+			topic.overloaded()
+			return ErrOverloaded
+		}
+		clientTimer = topic.resetTimer(clientTimer)
+		defer clientTimer.Stop()
+		select {
+		case topic.GetMWaitChan() <- info:
+		case <-topic.QuitChan():
+			log.Printf("topic %v put messages failed at exiting", topic.GetFullName())
+			return ErrExiting
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-clientTimer.C:
+			topic.overloaded()
+			return ErrOverloaded
+		}
+	}
+	return topic.waitDone(ctx, info.Done, &info.Err)
+}
+
+// resetTimer arms clientTimer, or a new timer if it is nil, for the time a
+// publisher may wait for room in the wait queue
+func (t *Topic) resetTimer(clientTimer *time.Timer) *time.Timer {
+	if clientTimer == nil {
+		return time.NewTimer(t.queueWait)
+	}
+	if !clientTimer.Stop() {
+		select {
+		case <-clientTimer.C:
+		default:
+		}
+	}
+	clientTimer.Reset(t.queueWait)
+	return clientTimer
+}
+
+func (t *Topic) overloaded() {
+	log.Printf("topic %v put messages timeout ", t.GetFullName())
+	t.IncrPubFailed()
+	incrServerPubFailed()
+}
+
+// waitDone waits for the pub loop to release a publisher whose message is
+// in the wait queue, returning *err once done is closed
+func (t *Topic) waitDone(ctx context.Context, done chan struct{}, err *error) error {
+	select {
+	case <-done:
+		return *err
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.exitChan:
+		// the pub loop released everything it saw before finishing, so
+		// anything left was queued too late
+		//退出前已经处理过的以done为准
+		select {
+		case <-done:
+			return *err
+		default:
+			return ErrExiting
+		}
 	}
-	<-info.Done
-	return info.Err
 }
 
 type MessageID uint64
@@ -106,6 +331,7 @@ type MessageID uint64
 type MPubInfo struct {
 	Done     chan struct{}
 	Msgs     []*Message
+	TraceID  uint64
 	StartPub time.Time
 	Err      error
 }
@@ -117,13 +343,9 @@ type Message struct {
 	Timestamp int64
 	attempts  uint32
 	ExtBytes  []byte
+	conn      *nsqConn //received by a Consumer over this connection
 }
 
-const (
-	maxBatchNum    = 0
-	pubWaitTimeout = time.Second * 3
-)
-
 var testPopQueueTimeout int32
 
 func NewMessage(id MessageID, body []byte) *Message {
@@ -135,10 +357,25 @@ func NewMessage(id MessageID, body []byte) *Message {
 	}
 }
 
+// batchFull reports whether a batch of n messages of size bytes should be
+// committed without waiting for more
+func (t *Topic) batchFull(n int, size int) bool {
+	if n >= t.maxBatchSize {
+		return true
+	}
+	return t.maxBatchBytes > 0 && size >= t.maxBatchBytes
+}
+
+// popTimeout fails a publisher that waited too long in the wait queue
+func (t *Topic) popTimeout(startPub time.Time) bool {
+	return time.Since(startPub) >= t.pubWaitTimeout || atomic.LoadInt32(&testPopQueueTimeout) == 1
+}
+
 func internalPubLoop(topic *Topic) {
-	messages := make([]*Message, 0, 100)
-	pubInfoList := make([]*PubInfo, 0, 100)
-	mpubInfoList := make([]*MPubInfo, 0, 100)
+	messages := make([]*Message, 0, topic.maxBatchSize)
+	pubInfoList := make([]*PubInfo, 0, topic.maxBatchSize)
+	mpubInfoList := make([]*MPubInfo, 0, topic.maxBatchSize)
+	batchBytes := 0
 	topicName := topic.GetTopicName()
 	log.Printf("start pub loop for topic: %v ", topic.GetFullName())
 	defer func() {
@@ -155,153 +392,148 @@ func internalPubLoop(topic *Topic) {
 		}
 		log.Printf("quit pub loop for topic: %v, left: %v, %v ", topic.GetFullName(), len(pubInfoList), len(mpubInfoList))
 		for _, info := range pubInfoList {
-			info.Err = errors.New("exiting")
+			info.Err = ErrExiting
 			close(info.Done)
 		}
 		for _, info := range mpubInfoList {
-			info.Err = errors.New("exiting")
+			info.Err = ErrExiting
 			close(info.Done)
 		}
 	}()
-	//quitChan := topic.QuitChan()
-	infoChan := topic.GetWaitChan()
-	//minfoChan := topic.GetMWaitChan()
-	for {
-		if len(messages) > maxBatchNum {
-			infoChan = nil
-			//minfoChan = nil
-		} else {
-			infoChan = topic.GetWaitChan()
-			//minfoChan = topic.GetMWaitChan()
+
+	//凑批的等待时间从第一条消息开始算
+	lingerTimer := time.NewTimer(time.Hour)
+	lingerTimer.Stop()
+	defer lingerTimer.Stop()
+
+	add := func(info *PubInfo) {
+		if len(info.MsgBody) <= 0 {
+			log.Println("empty msg body")
 		}
-		select {
-		//case <-quitChan:
-		//	return
-		//case minfo := <-minfoChan:
-		//	if time.Since(minfo.StartPub) >= pubWaitTimeout || atomic.LoadInt32(&testPopQueueTimeout) == 1 {
-		//		topic.IncrPubFailed()
-		//		incrServerPubFailed()
-		//		minfo.Err = errors.New("pub timeout while pop wait queue")
-		//		close(minfo.Done)
-		//		log.Printf("topic %v put message timeout while pop queue, pub start: %s", topic.GetFullName(), minfo.StartPub)
-		//		continue
-		//	}
-		//	messages = append(messages, minfo.Msgs...)
-		//	mpubInfoList = append(mpubInfoList, minfo)
-		case info := <-infoChan:
-			if len(info.MsgBody) <= 0 {
-				log.Println("empty msg body")
+		if topic.popTimeout(info.StartPub) {
+			topic.IncrPubFailed()
+			incrServerPubFailed()
+			info.Err = ErrPubTimeout
+			close(info.Done)
+			log.Printf("topic %v put message timeout while pop queue, pub start: %s", topic.GetFullName(), info.StartPub)
+			return
+		}
+		if len(messages) == 0 && topic.maxLinger > 0 {
+			lingerTimer.Reset(topic.maxLinger)
+		}
+		msg := NewMessage(topic.ids.next(), info.MsgBody)
+		msg.TraceID = info.TraceID
+		messages = append(messages, msg)
+		pubInfoList = append(pubInfoList, info)
+		batchBytes += len(info.MsgBody)
+	}
+	//批量发布的消息整体放进同一批
+	addMulti := func(minfo *MPubInfo) {
+		if topic.popTimeout(minfo.StartPub) {
+			topic.IncrPubFailed()
+			incrServerPubFailed()
+			minfo.Err = ErrPubTimeout
+			close(minfo.Done)
+			log.Printf("topic %v put messages timeout while pop queue, pub start: %s", topic.GetFullName(), minfo.StartPub)
+			return
+		}
+		if len(messages) == 0 && topic.maxLinger > 0 {
+			lingerTimer.Reset(topic.maxLinger)
+		}
+		for _, m := range minfo.Msgs {
+			//ID总是由topic分配，channel按ID跟踪投递中的消息
+			cp := *m
+			cp.ID = topic.ids.next()
+			if cp.TraceID == 0 {
+				cp.TraceID = minfo.TraceID
 			}
-			if time.Since(info.StartPub) >= pubWaitTimeout || atomic.LoadInt32(&testPopQueueTimeout) == 1 {
-				topic.IncrPubFailed()
-				incrServerPubFailed()
-				info.Err = errors.New("pub timeout while pop wait queue")
-				close(info.Done)
-				log.Printf("topic %v put message timeout while pop queue, pub start: %s", topic.GetFullName(), info.StartPub)
-				continue
+			if cp.Timestamp == 0 {
+				cp.Timestamp = time.Now().UnixNano()
 			}
-			messages = append(messages, NewMessage(0, info.MsgBody))
-			pubInfoList = append(pubInfoList, info)
+			batchBytes += len(cp.Body)
+			messages = append(messages, &cp)
+		}
+		mpubInfoList = append(mpubInfoList, minfo)
+	}
+
+	quitChan := topic.QuitChan()
+	infoChan := topic.GetWaitChan()
+	minfoChan := topic.GetMWaitChan()
+	flush := false
+	for {
+		//优先处理退出
+		select {
+		case <-quitChan:
+			return
 		default:
-			if len(messages) == 0 {
-				select {
-				//case <-quitChan:
-				//	return
-				case info := <-infoChan:
-					if time.Since(info.StartPub) >= pubWaitTimeout || atomic.LoadInt32(&testPopQueueTimeout) == 1 {
-						topic.IncrPubFailed()
-						incrServerPubFailed()
-						info.Err = errors.New("pub timeout while pop wait queue")
-						close(info.Done)
-						log.Printf("topic %v put message timeout while pop queue, pub start: %s", topic.GetFullName(), info.StartPub)
-						continue
-					}
-					messages = append(messages, NewMessage(0, info.MsgBody))
-					pubInfoList = append(pubInfoList, info)
-					//case minfo := <-minfoChan:
-					//	if time.Since(minfo.StartPub) >= pubWaitTimeout || atomic.LoadInt32(&testPopQueueTimeout) == 1 {
-					//		topic.IncrPubFailed()
-					//		incrServerPubFailed()
-					//		minfo.Err = errors.New("pub timeout while pop wait queue")
-					//		close(minfo.Done)
-					//		continue
-					//	}
-					//	messages = append(messages, minfo.Msgs...)
-					//	mpubInfoList = append(mpubInfoList, minfo)
-				}
-				continue
-			}
+		}
+
+		if len(messages) > 0 && (flush || topic.batchFull(len(messages), batchBytes)) {
 			if tcnt := atomic.LoadInt32(&testPopQueueTimeout); tcnt >= 1 {
 				time.Sleep(time.Second * time.Duration(tcnt))
 			}
-			log.Printf("%s success import db", topicName)
+			err := topic.sink.Commit(topicName, messages)
+			if err != nil {
+				log.Printf("topic %v commit %d messages failed: %v", topic.GetFullName(), len(messages), err)
+			} else {
+				//提交成功后分发给所有channel
+				topic.fanOut(messages)
+			}
 			for _, info := range pubInfoList {
-				info.Err = nil
+				if err != nil {
+					topic.IncrPubFailed()
+					incrServerPubFailed()
+				}
+				info.Err = err
 				close(info.Done)
 			}
 			for _, minfo := range mpubInfoList {
-				minfo.Err = nil
+				if err != nil {
+					topic.IncrPubFailed()
+					incrServerPubFailed()
+				}
+				minfo.Err = err
 				close(minfo.Done)
 			}
+			if !lingerTimer.Stop() && topic.maxLinger > 0 && !flush {
+				<-lingerTimer.C
+			}
 			pubInfoList = pubInfoList[:0]
 			mpubInfoList = mpubInfoList[:0]
 			messages = messages[:0]
+			batchBytes = 0
+			flush = false
+			continue
 		}
 
-	}
-}
-
-func main() {
-	topicCh := make(chan *Topic, 0)
-
-	go func() {
-		for {
-			select {
-			case topic := <-topicCh:
-				//item := map[string]interface{}{
-				//	"msgId":   i,
-				//	"content": fmt.Sprintf("hello world->%d", i),
-				//}
-				//fmt.Println(topic)
-				item := map[string]interface{}{
-					"content": "hello world",
-				}
-				msgBody, err := core.JSON.Marshal(item)
-				if err != nil {
-					log.Printf("Marshal err: %v", err)
-					continue
-				}
-				go func() {
-					for {
-						internalPubLoop(topic)
-					}
-
-				}()
-
-				err = internalPubAsync(nil, msgBody, topic)
-				if err != nil {
-					log.Printf("internalPubAsync err: %v", err)
-					continue
+		var linger <-chan time.Time
+		if len(messages) > 0 {
+			if topic.maxLinger <= 0 {
+				//没有更多等待中的消息就直接提交
+				select {
+				case <-quitChan:
+					return
+				case info := <-infoChan:
+					add(info)
+				case minfo := <-minfoChan:
+					addMulti(minfo)
+				default:
+					flush = true
 				}
-
-			default:
-
-
+				continue
 			}
+			linger = lingerTimer.C
 		}
-	}()
-
-	topic := &Topic{
-		tname:           "tname",
-		fullName:        "name-full",
-		pubWaitingChan:  make(PubInfoChan, 0),
-		mpubWaitingChan: make(MPubInfoChan, 0),
-		quitChan:        make(chan struct{}, 0),
-		pubFailedCnt:    0,
-	}
-	for i := 1; i <= 1000; i++ {
-		topicCh <- topic
 
+		select {
+		case <-quitChan:
+			return
+		case info := <-infoChan:
+			add(info)
+		case minfo := <-minfoChan:
+			addMulti(minfo)
+		case <-linger:
+			flush = true
+		}
 	}
-
 }
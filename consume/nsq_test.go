@@ -0,0 +1,244 @@
+package consume
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"twist/diskqueue"
+)
+
+// recordSink remembers the size of every batch it commits
+type recordSink struct {
+	sync.Mutex
+	batches []int
+	err     error
+}
+
+func (s *recordSink) Commit(topic string, msgs []*Message) error {
+	s.Lock()
+	defer s.Unlock()
+	s.batches = append(s.batches, len(msgs))
+	return s.err
+}
+
+func (s *recordSink) total() int {
+	s.Lock()
+	defer s.Unlock()
+	n := 0
+	for _, b := range s.batches {
+		n += b
+	}
+	return n
+}
+
+func publishAll(t *testing.T, topic *Topic, n int) []error {
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = topic.Publish([]byte(fmt.Sprintf("msg %d", i)))
+		}(i)
+	}
+	wg.Wait()
+	return errs
+}
+
+func TestTopicGroupCommit(t *testing.T) {
+	sink := &recordSink{}
+	topic := NewTopic("test", "test-full", sink, WithMaxBatch(10, 0), WithMaxLinger(20*time.Millisecond))
+	defer topic.Close()
+
+	for i, err := range publishAll(t, topic, 95) {
+		if err != nil {
+			t.Fatalf("publish %d: %v", i, err)
+		}
+	}
+	if n := sink.total(); n != 95 {
+		t.Fatalf("committed %d messages, want 95", n)
+	}
+	for _, b := range sink.batches {
+		if b > 10 {
+			t.Fatalf("batch of %d messages over the limit", b)
+		}
+	}
+	if len(sink.batches) >= 95 {
+		t.Fatalf("messages were not batched: %v", sink.batches)
+	}
+}
+
+func TestTopicMaxBatchBytes(t *testing.T) {
+	sink := &recordSink{}
+	topic := NewTopic("test", "test-full", sink, WithMaxBatch(100, 10), WithMaxLinger(time.Second))
+	defer topic.Close()
+
+	// each body is 10 bytes, so the byte limit commits every message at once
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := topic.Publish([]byte("0123456789")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if time.Since(start) >= time.Second {
+		t.Fatal("full batch waited for the linger time")
+	}
+}
+
+func TestTopicSinkError(t *testing.T) {
+	sinkErr := errors.New("disk full")
+	topic := NewTopic("test", "test-full", &recordSink{err: sinkErr})
+	defer topic.Close()
+
+	for i, err := range publishAll(t, topic, 5) {
+		if err != sinkErr {
+			t.Fatalf("publish %d: got %v, want %v", i, err, sinkErr)
+		}
+	}
+	if n := topic.PubFailed(); n != 5 {
+		t.Fatalf("PubFailed() = %d, want 5", n)
+	}
+}
+
+func TestTopicClose(t *testing.T) {
+	topic := NewTopic("test", "test-full", &recordSink{})
+	topic.Close()
+	if err := topic.Publish([]byte("late")); err == nil {
+		t.Fatal("publish after Close succeeded")
+	}
+}
+
+func TestDiskQueueSink(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("consume-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	q := diskqueue.Open("test_sink", tmpDir, diskqueue.WithSync(1<<30, time.Hour))
+	topic := NewTopic("test", "test-full", NewDiskQueueSink(q), WithMaxBatch(8, 0))
+	for i, err := range publishAll(t, topic, 20) {
+		if err != nil {
+			t.Fatalf("publish %d: %v", i, err)
+		}
+	}
+	defer q.Close()
+	defer topic.Close()
+
+	// everything acknowledged is on disk, even though the sync policy never
+	// ran
+	m, err := diskqueue.NewInspector("test_sink", tmpDir, 0, 1024*1024).Meta()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Depth != 20 {
+		t.Fatalf("persisted depth %d, want 20", m.Depth)
+	}
+
+	// and the messages keep their metadata
+	data, err := q.ReadBatch(20, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range data {
+		msg, err := DecodeMessageExt(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.ID == 0 || msg.Timestamp == 0 {
+			t.Fatalf("message without metadata: %+v", msg)
+		}
+	}
+}
+
+func TestTopicPublishMulti(t *testing.T) {
+	sink := &recordSink{}
+	topic := NewTopic("test", "test-full", sink, WithMaxBatch(4, 0))
+	defer topic.Close()
+
+	msgs := make([]*Message, 10)
+	for i := range msgs {
+		msgs[i] = NewMessage(0, []byte(fmt.Sprintf("msg %d", i)))
+	}
+	if err := topic.PublishMulti(msgs); err != nil {
+		t.Fatal(err)
+	}
+	// the unit is not split even though it is over the batch size
+	if len(sink.batches) != 1 || sink.batches[0] != 10 {
+		t.Fatalf("batches %v, want [10]", sink.batches)
+	}
+
+	sink.err = errors.New("disk full")
+	if err := topic.PublishMulti(msgs[:2]); err != sink.err {
+		t.Fatalf("got %v, want %v", err, sink.err)
+	}
+	if n := topic.PubFailed(); n != 1 {
+		t.Fatalf("PubFailed() = %d, want 1", n)
+	}
+}
+
+// blockSink blocks every commit until released
+type blockSink struct {
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (s *blockSink) Commit(topic string, msgs []*Message) error {
+	s.entered <- struct{}{}
+	<-s.release
+	return nil
+}
+
+func TestTopicBackpressure(t *testing.T) {
+	sink := &blockSink{entered: make(chan struct{}), release: make(chan struct{})}
+	topic := NewTopic("test", "test-full", sink, WithMaxBatch(1, 0), WithWaitQueue(1, 0))
+
+	// the first message is stuck in the sink, the second fills the queue
+	first := make(chan error, 1)
+	go func() { first <- topic.Publish([]byte("first")) }()
+	<-sink.entered
+	second := make(chan error, 1)
+	go func() { second <- topic.Publish([]byte("second")) }()
+	for len(topic.GetWaitChan()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := topic.Publish([]byte("third")); err != ErrOverloaded {
+		t.Fatalf("got %v, want %v", err, ErrOverloaded)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	topic.queueWait = time.Second
+	if err := topic.PublishContext(ctx, []byte("third")); err != context.DeadlineExceeded {
+		t.Fatalf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	// closing fails the queued publisher once the sink lets go
+	go topic.Close()
+	for {
+		select {
+		case <-topic.QuitChan():
+		default:
+			time.Sleep(time.Millisecond)
+			continue
+		}
+		break
+	}
+	close(sink.release)
+	if err := <-first; err != nil {
+		t.Fatalf("first: %v", err)
+	}
+	if err := <-second; err != ErrExiting {
+		t.Fatalf("second: got %v, want %v", err, ErrExiting)
+	}
+	if err := topic.Publish([]byte("late")); err != ErrExiting {
+		t.Fatalf("late: got %v, want %v", err, ErrExiting)
+	}
+}
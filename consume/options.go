@@ -0,0 +1,68 @@
+package consume
+
+import (
+	"time"
+)
+
+// defaults used by NewTopic for anything not set by an Option
+const (
+	defaultMaxBatchSize   = 100
+	defaultPubWaitTimeout = time.Second * 3
+	defaultMsgTimeout     = time.Minute
+)
+
+// Option configures a Topic created by NewTopic
+//Topic的配置项
+type Option func(*Topic)
+
+// WithMaxBatch caps the number of messages and the total body bytes of a
+// batch; a batch is committed as soon as it reaches either. Zero bytes means
+// no limit on the size. The messages of a PublishMulti are never split, so
+// they may take a batch over the limits.
+//每批最多的消息数和字节数
+func WithMaxBatch(size int, bytes int) Option {
+	return func(t *Topic) {
+		if size > 0 {
+			t.maxBatchSize = size
+		}
+		t.maxBatchBytes = bytes
+	}
+}
+
+// WithMaxLinger sets how long a batch waits for more messages after its
+// first one before being committed. Zero, the default, commits as soon as
+// no other publisher is waiting.
+//凑批等待的最长时间
+func WithMaxLinger(d time.Duration) Option {
+	return func(t *Topic) {
+		t.maxLinger = d
+	}
+}
+
+// WithPubWaitTimeout sets how long a publisher may wait in the wait queue
+// before the pub loop fails it rather than commit it
+func WithPubWaitTimeout(d time.Duration) Option {
+	return func(t *Topic) {
+		t.pubWaitTimeout = d
+	}
+}
+
+// WithWaitQueue sets how many publishers may wait for the pub loop, and how
+// long a publisher finding the wait queue full waits for room before failing
+// with ErrOverloaded. Zero wait fails at once.
+//等待队列的长度和队列满时的等待时间
+func WithWaitQueue(size int, wait time.Duration) Option {
+	return func(t *Topic) {
+		t.waitQueueSize = size
+		t.queueWait = wait
+	}
+}
+
+// WithMsgTimeout sets how long a channel consumer may hold a message before
+// it is requeued, unless touched
+//channel中消息的处理超时
+func WithMsgTimeout(d time.Duration) Option {
+	return func(t *Topic) {
+		t.msgTimeout = d
+	}
+}
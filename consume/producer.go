@@ -0,0 +1,193 @@
+package consume
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Producer publishes messages to a single nsqd over TCP. It connects on
+// first use and again after any connection error; each publish waits for
+// nsqd's answer. While connected it keeps reading, so that heartbeats are
+// answered even when idle.
+//NSQ生产者
+type Producer struct {
+	sync.Mutex
+	addr    string
+	config  *Config
+	conn    *producerConn
+	stopped bool
+}
+
+// producerConn is a Producer's connection along with its read loop
+type producerConn struct {
+	*nsqConn
+	resps  chan producerResp // answers to commands
+	closed chan struct{}     // closed once reading fails, see err
+	err    error
+}
+
+// producerResp is nsqd's answer to a command
+type producerResp struct {
+	data []byte
+	err  error
+}
+
+// NewProducer returns a Producer for the nsqd at addr
+func NewProducer(addr string, config *Config) *Producer {
+	if config == nil {
+		config = NewConfig()
+	}
+	return &Producer{addr: addr, config: config}
+}
+
+// Publish publishes a message to topic (PUB)
+func (p *Producer) Publish(topic string, body []byte) error {
+	return p.do(body, "PUB", topic)
+}
+
+// MultiPublish publishes messages to topic atomically (MPUB)
+//批量发布
+func (p *Producer) MultiPublish(topic string, bodies [][]byte) error {
+	if len(bodies) == 0 {
+		return nil
+	}
+	return p.do(mpubBody(bodies), "MPUB", topic)
+}
+
+// DeferredPublish publishes a message to topic to be delivered after delay
+// (DPUB)
+//延迟发布
+func (p *Producer) DeferredPublish(topic string, delay time.Duration, body []byte) error {
+	return p.do(body, "DPUB", topic, millis(delay))
+}
+
+// Ping checks the connection to nsqd, connecting if necessary
+func (p *Producer) Ping() error {
+	p.Lock()
+	defer p.Unlock()
+	if p.stopped {
+		return ErrExiting
+	}
+	return p.connect()
+}
+
+// Stop closes the connection. Publishing afterwards fails with ErrExiting.
+func (p *Producer) Stop() {
+	p.Lock()
+	defer p.Unlock()
+	p.stopped = true
+	if p.conn != nil {
+		p.conn.command(nil, "CLS")
+		p.conn.Close()
+		p.conn = nil
+	}
+}
+
+func (p *Producer) connect() error {
+	if p.conn != nil {
+		select {
+		case <-p.conn.closed:
+			// lost while idle, start over
+			//空闲时连接断开，重新连接
+			p.conn.Close()
+			p.conn = nil
+		default:
+			return nil
+		}
+	}
+	conn, err := dialNSQ(p.addr, p.config)
+	if err != nil {
+		return err
+	}
+	p.conn = &producerConn{
+		nsqConn: conn,
+		// one command at a time, and CLS may go unread
+		resps:  make(chan producerResp, 1),
+		closed: make(chan struct{}),
+	}
+	go p.conn.readLoop()
+	return nil
+}
+
+// readLoop reads answers until the connection fails, answering heartbeats
+// on the way
+func (c *producerConn) readLoop() {
+	defer close(c.closed)
+	for {
+		frameType, data, err := c.readFrame()
+		if err != nil {
+			c.err = err
+			return
+		}
+		switch frameType {
+		case FrameTypeResponse:
+			if bytes.Equal(data, respHeartbeat) {
+				err = c.command(nil, "NOP")
+				if err != nil {
+					c.err = err
+					return
+				}
+				continue
+			}
+			c.resps <- producerResp{data: data}
+		case FrameTypeError:
+			c.resps <- producerResp{err: &ErrProtocol{Message: string(data)}}
+		default:
+			c.err = fmt.Errorf("unexpected frame type %d", frameType)
+			return
+		}
+	}
+}
+
+// response waits for the answer to the command just sent
+func (c *producerConn) response() ([]byte, error) {
+	select {
+	case r := <-c.resps:
+		return r.data, r.err
+	case <-c.closed:
+		// the answer may have come just before the connection failed
+		select {
+		case r := <-c.resps:
+			return r.data, r.err
+		default:
+		}
+		return nil, c.err
+	}
+}
+
+// do sends a command and waits for its OK
+func (p *Producer) do(body []byte, params ...string) error {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.stopped {
+		return ErrExiting
+	}
+	err := p.connect()
+	if err != nil {
+		return err
+	}
+
+	err = p.conn.command(body, params...)
+	if err == nil {
+		var resp []byte
+		resp, err = p.conn.response()
+		if err == nil && !bytes.Equal(resp, respOK) {
+			err = fmt.Errorf("unexpected response %q", resp)
+		}
+	}
+	if err != nil {
+		var perr *ErrProtocol
+		if !errors.As(err, &perr) {
+			// the connection is in an unknown state, start over next time
+			//连接异常，下次重新连接
+			p.conn.Close()
+			p.conn = nil
+		}
+		return err
+	}
+	return nil
+}
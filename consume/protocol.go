@@ -0,0 +1,236 @@
+package consume
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// NSQ V2 TCP protocol
+//
+// A client opens with the 4 byte magic "  V2" and then sends commands, each
+// a line of space separated words, some followed by a 4 byte big-endian
+// size and a body. nsqd answers with frames:
+//
+//	[4 byte size][4 byte frame type][data]
+//
+// where the size counts the frame type and data. A response frame carries
+// "OK", "CLOSE_WAIT" or the "_heartbeat_" a client must answer with NOP,
+// an error frame the error, and a message frame a message as decoded by
+// DecodeMessage.
+//NSQ V2 TCP协议
+const (
+	FrameTypeResponse int32 = 0
+	FrameTypeError    int32 = 1
+	FrameTypeMessage  int32 = 2
+
+	maxFrameSize = 64 * 1024 * 1024
+)
+
+var (
+	protocolMagic = []byte("  V2")
+
+	respOK         = []byte("OK")
+	respCloseWait  = []byte("CLOSE_WAIT")
+	respHeartbeat  = []byte("_heartbeat_")
+	errFrameTooBig = errors.New("frame too big")
+)
+
+// ErrProtocol is an error frame sent by nsqd
+type ErrProtocol struct {
+	Message string
+}
+
+func (e *ErrProtocol) Error() string {
+	return "nsqd: " + e.Message
+}
+
+// Config configures the connections of a Producer or Consumer
+//NSQ客户端的配置
+type Config struct {
+	ClientID          string
+	Hostname          string
+	UserAgent         string
+	HeartbeatInterval time.Duration // how often nsqd sends heartbeats
+	MsgTimeout        time.Duration // server side message timeout, 0 for nsqd's default
+
+	DialTimeout       time.Duration
+	ReadTimeout       time.Duration // should exceed HeartbeatInterval
+	WriteTimeout      time.Duration
+	ReconnectInterval time.Duration // how long a Consumer waits to reconnect
+
+	MaxInFlight  int           // RDY count of a Consumer connection
+	MaxAttempts  uint16        // messages delivered more often are dropped, 0 for no limit
+	RequeueDelay time.Duration // delay of a failed message, multiplied by its attempts
+}
+
+// NewConfig returns a Config with the same defaults as the official clients
+func NewConfig() *Config {
+	hostname, _ := os.Hostname()
+	return &Config{
+		ClientID:          hostname,
+		Hostname:          hostname,
+		UserAgent:         "twist-consume",
+		HeartbeatInterval: 30 * time.Second,
+		DialTimeout:       time.Second,
+		ReadTimeout:       60 * time.Second,
+		WriteTimeout:      time.Second,
+		ReconnectInterval: 5 * time.Second,
+		MaxInFlight:       1,
+		MaxAttempts:       5,
+		RequeueDelay:      90 * time.Second,
+	}
+}
+
+// nsqConn is a connection to nsqd that has been through IDENTIFY. Writes
+// are serialized so that heartbeats can be answered from the read side.
+type nsqConn struct {
+	net.Conn
+	config *Config
+	r      *bufio.Reader
+	mu     sync.Mutex // guards writes
+}
+
+func dialNSQ(addr string, config *Config) (*nsqConn, error) {
+	conn, err := net.DialTimeout("tcp", addr, config.DialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &nsqConn{Conn: conn, config: config, r: bufio.NewReader(conn)}
+
+	_, err = c.Write(protocolMagic)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	err = c.identify()
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *nsqConn) identify() error {
+	identify := map[string]interface{}{
+		"client_id":          c.config.ClientID,
+		"hostname":           c.config.Hostname,
+		"user_agent":         c.config.UserAgent,
+		"heartbeat_interval": int64(c.config.HeartbeatInterval / time.Millisecond),
+	}
+	if c.config.MsgTimeout > 0 {
+		identify["msg_timeout"] = int64(c.config.MsgTimeout / time.Millisecond)
+	}
+	body, err := json.Marshal(identify)
+	if err != nil {
+		return err
+	}
+	err = c.command(body, "IDENTIFY")
+	if err != nil {
+		return err
+	}
+	_, err = c.readResponse()
+	return err
+}
+
+// command writes a command made of params, followed by body if not nil
+func (c *nsqConn) command(body []byte, params ...string) error {
+	var buf bytes.Buffer
+	for i, p := range params {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(p)
+	}
+	buf.WriteByte('\n')
+	if body != nil {
+		var size [4]byte
+		binary.BigEndian.PutUint32(size[:], uint32(len(body)))
+		buf.Write(size[:])
+		buf.Write(body)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.config.WriteTimeout > 0 {
+		c.SetWriteDeadline(time.Now().Add(c.config.WriteTimeout))
+	}
+	_, err := c.Write(buf.Bytes())
+	return err
+}
+
+// readFrame reads the next frame
+func (c *nsqConn) readFrame() (int32, []byte, error) {
+	if c.config.ReadTimeout > 0 {
+		c.SetReadDeadline(time.Now().Add(c.config.ReadTimeout))
+	}
+	var header [8]byte
+	_, err := io.ReadFull(c.r, header[:])
+	if err != nil {
+		return 0, nil, err
+	}
+	size := int32(binary.BigEndian.Uint32(header[:4]))
+	frameType := int32(binary.BigEndian.Uint32(header[4:]))
+	if size < 4 || size > maxFrameSize {
+		return 0, nil, errFrameTooBig
+	}
+	data := make([]byte, size-4)
+	_, err = io.ReadFull(c.r, data)
+	if err != nil {
+		return 0, nil, err
+	}
+	return frameType, data, nil
+}
+
+// readResponse reads frames up to the next response, answering heartbeats
+// on the way. An error frame is returned as an *ErrProtocol.
+func (c *nsqConn) readResponse() ([]byte, error) {
+	for {
+		frameType, data, err := c.readFrame()
+		if err != nil {
+			return nil, err
+		}
+		switch frameType {
+		case FrameTypeResponse:
+			if bytes.Equal(data, respHeartbeat) {
+				err = c.command(nil, "NOP")
+				if err != nil {
+					return nil, err
+				}
+				continue
+			}
+			return data, nil
+		case FrameTypeError:
+			return nil, &ErrProtocol{Message: string(data)}
+		default:
+			return nil, fmt.Errorf("unexpected frame type %d", frameType)
+		}
+	}
+}
+
+// mpubBody returns the body of an MPUB command
+func mpubBody(bodies [][]byte) []byte {
+	var buf bytes.Buffer
+	var n [4]byte
+	binary.BigEndian.PutUint32(n[:], uint32(len(bodies)))
+	buf.Write(n[:])
+	for _, b := range bodies {
+		binary.BigEndian.PutUint32(n[:], uint32(len(b)))
+		buf.Write(n[:])
+		buf.Write(b)
+	}
+	return buf.Bytes()
+}
+
+func millis(d time.Duration) string {
+	return strconv.FormatInt(int64(d/time.Millisecond), 10)
+}
@@ -0,0 +1,44 @@
+package consume
+
+import (
+	"bytes"
+
+	"twist/diskqueue"
+)
+
+// DiskQueueSink is a Sink that appends every batch to a diskqueue and fsyncs
+// it once before reporting success, so a publisher released without error
+// knows its message survives a crash. Messages are stored as written by
+// WriteExtTo, to be read back with DecodeMessageExt. A batch is committed
+// whole or not at all as long as it fits in a data file of q, see PutBatch.
+//把每一批消息写入diskqueue并同步一次再返回
+type DiskQueueSink struct {
+	q diskqueue.Interface
+}
+
+// NewDiskQueueSink returns a Sink writing to q
+func NewDiskQueueSink(q diskqueue.Interface) *DiskQueueSink {
+	return &DiskQueueSink{q: q}
+}
+
+func (s *DiskQueueSink) Commit(topic string, msgs []*Message) error {
+	batch := make([][]byte, len(msgs))
+	for i, m := range msgs {
+		var buf bytes.Buffer
+		_, err := m.WriteExtTo(&buf)
+		if err != nil {
+			return err
+		}
+		batch[i] = buf.Bytes()
+	}
+	err := s.q.PutBatch(batch)
+	if err != nil {
+		return err
+	}
+	return s.q.Sync()
+}
+
+// Queue returns the diskqueue the sink writes to
+func (s *DiskQueueSink) Queue() diskqueue.Interface {
+	return s.q
+}
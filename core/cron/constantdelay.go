@@ -25,3 +25,27 @@ func Every(duration time.Duration) ConstantDelaySchedule {
 func (schedule ConstantDelaySchedule) Next(t time.Time) time.Time {
 	return t.Add(schedule.Delay - time.Duration(t.Nanosecond())*time.Nanosecond)
 }
+
+// PreciseDelaySchedule is a ConstantDelaySchedule with millisecond rather
+// than second granularity, for jobs that must run more than once a second.
+type PreciseDelaySchedule struct {
+	Delay time.Duration
+}
+
+// EveryPrecise returns a Schedule that activates once every duration.
+// Delays of less than a millisecond are not supported (will round up to 1
+// millisecond). Any fields less than a Millisecond are truncated.
+func EveryPrecise(duration time.Duration) PreciseDelaySchedule {
+	if duration < time.Millisecond {
+		duration = time.Millisecond
+	}
+	return PreciseDelaySchedule{
+		Delay: duration.Truncate(time.Millisecond),
+	}
+}
+
+// Next returns the next time this should be run.
+// This rounds so that the next activation time will be on the millisecond.
+func (schedule PreciseDelaySchedule) Next(t time.Time) time.Time {
+	return t.Add(schedule.Delay - time.Duration(t.Nanosecond())%time.Millisecond)
+}
@@ -52,3 +52,35 @@ func TestConstantDelayNext(t *testing.T) {
 		}
 	}
 }
+
+func TestPreciseDelayNext(t *testing.T) {
+	tests := []struct {
+		time     string
+		delay    time.Duration
+		expected string
+	}{
+		// Sub-second delays are kept.
+		{"Mon Jul 9 14:45:00 2012", 250 * time.Millisecond, "Mon Jul 9 14:45:00.250 2012"},
+		{"Mon Jul 9 14:45:00.750 2012", 250 * time.Millisecond, "Mon Jul 9 14:45:01 2012"},
+
+		// Wrap around minute, hour, day, month, and year
+		{"Mon Dec 31 23:59:59.900 2012", 100 * time.Millisecond, "Tue Jan 1 00:00:00 2013"},
+
+		// Round to nearest millisecond on the delay
+		{"Mon Jul 9 14:45 2012", 15*time.Millisecond + 50*time.Microsecond, "Mon Jul 9 14:45:00.015 2012"},
+
+		// Round up to 1 millisecond if the duration is less.
+		{"Mon Jul 9 14:45:00 2012", 15 * time.Microsecond, "Mon Jul 9 14:45:00.001 2012"},
+
+		// Round to nearest millisecond when calculating the next time.
+		{"Mon Jul 9 14:45:00.0055 2012", 5 * time.Millisecond, "Mon Jul 9 14:45:00.010 2012"},
+	}
+
+	for _, c := range tests {
+		actual := EveryPrecise(c.delay).Next(getTime(c.time))
+		expected := getTime(c.expected)
+		if actual != expected {
+			t.Errorf("%s, \"%s\": (expected) %v != %v (actual)", c.time, c.delay, expected, actual)
+		}
+	}
+}
@@ -1,23 +1,37 @@
 package cron
 
 import (
+	"context"
 	"log"
 	"runtime"
 	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // Cron keeps track of any number of entries, invoking the associated func as
 // specified by the schedule. It may be started, stopped, and the entries may
-// be inspected while running.
+// be inspected while running. All of its methods are safe for concurrent use.
 type Cron struct {
 	entries  []*Entry
-	stop     chan struct{}
+	stop     chan chan *sync.WaitGroup
 	add      chan *Entry
-	snapshot chan []*Entry
+	remove   chan EntryID
+	snapshot chan chan []*Entry
 	running  bool
 	ErrorLog *log.Logger
 	location *time.Location
+
+	// runningMu guards running and nextID, and entries while not running;
+	// once running, entries belong to the run goroutine.
+	runningMu sync.Mutex
+	nextID    EntryID
+	jobWaiter *sync.WaitGroup // jobs of the last stopped run, guarded by runningMu
+
+	observerMu sync.RWMutex
+	observers  []Observer
+	stats      stats
 }
 
 // Job is an interface for submitted cron jobs.
@@ -25,6 +39,13 @@ type Job interface {
 	Run()
 }
 
+// ContextJob is a Job that is told, through its context, when the Cron it
+// runs under is stopped. Plain Jobs keep working and simply never see the
+// cancellation.
+type ContextJob interface {
+	RunContext(ctx context.Context)
+}
+
 // The Schedule describes a job's duty cycle.
 type Schedule interface {
 	// Return the next activation time, later than the given time.
@@ -32,8 +53,14 @@ type Schedule interface {
 	Next(time.Time) time.Time
 }
 
+// EntryID identifies an entry within a Cron instance.
+type EntryID int
+
 // Entry consists of a schedule and the func to execute on that schedule.
 type Entry struct {
+	// ID is the cron-assigned ID of this entry, which may be used to remove it.
+	ID EntryID
+
 	// The schedule on which this job should be run.
 	Schedule Schedule
 
@@ -78,8 +105,9 @@ func NewWithLocation(location *time.Location) *Cron {
 	return &Cron{
 		entries:  nil,
 		add:      make(chan *Entry),
-		stop:     make(chan struct{}),
-		snapshot: make(chan []*Entry),
+		remove:   make(chan EntryID),
+		stop:     make(chan chan *sync.WaitGroup),
+		snapshot: make(chan chan []*Entry),
 		running:  false,
 		ErrorLog: nil,
 		location: location,
@@ -91,41 +119,109 @@ type FuncJob func()
 
 func (f FuncJob) Run() { f() }
 
+// A wrapper that turns a func(context.Context) into a cron.ContextJob. Run
+// calls the func with a background context.
+type ContextFuncJob func(context.Context)
+
+func (f ContextFuncJob) Run()                           { f(context.Background()) }
+func (f ContextFuncJob) RunContext(ctx context.Context) { f(ctx) }
+
+// contextJob adapts a ContextJob so that it can be stored as an Entry's Job.
+type contextJob struct {
+	ContextJob
+}
+
+func (j contextJob) Run() { j.RunContext(context.Background()) }
+
+// runJob runs j with ctx if it is context-aware, and plainly otherwise.
+func runJob(ctx context.Context, j Job) {
+	if cj, ok := j.(ContextJob); ok {
+		cj.RunContext(ctx)
+		return
+	}
+	j.Run()
+}
+
 // AddFunc adds a func to the Cron to be run on the given schedule.
-func (c *Cron) AddFunc(spec string, cmd func()) error {
+// The returned ID may be used to remove it later.
+func (c *Cron) AddFunc(spec string, cmd func()) (EntryID, error) {
 	return c.AddJob(spec, FuncJob(cmd))
 }
 
 // AddJob adds a Job to the Cron to be run on the given schedule.
-func (c *Cron) AddJob(spec string, cmd Job) error {
+// The returned ID may be used to remove it later.
+func (c *Cron) AddJob(spec string, cmd Job) (EntryID, error) {
+	schedule, err := Parse(spec)
+	if err != nil {
+		return 0, err
+	}
+	return c.Schedule(schedule, cmd), nil
+}
+
+// AddContextFunc adds a context-aware func to the Cron to be run on the given
+// schedule. The returned ID may be used to remove it later.
+func (c *Cron) AddContextFunc(spec string, cmd func(context.Context)) (EntryID, error) {
+	return c.AddJob(spec, ContextFuncJob(cmd))
+}
+
+// AddContextJob adds a ContextJob to the Cron to be run on the given schedule.
+// The returned ID may be used to remove it later.
+func (c *Cron) AddContextJob(spec string, cmd ContextJob) (EntryID, error) {
 	schedule, err := Parse(spec)
 	if err != nil {
-		return err
+		return 0, err
+	}
+	return c.ScheduleContext(schedule, cmd), nil
+}
+
+// ScheduleContext adds a ContextJob to the Cron to be run on the given schedule.
+// The returned ID may be used to remove it later.
+func (c *Cron) ScheduleContext(schedule Schedule, cmd ContextJob) EntryID {
+	if j, ok := cmd.(Job); ok {
+		return c.Schedule(schedule, j)
 	}
-	c.Schedule(schedule, cmd)
-	return nil
+	return c.Schedule(schedule, contextJob{cmd})
 }
 
 // Schedule adds a Job to the Cron to be run on the given schedule.
-func (c *Cron) Schedule(schedule Schedule, cmd Job) {
+// The returned ID may be used to remove it later.
+func (c *Cron) Schedule(schedule Schedule, cmd Job) EntryID {
+	c.runningMu.Lock()
+	defer c.runningMu.Unlock()
+	c.nextID++
 	entry := &Entry{
+		ID:       c.nextID,
 		Schedule: schedule,
 		Job:      cmd,
 	}
 	if !c.running {
 		c.entries = append(c.entries, entry)
-		return
+	} else {
+		c.add <- entry
 	}
+	return entry.ID
+}
 
-	c.add <- entry
+// Remove an entry from being run in the future. Runs already in flight are
+// not affected.
+func (c *Cron) Remove(id EntryID) {
+	c.runningMu.Lock()
+	defer c.runningMu.Unlock()
+	if c.running {
+		c.remove <- id
+	} else {
+		c.removeEntry(id)
+	}
 }
 
 // Entries returns a snapshot of the cron entries.
 func (c *Cron) Entries() []*Entry {
+	c.runningMu.Lock()
+	defer c.runningMu.Unlock()
 	if c.running {
-		c.snapshot <- nil
-		x := <-c.snapshot
-		return x
+		replyChan := make(chan []*Entry, 1)
+		c.snapshot <- replyChan
+		return <-replyChan
 	}
 	return c.entrySnapshot()
 }
@@ -137,6 +233,8 @@ func (c *Cron) Location() *time.Location {
 
 // Start the cron scheduler in its own go-routine, or no-op if already started.
 func (c *Cron) Start() {
+	c.runningMu.Lock()
+	defer c.runningMu.Unlock()
 	if c.running {
 		return
 	}
@@ -146,32 +244,55 @@ func (c *Cron) Start() {
 
 // Run the cron scheduler, or no-op if already running.
 func (c *Cron) Run() {
+	c.runningMu.Lock()
 	if c.running {
+		c.runningMu.Unlock()
 		return
 	}
 	c.running = true
+	c.runningMu.Unlock()
 	c.run()
 }
 
-func (c *Cron) runWithRecovery(j Job) {
+func (c *Cron) runWithRecovery(ctx context.Context, jobs *sync.WaitGroup, e *Entry, planned time.Time) {
+	defer jobs.Done()
+	start := c.now()
+	c.stats.started(start.Sub(planned))
+	c.notify(Event{Type: EventStart, Entry: e, Planned: planned, Start: start})
 	defer func() {
+		atomic.AddInt64(&c.stats.running, -1)
+		event := Event{Type: EventFinish, Entry: e, Planned: planned, Start: start, Duration: time.Since(start)}
 		if r := recover(); r != nil {
 			const size = 64 << 10
 			buf := make([]byte, size)
 			buf = buf[:runtime.Stack(buf, false)]
 			c.logf("cron: panic running job: %v\n%s", r, buf)
+			atomic.AddInt64(&c.stats.failures, 1)
+			event.Type = EventPanic
+			event.Panic = r
 		}
+		c.notify(event)
 	}()
-	j.Run()
+	runJob(ctx, e.Job)
 }
 
 // Run the scheduler. this is private just due to the need to synchronize
 // access to the 'running' state variable.
+//
+// The context handed to jobs is cancelled when the scheduler stops, and the
+// jobs of this run are handed to Stop to wait for.
 func (c *Cron) run() {
-	// Figure out the next activation times for each entry.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	jobs := new(sync.WaitGroup)
+
+	// Figure out the next activation times for each entry. Activations
+	// missed while the scheduler was stopped are not skips, so a restart
+	// schedules from scratch.
 	now := c.now()
 	for _, entry := range c.entries {
-		entry.Next = entry.Schedule.Next(now)
+		entry.Next = time.Time{}
+		c.scheduled(entry, now)
 	}
 
 	for {
@@ -196,23 +317,30 @@ func (c *Cron) run() {
 					if e.Next.After(now) || e.Next.IsZero() {
 						break
 					}
-					go c.runWithRecovery(e.Job)
 					e.Prev = e.Next
-					e.Next = e.Schedule.Next(now)
+					jobs.Add(1)
+					go c.runWithRecovery(ctx, jobs, e.snapshot(), e.Prev)
+					c.scheduled(e, now)
 				}
 
 			case newEntry := <-c.add:
 				timer.Stop()
 				now = c.now()
-				newEntry.Next = newEntry.Schedule.Next(now)
+				c.scheduled(newEntry, now)
 				c.entries = append(c.entries, newEntry)
 
-			case <-c.snapshot:
-				c.snapshot <- c.entrySnapshot()
+			case replyChan := <-c.snapshot:
+				replyChan <- c.entrySnapshot()
 				continue
 
-			case <-c.stop:
+			case id := <-c.remove:
+				timer.Stop()
+				now = c.now()
+				c.removeEntry(id)
+
+			case replyChan := <-c.stop:
 				timer.Stop()
+				replyChan <- jobs
 				return
 			}
 
@@ -230,29 +358,60 @@ func (c *Cron) logf(format string, args ...interface{}) {
 	}
 }
 
-// Stop stops the cron scheduler if it is running; otherwise it does nothing.
-func (c *Cron) Stop() {
-	if !c.running {
-		return
+// Stop stops the cron scheduler if it is running and cancels the context of
+// any ContextJob in flight. It does not wait for running jobs; instead the
+// returned context is done once all of them have returned.
+func (c *Cron) Stop() context.Context {
+	c.runningMu.Lock()
+	defer c.runningMu.Unlock()
+	if c.running {
+		replyChan := make(chan *sync.WaitGroup)
+		c.stop <- replyChan
+		c.jobWaiter = <-replyChan
+		c.running = false
 	}
-	c.stop <- struct{}{}
-	c.running = false
+	jobs := c.jobWaiter
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		if jobs != nil {
+			jobs.Wait()
+		}
+		cancel()
+	}()
+	return ctx
 }
 
 // entrySnapshot returns a copy of the current cron entry list.
 func (c *Cron) entrySnapshot() []*Entry {
 	entries := []*Entry{}
 	for _, e := range c.entries {
-		entries = append(entries, &Entry{
-			Schedule: e.Schedule,
-			Next:     e.Next,
-			Prev:     e.Prev,
-			Job:      e.Job,
-		})
+		entries = append(entries, e.snapshot())
 	}
 	return entries
 }
 
+// removeEntry drops the entry with the given ID, if present.
+func (c *Cron) removeEntry(id EntryID) {
+	var entries []*Entry
+	for _, e := range c.entries {
+		if e.ID != id {
+			entries = append(entries, e)
+		}
+	}
+	c.entries = entries
+}
+
+// snapshot returns a copy of the entry.
+func (e *Entry) snapshot() *Entry {
+	return &Entry{
+		ID:       e.ID,
+		Schedule: e.Schedule,
+		Next:     e.Next,
+		Prev:     e.Prev,
+		Job:      e.Job,
+	}
+}
+
 // now returns current time in c location
 func (c *Cron) now() time.Time {
 	return time.Now().In(c.location)
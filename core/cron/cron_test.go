@@ -1,8 +1,10 @@
 package cron
 
 import (
+	"context"
 	"fmt"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -115,11 +117,11 @@ func TestAddWhileRunningWithDelay(t *testing.T) {
 	cron.Start()
 	defer cron.Stop()
 	time.Sleep(5 * time.Second)
-	var calls = 0
-	cron.AddFunc("* * * * * *", func() { calls += 1 })
+	var calls int64
+	cron.AddFunc("* * * * * *", func() { atomic.AddInt64(&calls, 1) })
 
 	<-time.After(OneSecond)
-	if calls != 1 {
+	if calls := atomic.LoadInt64(&calls); calls != 1 {
 		t.Errorf("called %d times, expected 1\n", calls)
 	}
 }
@@ -282,7 +284,7 @@ func (t testJob) Run() {
 // Test that adding an invalid job spec returns an error
 func TestInvalidJobSpec(t *testing.T) {
 	cron := New()
-	err := cron.AddJob("this will not parse", nil)
+	_, err := cron.AddJob("this will not parse", nil)
 	if err == nil {
 		t.Errorf("expected an error with invalid spec, got nil")
 	}
@@ -377,6 +379,184 @@ func TestJob(t *testing.T) {
 	}
 }
 
+// Test that stopping cancels the context of running jobs and that the
+// context returned by Stop is done once they have returned.
+func TestStopCancelsContextJobs(t *testing.T) {
+	started := make(chan struct{}, 1)
+	finished := make(chan struct{})
+
+	cron := New()
+	cron.AddContextFunc("* * * * * ?", func(ctx context.Context) {
+		select {
+		case started <- struct{}{}:
+		default:
+			return
+		}
+		<-ctx.Done()
+		time.Sleep(100 * time.Millisecond)
+		close(finished)
+	})
+	cron.Start()
+
+	select {
+	case <-time.After(OneSecond):
+		t.Fatal("expected job runs")
+	case <-started:
+	}
+
+	ctx := cron.Stop()
+	select {
+	case <-time.After(OneSecond):
+		t.Fatal("expected stop context to be done once jobs finish")
+	case <-ctx.Done():
+	}
+	select {
+	case <-finished:
+	default:
+		t.Error("expected stop context to wait for the running job")
+	}
+}
+
+// Test that plain jobs run under the context-aware runner.
+func TestStopWaitsForPlainJobs(t *testing.T) {
+	var done int32
+	started := make(chan struct{}, 1)
+
+	cron := New()
+	cron.AddFunc("* * * * * ?", func() {
+		select {
+		case started <- struct{}{}:
+		default:
+			return
+		}
+		time.Sleep(200 * time.Millisecond)
+		atomic.StoreInt32(&done, 1)
+	})
+	cron.Start()
+	<-started
+
+	<-cron.Stop().Done()
+	if atomic.LoadInt32(&done) != 1 {
+		t.Error("expected stop context to wait for the running job")
+	}
+}
+
+// Test that the context returned by Stop only waits for the jobs of the run
+// it stopped, even once the scheduler is started again.
+func TestStopThenStartWhileJobRuns(t *testing.T) {
+	var calls int32
+	started, restarted := make(chan struct{}), make(chan struct{}, 1)
+	release, releaseRestarted := make(chan struct{}), make(chan struct{})
+
+	cron := New()
+	cron.AddFunc("* * * * * ?", func() {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			close(started)
+			<-release
+			return
+		}
+		select {
+		case restarted <- struct{}{}:
+			<-releaseRestarted
+		default:
+		}
+	})
+	cron.Start()
+	<-started
+
+	ctx := cron.Stop()
+	cron.Start()
+	select {
+	case <-time.After(2 * OneSecond):
+		t.Fatal("expected job runs after restart")
+	case <-restarted:
+	}
+	close(release)
+	select {
+	case <-time.After(OneSecond):
+		t.Error("expected stop context not to wait for jobs of the next run")
+	case <-ctx.Done():
+	}
+
+	close(releaseRestarted)
+	<-cron.Stop().Done()
+}
+
+// Test that a removed entry does not run, whether removed before or after start.
+func TestRemove(t *testing.T) {
+	var calls int64
+	cron := New()
+	cron.AddFunc("* * * * * ?", func() { atomic.AddInt64(&calls, 1) })
+	removedBefore := cron.Schedule(Every(time.Second), FuncJob(func() { t.Error("expected removed entry will not run") }))
+	cron.Remove(removedBefore)
+	cron.Start()
+	defer cron.Stop()
+
+	removedAfter := cron.Schedule(Every(time.Second), FuncJob(func() { t.Error("expected removed entry will not run") }))
+	cron.Remove(removedAfter)
+
+	<-time.After(OneSecond)
+	if calls := atomic.LoadInt64(&calls); calls != 1 {
+		t.Errorf("called %d times, expected 1\n", calls)
+	}
+	if n := len(cron.Entries()); n != 1 {
+		t.Errorf("expected 1 entry left, got %d", n)
+	}
+}
+
+// Test that entries added from a spec can be removed by their ID.
+func TestRemoveAddedFunc(t *testing.T) {
+	cron := New()
+	id, err := cron.AddFunc("* * * * * ?", func() { t.Error("expected removed entry will not run") })
+	if err != nil {
+		t.Fatal(err)
+	}
+	cron.Start()
+	defer cron.Stop()
+	cron.Remove(id)
+
+	<-time.After(OneSecond)
+	if n := len(cron.Entries()); n != 0 {
+		t.Errorf("expected no entry left, got %d", n)
+	}
+}
+
+// Test that the public API may be used concurrently. Run with -race.
+func TestConcurrentAccess(t *testing.T) {
+	cron := New()
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(4)
+		go func() {
+			defer wg.Done()
+			id := cron.Schedule(EveryPrecise(time.Millisecond), FuncJob(func() {}))
+			cron.Remove(id)
+		}()
+		go func() {
+			defer wg.Done()
+			cron.AddFunc("* * * * * ?", func() {})
+		}()
+		go func() {
+			defer wg.Done()
+			for _, e := range cron.Entries() {
+				_ = e.Next
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			cron.Start()
+			time.Sleep(time.Millisecond)
+			cron.Stop()
+		}()
+	}
+	wg.Wait()
+	<-cron.Stop().Done()
+
+	if n := len(cron.Entries()); n != 10 {
+		t.Errorf("expected 10 entries, got %d", n)
+	}
+}
+
 type ZeroSchedule struct{}
 
 func (*ZeroSchedule) Next(time.Time) time.Time {
@@ -386,13 +566,13 @@ func (*ZeroSchedule) Next(time.Time) time.Time {
 // Tests that job without time does not run
 func TestJobWithZeroTimeDoesNotRun(t *testing.T) {
 	cron := New()
-	calls := 0
-	cron.AddFunc("* * * * * *", func() { calls += 1 })
+	var calls int64
+	cron.AddFunc("* * * * * *", func() { atomic.AddInt64(&calls, 1) })
 	cron.Schedule(new(ZeroSchedule), FuncJob(func() { t.Error("expected zero task will not run") }))
 	cron.Start()
 	defer cron.Stop()
 	<-time.After(OneSecond)
-	if calls != 1 {
+	if calls := atomic.LoadInt64(&calls); calls != 1 {
 		t.Errorf("called %d times, expected 1\n", calls)
 	}
 }
@@ -0,0 +1,120 @@
+package cron
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var (
+	monthNames = []string{"", "Jan", "Feb", "Mar", "Apr", "May", "Jun",
+		"Jul", "Aug", "Sep", "Oct", "Nov", "Dec"}
+	dowNames = []string{"Sun", "Mon", "Tue", "Wed", "Thu", "Fri", "Sat"}
+)
+
+// Describe returns a human-readable description of the schedule, e.g.
+// "second 0, minute 30, hours 9-17, every day, months Jan-Mar".
+func (s *SpecSchedule) Describe() string {
+	parts := []string{
+		describeField(s.Second, seconds, "second", "seconds", nil),
+		describeField(s.Minute, minutes, "minute", "minutes", nil),
+		describeField(s.Hour, hours, "hour", "hours", nil),
+		describeDays(s),
+		describeField(s.Month, months, "month", "months", monthNames),
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Describe returns a human-readable description of the schedule.
+func (schedule ConstantDelaySchedule) Describe() string {
+	return "every " + schedule.Delay.String()
+}
+
+// Describe returns a human-readable description of the schedule.
+func (schedule PreciseDelaySchedule) Describe() string {
+	return "every " + schedule.Delay.String()
+}
+
+// Describe returns a human-readable description of any schedule that knows
+// how to describe itself, falling back to its Go representation.
+func Describe(schedule Schedule) string {
+	if d, ok := schedule.(interface{ Describe() string }); ok {
+		return d.Describe()
+	}
+	return fmt.Sprintf("%v", schedule)
+}
+
+// describeDays mirrors dayMatches: if either day field has a star, both must
+// match, otherwise either may.
+func describeDays(s *SpecSchedule) string {
+	domAll := isAll(s.Dom, dom)
+	dowAll := isAll(s.Dow, dow)
+	d := describeField(s.Dom, dom, "day of month", "days of month", nil)
+	w := describeField(s.Dow, dow, "day of week", "days of week", dowNames)
+	if s.Dom&starBit > 0 || s.Dow&starBit > 0 {
+		switch {
+		case domAll && dowAll:
+			return "every day"
+		case dowAll:
+			return d
+		case domAll:
+			return w
+		}
+		return d + " and " + w
+	}
+	if domAll || dowAll {
+		return "every day"
+	}
+	return d + " or " + w
+}
+
+// isAll returns true if every value within the bounds is set.
+func isAll(bits uint64, r bounds) bool {
+	all := getBits(r.min, r.max, 1)
+	return bits&all == all
+}
+
+// describeField renders the set bits as a compact list of values and ranges.
+func describeField(bits uint64, r bounds, one, many string, names []string) string {
+	if isAll(bits, r) {
+		return "every " + one
+	}
+
+	name := func(v uint) string {
+		if names != nil {
+			return names[v]
+		}
+		return strconv.Itoa(int(v))
+	}
+
+	var (
+		items []string
+		count int
+	)
+	for v := r.min; v <= r.max; v++ {
+		if 1<<v&bits == 0 {
+			continue
+		}
+		end := v
+		for end+1 <= r.max && 1<<(end+1)&bits > 0 {
+			end++
+		}
+		switch {
+		case end == v:
+			items = append(items, name(v))
+		case end == v+1:
+			items = append(items, name(v), name(end))
+		default:
+			items = append(items, name(v)+"-"+name(end))
+		}
+		count += int(end-v) + 1
+		v = end
+	}
+	if count == 0 {
+		return "no " + one
+	}
+	if count == 1 {
+		return one + " " + items[0]
+	}
+	return many + " " + strings.Join(items, ",")
+}
@@ -17,11 +17,22 @@ them in their own goroutines.
 	// Funcs may also be added to a running Cron
 	c.AddFunc("@daily", func() { fmt.Println("Every day") })
 	..
+	// Added funcs and jobs may be removed by their ID
+	id, _ := c.AddFunc("@every 1m", func() { fmt.Println("Every minute") })
+	c.Remove(id)
+	..
 	// Inspect the cron job entries' next and previous run times.
 	inspect(c.Entries())
 	..
 	c.Stop()  // Stop the scheduler (does not stop any jobs already running).
 
+Jobs that accept a context are told when the scheduler stops, and the context
+returned by Stop is done once every job in flight has returned.
+
+	c.AddContextFunc("@every 1m", func(ctx context.Context) { sync(ctx) })
+	..
+	<-c.Stop().Done()  // Cancel running jobs' contexts and wait for them.
+
 CRON Expression Format
 
 A cron expression represents a set of times, using 6 space-separated fields.
@@ -99,6 +110,20 @@ Note: The interval does not take the job runtime into account.  For example,
 if a job takes 3 minutes to run, and it is scheduled to run every 5 minutes,
 it will have only 2 minutes of idle time between each run.
 
+Intervals of less than a second are rounded up by "@every"; schedule them
+with EveryPrecise instead, which keeps millisecond precision:
+
+	c.Schedule(cron.EveryPrecise(250*time.Millisecond), job)
+
+Jitter
+
+To keep many processes sharing a spec from firing in the same instant, wrap
+the schedule with Jitter, which delays each activation by a random offset, or
+HashJitter, which applies a fixed offset derived from a key:
+
+	sched, _ := cron.Parse("0 0/5 * * * *")
+	c.Schedule(cron.HashJitter(sched, 30*time.Second, hostname+"/report"), job)
+
 Time zones
 
 All interpretation and scheduling is done in the machine's local time zone (as
@@ -107,13 +132,39 @@ provided by the Go time package (http://www.golang.org/pkg/time).
 Be aware that jobs scheduled during daylight-savings leap-ahead transitions will
 not be run!
 
+Previewing and validation
+
+Schedules may be inspected without running a Cron.  Preview and PreviewSpec
+return the upcoming activation times within a window, Describe renders a
+schedule in words, and Validate reports which field of a spec is invalid.
+
+	times, err := cron.PreviewSpec("0 30 9 * * MON-FRI", from, to, 10)
+	fmt.Println(cron.Describe(sched))  // second 0, minute 30, hour 9, ...
+	if ferr, ok := cron.Validate(spec).(*cron.FieldError); ok {
+		fmt.Println("bad", ferr.Field)
+	}
+
+Observing execution
+
+An Observer registered with AddObserver receives an Event when an entry is
+scheduled, when its job starts, finishes or panics, and for each activation
+skipped because the scheduler woke too late.  Stats returns counters of runs,
+failures, skips and the lag between planned and actual start times.
+
+	c.AddObserver(cron.ObserverFunc(func(e cron.Event) {
+		if e.Type == cron.EventFinish {
+			metrics.Observe(e.Duration)
+		}
+	}))
+
 Thread safety
 
 Since the Cron service runs concurrently with the calling code, some amount of
 care must be taken to ensure proper synchronization.
 
-All cron methods are designed to be correctly synchronized as long as the caller
-ensures that invocations have a clear happens-before ordering between them.
+All cron methods are safe to call concurrently, from any goroutine, whether or
+not the scheduler is running.  Entries may be removed with Remove, using the ID
+returned by Schedule.
 
 Implementation
 
@@ -0,0 +1,88 @@
+package cron
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"time"
+)
+
+// JitterSchedule delays each activation of the wrapped Schedule by an offset
+// in [0, Max), so that many processes sharing a spec do not all fire in the
+// same instant. Max should be smaller than the interval between activations.
+type JitterSchedule struct {
+	Schedule Schedule
+	Max      time.Duration
+
+	seed  uint64
+	fixed bool
+}
+
+// Jitter returns a Schedule that delays every activation of schedule by a
+// random offset of less than max, drawn afresh for each activation.
+func Jitter(schedule Schedule, max time.Duration) *JitterSchedule {
+	return &JitterSchedule{
+		Schedule: schedule,
+		Max:      max,
+		seed:     rand.Uint64(),
+	}
+}
+
+// HashJitter returns a Schedule that delays every activation of schedule by
+// the same offset of less than max, derived from key. Using e.g. the host and
+// job name as the key spreads pods apart deterministically across restarts.
+func HashJitter(schedule Schedule, max time.Duration, key string) *JitterSchedule {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return &JitterSchedule{
+		Schedule: schedule,
+		Max:      max,
+		seed:     h.Sum64(),
+		fixed:    true,
+	}
+}
+
+// Next returns the next jittered activation time, later than the given time.
+// It returns the zero time if the wrapped schedule is unsatisfiable.
+func (s *JitterSchedule) Next(t time.Time) time.Time {
+	if s.Max <= 0 {
+		return s.Schedule.Next(t)
+	}
+
+	// Any activation planned at or before t-Max has already fired, whatever
+	// its offset, so start the search just after it.
+	planned := s.Schedule.Next(t.Add(-s.Max))
+	for !planned.IsZero() {
+		if next := planned.Add(s.Offset(planned)); next.After(t) {
+			return next
+		}
+		planned = s.Schedule.Next(planned)
+	}
+	return time.Time{}
+}
+
+// Offset returns the delay applied to the activation planned at the given
+// time. It is a pure function of the seed and, unless fixed, the planned
+// time, so repeated calls to Next agree with each other.
+func (s *JitterSchedule) Offset(planned time.Time) time.Duration {
+	if s.Max <= 0 {
+		return 0
+	}
+	x := s.seed
+	if !s.fixed {
+		x ^= uint64(planned.UnixNano())
+	}
+	return time.Duration(mix64(x) % uint64(s.Max))
+}
+
+// Describe returns a human-readable description of the schedule.
+func (s *JitterSchedule) Describe() string {
+	return Describe(s.Schedule) + ", jitter up to " + s.Max.String()
+}
+
+// mix64 is the splitmix64 finalizer, used to spread nearby inputs.
+func mix64(x uint64) uint64 {
+	x += 0x9e3779b97f4a7c15
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
@@ -0,0 +1,88 @@
+package cron
+
+import (
+	"testing"
+	"time"
+)
+
+func TestJitterWithinBounds(t *testing.T) {
+	sched, _ := Parse("0 * * * * *")
+	max := 30 * time.Second
+
+	for _, js := range []*JitterSchedule{
+		Jitter(sched, max),
+		HashJitter(sched, max, "pod-1/job"),
+	} {
+		now := getTime("Mon Jul 9 14:45:40 2012")
+		planned := now
+		for i := 0; i < 100; i++ {
+			next := js.Next(now)
+			planned = sched.Next(planned)
+			if !next.After(now) {
+				t.Fatalf("%v: next %v not after %v", js, next, now)
+			}
+			if next.Before(planned) || !next.Before(planned.Add(max)) {
+				t.Fatalf("%v: next %v outside [%v, %v)", js, next, planned, planned.Add(max))
+			}
+			now = next
+		}
+	}
+}
+
+func TestHashJitterDeterministic(t *testing.T) {
+	sched := Every(time.Minute)
+	max := 20 * time.Second
+	a := HashJitter(sched, max, "pod-1/job")
+	b := HashJitter(sched, max, "pod-1/job")
+
+	now := getTime("Mon Jul 9 14:45 2012")
+	if a.Next(now) != b.Next(now) {
+		t.Errorf("expected equal keys to give equal activations")
+	}
+
+	// The same offset applies to every activation.
+	first, second := getTime("Mon Jul 9 14:45 2012"), getTime("Mon Jul 9 14:46 2012")
+	if a.Offset(first) != a.Offset(second) {
+		t.Errorf("expected a fixed offset, got %v and %v", a.Offset(first), a.Offset(second))
+	}
+
+	// Different keys should be spread apart.
+	offsets := map[time.Duration]bool{}
+	for _, key := range []string{"pod-1", "pod-2", "pod-3", "pod-4", "pod-5"} {
+		offsets[HashJitter(sched, max, key).Offset(first)] = true
+	}
+	if len(offsets) < 2 {
+		t.Errorf("expected different keys to give different offsets")
+	}
+}
+
+func TestJitterZeroSchedule(t *testing.T) {
+	js := Jitter(new(ZeroSchedule), time.Second)
+	if next := js.Next(time.Now()); !next.IsZero() {
+		t.Errorf("expected zero time, got %v", next)
+	}
+}
+
+// Test that a sub-second schedule runs more than once a second.
+func TestPreciseScheduleRuns(t *testing.T) {
+	calls := make(chan struct{}, 10)
+
+	cron := New()
+	cron.Schedule(EveryPrecise(100*time.Millisecond), FuncJob(func() {
+		select {
+		case calls <- struct{}{}:
+		default:
+		}
+	}))
+	cron.Start()
+	defer cron.Stop()
+
+	timeout := time.After(OneSecond)
+	for i := 0; i < 3; i++ {
+		select {
+		case <-calls:
+		case <-timeout:
+			t.Fatalf("expected 3 runs within a second, got %d", i)
+		}
+	}
+}
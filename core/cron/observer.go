@@ -0,0 +1,169 @@
+package cron
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// EventType identifies the point in an entry's life cycle an Event reports.
+type EventType int
+
+const (
+	// EventSchedule is sent whenever an entry's next activation is computed.
+	EventSchedule EventType = iota
+	// EventStart is sent as a job begins running.
+	EventStart
+	// EventFinish is sent when a job returns normally.
+	EventFinish
+	// EventPanic is sent when a job panics; the panic has been recovered.
+	EventPanic
+	// EventSkip is sent for each activation missed because the scheduler
+	// woke up too late to run it.
+	EventSkip
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventSchedule:
+		return "schedule"
+	case EventStart:
+		return "start"
+	case EventFinish:
+		return "finish"
+	case EventPanic:
+		return "panic"
+	case EventSkip:
+		return "skip"
+	}
+	return "unknown"
+}
+
+// Event describes something that happened to an entry.
+type Event struct {
+	Type EventType
+
+	// A snapshot of the entry the event concerns.
+	Entry *Entry
+
+	// The activation time the entry was scheduled for.
+	Planned time.Time
+
+	// When the job actually started; zero for schedule and skip events.
+	Start time.Time
+
+	// How long the job ran; only set for finish and panic events.
+	Duration time.Duration
+
+	// The recovered value; only set for panic events.
+	Panic interface{}
+}
+
+// Lag returns how late the job started relative to its planned time.
+func (e Event) Lag() time.Duration {
+	if e.Start.IsZero() {
+		return 0
+	}
+	return e.Start.Sub(e.Planned)
+}
+
+// Observer receives the events of a Cron. Observe is called synchronously,
+// from the scheduler goroutine for schedule and skip events and from the
+// job's goroutine otherwise, so it should return quickly.
+//
+// While handling a schedule or skip event of a running Cron, an Observer
+// must not call its AddFunc, AddJob, Schedule, Remove, Entries or Stop:
+// they wait for the scheduler goroutine, which is busy calling the
+// Observer, and would deadlock. Hand the call to another goroutine instead.
+type Observer interface {
+	Observe(Event)
+}
+
+// ObserverFunc is a wrapper that turns a func(Event) into a cron.Observer.
+type ObserverFunc func(Event)
+
+func (f ObserverFunc) Observe(e Event) { f(e) }
+
+// Stats holds counters describing the executions of a Cron.
+type Stats struct {
+	Runs     int64         // jobs started
+	Failures int64         // jobs that panicked
+	Skips    int64         // activations missed
+	Running  int64         // jobs currently running
+	LastLag  time.Duration // lag of the most recently started job
+	MaxLag   time.Duration // greatest lag seen
+	TotalLag time.Duration // sum of lags, for averaging over Runs
+}
+
+// AvgLag returns the mean lag between planned and actual start times.
+func (s Stats) AvgLag() time.Duration {
+	if s.Runs == 0 {
+		return 0
+	}
+	return s.TotalLag / time.Duration(s.Runs)
+}
+
+// stats is the live, atomically updated form of Stats.
+type stats struct {
+	runs, failures, skips, running int64
+	lastLag, maxLag, totalLag      int64
+}
+
+func (s *stats) started(lag time.Duration) {
+	atomic.AddInt64(&s.runs, 1)
+	atomic.AddInt64(&s.running, 1)
+	atomic.StoreInt64(&s.lastLag, int64(lag))
+	atomic.AddInt64(&s.totalLag, int64(lag))
+	for {
+		max := atomic.LoadInt64(&s.maxLag)
+		if int64(lag) <= max || atomic.CompareAndSwapInt64(&s.maxLag, max, int64(lag)) {
+			return
+		}
+	}
+}
+
+func (s *stats) snapshot() Stats {
+	return Stats{
+		Runs:     atomic.LoadInt64(&s.runs),
+		Failures: atomic.LoadInt64(&s.failures),
+		Skips:    atomic.LoadInt64(&s.skips),
+		Running:  atomic.LoadInt64(&s.running),
+		LastLag:  time.Duration(atomic.LoadInt64(&s.lastLag)),
+		MaxLag:   time.Duration(atomic.LoadInt64(&s.maxLag)),
+		TotalLag: time.Duration(atomic.LoadInt64(&s.totalLag)),
+	}
+}
+
+// AddObserver registers an observer to receive the events of this Cron.
+func (c *Cron) AddObserver(o Observer) {
+	c.observerMu.Lock()
+	c.observers = append(c.observers, o)
+	c.observerMu.Unlock()
+}
+
+// Stats returns a snapshot of the execution counters of this Cron.
+func (c *Cron) Stats() Stats {
+	return c.stats.snapshot()
+}
+
+// notify delivers the event to every registered observer.
+func (c *Cron) notify(e Event) {
+	c.observerMu.RLock()
+	observers := c.observers
+	c.observerMu.RUnlock()
+	for _, o := range observers {
+		o.Observe(e)
+	}
+}
+
+// scheduled records a newly computed activation of the entry, after counting
+// any activations between the previous one and now that will never run.
+func (c *Cron) scheduled(e *Entry, now time.Time) {
+	if !e.Next.IsZero() {
+		for missed := e.Schedule.Next(e.Next); !missed.IsZero() && !missed.After(now); missed = e.Schedule.Next(missed) {
+			atomic.AddInt64(&c.stats.skips, 1)
+			c.notify(Event{Type: EventSkip, Entry: e.snapshot(), Planned: missed})
+		}
+	}
+	e.Next = e.Schedule.Next(now)
+	c.notify(Event{Type: EventSchedule, Entry: e.snapshot(), Planned: e.Next})
+}
@@ -0,0 +1,147 @@
+package cron
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+type recorder struct {
+	sync.Mutex
+	events []Event
+}
+
+func (r *recorder) Observe(e Event) {
+	r.Lock()
+	r.events = append(r.events, e)
+	r.Unlock()
+}
+
+func (r *recorder) count(typ EventType) int {
+	r.Lock()
+	defer r.Unlock()
+	n := 0
+	for _, e := range r.events {
+		if e.Type == typ {
+			n++
+		}
+	}
+	return n
+}
+
+// Test that an observer sees a job scheduled, started and finished.
+func TestObserverEvents(t *testing.T) {
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+
+	rec := &recorder{}
+	cron := New()
+	cron.AddObserver(rec)
+	cron.AddObserver(ObserverFunc(func(e Event) {
+		if e.Type == EventFinish {
+			wg.Done()
+		}
+	}))
+	cron.AddFunc("* * * * * ?", func() {})
+	cron.Start()
+	defer cron.Stop()
+
+	select {
+	case <-time.After(OneSecond):
+		t.Fatal("expected job finishes")
+	case <-wait(wg):
+	}
+
+	if n := rec.count(EventSchedule); n < 2 {
+		t.Errorf("expected at least 2 schedule events, got %d", n)
+	}
+	if n := rec.count(EventStart); n != 1 {
+		t.Errorf("expected 1 start event, got %d", n)
+	}
+
+	rec.Lock()
+	defer rec.Unlock()
+	for _, e := range rec.events {
+		if e.Type != EventStart {
+			continue
+		}
+		if e.Entry == nil || e.Planned.IsZero() || e.Start.Before(e.Planned) {
+			t.Errorf("unexpected start event %+v", e)
+		}
+	}
+}
+
+// Test that panics are reported and counted.
+func TestObserverPanic(t *testing.T) {
+	panics := make(chan Event, 1)
+
+	cron := New()
+	cron.AddObserver(ObserverFunc(func(e Event) {
+		if e.Type == EventPanic {
+			panics <- e
+		}
+	}))
+	cron.AddFunc("* * * * * ?", func() { panic("YOLO") })
+	cron.Start()
+	defer cron.Stop()
+
+	select {
+	case <-time.After(OneSecond):
+		t.Fatal("expected panic event")
+	case e := <-panics:
+		if e.Panic != "YOLO" {
+			t.Errorf("expected recovered value YOLO, got %v", e.Panic)
+		}
+	}
+
+	stats := cron.Stats()
+	if stats.Runs != 1 || stats.Failures != 1 {
+		t.Errorf("expected 1 run and 1 failure, got %+v", stats)
+	}
+	if stats.MaxLag < stats.LastLag || stats.AvgLag() != stats.TotalLag {
+		t.Errorf("inconsistent lag counters %+v", stats)
+	}
+}
+
+// Test that activations missed while the scheduler was behind are skipped.
+func TestScheduledCountsSkips(t *testing.T) {
+	rec := &recorder{}
+	cron := New()
+	cron.AddObserver(rec)
+
+	e := &Entry{Schedule: Every(time.Second), Next: getTime("Mon Jul 9 14:45:00 2012")}
+	cron.scheduled(e, getTime("Mon Jul 9 14:45:03.5 2012"))
+
+	if n := rec.count(EventSkip); n != 3 {
+		t.Errorf("expected 3 skip events, got %d", n)
+	}
+	if skips := cron.Stats().Skips; skips != 3 {
+		t.Errorf("expected 3 skips counted, got %d", skips)
+	}
+	if expected := getTime("Mon Jul 9 14:45:04 2012"); e.Next != expected {
+		t.Errorf("(expected) %v != %v (actual)", expected, e.Next)
+	}
+}
+
+// Test that restarting after a pause does not report the paused activations
+// as skips.
+func TestRestartCountsNoSkips(t *testing.T) {
+	rec := &recorder{}
+	cron := New()
+	cron.AddObserver(rec)
+	cron.AddFunc("* * * * * ?", func() {})
+	cron.Start()
+	cron.Stop()
+
+	// as if stopped an hour ago
+	cron.entries[0].Next = cron.now().Add(-time.Hour)
+	cron.Start()
+	cron.Stop()
+
+	if n := rec.count(EventSkip); n != 0 {
+		t.Errorf("expected no skip events, got %d", n)
+	}
+	if skips := cron.Stats().Skips; skips != 0 {
+		t.Errorf("expected no skips counted, got %d", skips)
+	}
+}
@@ -34,6 +34,16 @@ var places = []ParseOption{
 	Dow,
 }
 
+// fieldNames names each place, for use in FieldError.
+var fieldNames = []string{
+	"Second",
+	"Minute",
+	"Hour",
+	"Dom",
+	"Month",
+	"Dow",
+}
+
 var defaults = []string{
 	"0",
 	"0",
@@ -43,6 +53,17 @@ var defaults = []string{
 	"*",
 }
 
+// FieldError reports the field of a spec that failed to parse.
+type FieldError struct {
+	Field string // Second, Minute, Hour, Dom, Month, Dow or Descriptor
+	Value string // the offending text of that field
+	Err   error
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("%s field %q: %s", e.Field, e.Value, e.Err)
+}
+
 // A custom Parser that can be configured.
 type Parser struct {
 	options   ParseOption
@@ -80,7 +101,11 @@ func (p Parser) Parse(spec string) (Schedule, error) {
 		return nil, fmt.Errorf("Empty spec string")
 	}
 	if spec[0] == '@' && p.options&Descriptor > 0 {
-		return parseDescriptor(spec)
+		schedule, err := parseDescriptor(spec)
+		if err != nil {
+			return nil, &FieldError{Field: "Descriptor", Value: spec, Err: err}
+		}
+		return schedule, nil
 	}
 
 	// Figure out how many fields we need
@@ -107,22 +132,24 @@ func (p Parser) Parse(spec string) (Schedule, error) {
 	fields = expandFields(fields, p.options)
 
 	var err error
-	field := func(field string, r bounds) uint64 {
+	field := func(i int, r bounds) uint64 {
 		if err != nil {
 			return 0
 		}
-		var bits uint64
-		bits, err = getField(field, r)
+		bits, ferr := getField(fields[i], r)
+		if ferr != nil {
+			err = &FieldError{Field: fieldNames[i], Value: fields[i], Err: ferr}
+		}
 		return bits
 	}
 
 	var (
-		second     = field(fields[0], seconds)
-		minute     = field(fields[1], minutes)
-		hour       = field(fields[2], hours)
-		dayofmonth = field(fields[3], dom)
-		month      = field(fields[4], months)
-		dayofweek  = field(fields[5], dow)
+		second     = field(0, seconds)
+		minute     = field(1, minutes)
+		hour       = field(2, hours)
+		dayofmonth = field(3, dom)
+		month      = field(4, months)
+		dayofweek  = field(5, dow)
 	)
 	if err != nil {
 		return nil, err
@@ -155,6 +182,13 @@ func expandFields(fields []string, options ParseOption) []string {
 	return expFields
 }
 
+// Validate reports whether spec is acceptable to the parser. When a single
+// field is at fault the error is a *FieldError naming it.
+func (p Parser) Validate(spec string) error {
+	_, err := p.Parse(spec)
+	return err
+}
+
 var standardParser = NewParser(
 	Minute | Hour | Dom | Month | Dow | Descriptor,
 )
@@ -185,6 +219,12 @@ func Parse(spec string) (Schedule, error) {
 	return defaultParser.Parse(spec)
 }
 
+// Validate reports whether spec is acceptable to Parse. When a single field
+// is at fault the error is a *FieldError naming it.
+func Validate(spec string) error {
+	return defaultParser.Validate(spec)
+}
+
 // getField returns an Int with the bits set representing all of the times that
 // the field represents or error parsing field value.  A "field" is a comma-separated
 // list of "ranges".
@@ -0,0 +1,41 @@
+package cron
+
+import "time"
+
+// Preview returns up to n activation times of the schedule that are later
+// than from and not later than to. A zero to leaves the window open-ended,
+// in which case n bounds the result; a non-positive n is only honoured with a
+// bounded window. No scheduler needs to be running.
+func Preview(schedule Schedule, from, to time.Time, n int) []time.Time {
+	if n <= 0 && to.IsZero() {
+		return nil
+	}
+	var times []time.Time
+	for t := from; n <= 0 || len(times) < n; {
+		next := schedule.Next(t)
+		// Stop on an unsatisfiable schedule, or one that fails to advance.
+		if next.IsZero() || !next.After(t) {
+			break
+		}
+		if !to.IsZero() && next.After(to) {
+			break
+		}
+		times = append(times, next)
+		t = next
+	}
+	return times
+}
+
+// PreviewSpec parses spec and returns its activation times as Preview does.
+func PreviewSpec(spec string, from, to time.Time, n int) ([]time.Time, error) {
+	schedule, err := Parse(spec)
+	if err != nil {
+		return nil, err
+	}
+	return Preview(schedule, from, to, n), nil
+}
+
+// Preview returns the entry's upcoming activation times as Preview does.
+func (e *Entry) Preview(from, to time.Time, n int) []time.Time {
+	return Preview(e.Schedule, from, to, n)
+}
@@ -0,0 +1,126 @@
+package cron
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPreviewSpec(t *testing.T) {
+	tests := []struct {
+		spec     string
+		from, to string
+		n        int
+		expected []string
+	}{
+		// Bounded by n.
+		{"0 0/15 * * *", "Mon Jul 9 14:45 2012", "", 3,
+			[]string{"Mon Jul 9 15:00 2012", "Mon Jul 9 15:15 2012", "Mon Jul 9 15:30 2012"}},
+
+		// Bounded by the window; the upper bound is inclusive.
+		{"0 0/15 * * *", "Mon Jul 9 14:45 2012", "Mon Jul 9 15:15 2012", 10,
+			[]string{"Mon Jul 9 15:00 2012", "Mon Jul 9 15:15 2012"}},
+
+		// Non-positive n with a window returns everything in it.
+		{"0 0 * * * *", "Mon Jul 9 22:30 2012", "Tue Jul 10 01:00 2012", 0,
+			[]string{"Mon Jul 9 23:00 2012", "Tue Jul 10 00:00 2012", "Tue Jul 10 01:00 2012"}},
+
+		// Non-positive n without a window returns nothing.
+		{"0 0 * * * *", "Mon Jul 9 22:30 2012", "", 0, nil},
+
+		// Intervals.
+		{"@every 90m", "Mon Jul 9 22:30 2012", "", 2,
+			[]string{"Tue Jul 10 00:00 2012", "Tue Jul 10 01:30 2012"}},
+
+		// Unsatisfiable schedules stop early.
+		{"0 0 0 30 Feb ?", "Mon Jul 9 22:30 2012", "", 2, nil},
+	}
+
+	for _, c := range tests {
+		actual, err := PreviewSpec(c.spec, getTime(c.from), getTime(c.to), c.n)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", c.spec, err)
+			continue
+		}
+		var expected []time.Time
+		for _, e := range c.expected {
+			expected = append(expected, getTime(e))
+		}
+		if !reflect.DeepEqual(expected, actual) {
+			t.Errorf("%s from %s: (expected) %v != %v (actual)", c.spec, c.from, expected, actual)
+		}
+	}
+}
+
+func TestEntryPreview(t *testing.T) {
+	entry := &Entry{Schedule: Every(time.Hour)}
+	actual := entry.Preview(getTime("Mon Jul 9 22:30 2012"), getTime("Tue Jul 10 00:00 2012"), 5)
+	expected := []time.Time{getTime("Mon Jul 9 23:30 2012")}
+	if !reflect.DeepEqual(expected, actual) {
+		t.Errorf("(expected) %v != %v (actual)", expected, actual)
+	}
+}
+
+func TestDescribe(t *testing.T) {
+	tests := []struct {
+		spec     string
+		expected string
+	}{
+		{"* * * * * ?", "every second, every minute, every hour, every day, every month"},
+		{"0 30 9-17 * * MON-FRI", "second 0, minute 30, hours 9-17, days of week Mon-Fri, every month"},
+		{"0 0/20 8,9 1,15 Jan-Mar ?", "second 0, minutes 0,20,40, hours 8,9, days of month 1,15, months Jan-Mar"},
+		{"0 0 0 1,15 * Sun", "second 0, minute 0, hour 0, days of month 1,15 or day of week Sun, every month"},
+		{"0 0 0 1,15 * 0-6", "second 0, minute 0, hour 0, every day, every month"},
+		{"0 0 0 */2 * Sun", "second 0, minute 0, hour 0, days of month 1,3,5,7,9,11,13,15,17,19,21,23,25,27,29,31 and day of week Sun, every month"},
+		{"@every 1h30m", "every 1h30m0s"},
+	}
+
+	for _, c := range tests {
+		sched, err := Parse(c.spec)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", c.spec, err)
+			continue
+		}
+		if actual := Describe(sched); actual != c.expected {
+			t.Errorf("%s: (expected) %q != %q (actual)", c.spec, c.expected, actual)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		spec  string
+		field string
+		value string
+	}{
+		{"0 30 9-17 * * MON-FRI", "", ""},
+		{"0 61 * * * *", "Minute", "61"},
+		{"0 * * 1-40 * *", "Dom", "1-40"},
+		{"0 * * * Foo *", "Month", "Foo"},
+		{"0 * * * * 9", "Dow", "9"},
+		{"@every Xm", "Descriptor", "@every Xm"},
+	}
+
+	for _, c := range tests {
+		err := Validate(c.spec)
+		if c.field == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error %v", c.spec, err)
+			}
+			continue
+		}
+		ferr, ok := err.(*FieldError)
+		if !ok {
+			t.Errorf("%s: expected a *FieldError, got %v", c.spec, err)
+			continue
+		}
+		if ferr.Field != c.field || ferr.Value != c.value {
+			t.Errorf("%s: (expected) %s=%q != %s=%q (actual)", c.spec, c.field, c.value, ferr.Field, ferr.Value)
+		}
+	}
+
+	// A wrong field count is not attributable to a single field.
+	if _, ok := Validate("* * *").(*FieldError); ok {
+		t.Error("expected a plain error for a wrong field count")
+	}
+}
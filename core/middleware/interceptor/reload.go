@@ -4,10 +4,51 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 	"time"
 )
 
+var (
+	hooksLock  sync.Mutex
+	closeHooks []*closeHook
+)
+
+type closeHook struct {
+	fn func()
+}
+
+// OnClose registers fn to run as soon as Reload gets a stop signal, before
+// the grace period and its own close function, e.g. to deregister from
+// service discovery while still serving. The returned func unregisters it.
+// 收到退出信号后立即执行
+func OnClose(fn func()) (unregister func()) {
+	hook := &closeHook{fn: fn}
+	hooksLock.Lock()
+	defer hooksLock.Unlock()
+	closeHooks = append(closeHooks, hook)
+	return func() {
+		hooksLock.Lock()
+		defer hooksLock.Unlock()
+		for i, h := range closeHooks {
+			if h == hook {
+				closeHooks = append(closeHooks[:i:i], closeHooks[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+func runCloseHooks() {
+	hooksLock.Lock()
+	hooks := closeHooks
+	closeHooks = nil
+	hooksLock.Unlock()
+	for _, hook := range hooks {
+		hook.fn()
+	}
+}
+
 // Reload Reload
 func Reload(cls func()) {
 	env := os.Getenv("ENV_DEVELOPMENT")
@@ -19,6 +60,7 @@ func Reload(cls func()) {
 		fmt.Println(fmt.Sprintf("service get a signal %s, %v", s.String(), s))
 		switch s {
 		case syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGSTOP, syscall.SIGINT, syscall.SIGHUP:
+			runCloseHooks()
 			if env != "debug" {
 				time.Sleep(3 * time.Second)
 			}
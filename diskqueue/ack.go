@@ -0,0 +1,68 @@
+package diskqueue
+
+import (
+	"errors"
+	"time"
+)
+
+// Offset identifies a message by the data file and position it was read from
+type Offset struct {
+	FileNum int64
+	Pos     int64
+}
+
+// Message is a message handed out by Get, which must be acknowledged with
+// Ack once processed
+type Message struct {
+	Body      []byte
+	Offset    Offset
+	Timestamp time.Time // when it was enqueued, zero without record headers
+}
+
+// inFlightMsg is a delivered message that may not yet be acknowledged
+type inFlightMsg struct {
+	offset Offset
+	acked  bool
+}
+
+// ackRequest asks the ioLoop to acknowledge an offset on a cursor
+type ackRequest struct {
+	c      *cursor
+	offset Offset
+}
+
+// ErrUnknownOffset is returned by Ack for an offset that is not in flight,
+// e.g. one delivered before a restart, which will be delivered again
+var ErrUnknownOffset = errors.New("unknown offset")
+
+// Get returns the next message, blocking until one is available. Unlike
+// messages sent on ReadChan, it is only removed from the queue once passed to
+// Ack; if the queue is closed first, it is delivered again after a restart.
+//获取一条需要确认的消息
+func (d *diskQueue) Get() (*Message, error) {
+	if d.consumersOnly {
+		return nil, errConsumersOnly
+	}
+	select {
+	case m := <-d.getChan:
+		return m, nil
+	case <-d.exitChan:
+		return nil, errors.New("exiting")
+	}
+}
+
+// Ack acknowledges the message at the given offset. The committed position
+// persisted in the metadata advances past every message up to the oldest
+// one still unacknowledged.
+//确认消息
+func (d *diskQueue) Ack(offset Offset) error {
+	d.RLock()
+	defer d.RUnlock()
+
+	if d.exitFlag == 1 {
+		return errors.New("exiting")
+	}
+
+	d.ackChan <- ackRequest{c: &d.cursor, offset: offset}
+	return <-d.ackResponseChan
+}
@@ -0,0 +1,239 @@
+// dqtool inspects and repairs diskqueue directories offline. The queue must
+// not be open in any process while it runs.
+//
+//	dqtool -dir DIR -name NAME meta
+//	dqtool -dir DIR -name NAME count [-all]
+//	dqtool -dir DIR -name NAME dump [-all] [-n N] [-hex]
+//	dqtool -dir DIR -name NAME verify
+//	dqtool -dir DIR -name NAME truncate
+//	dqtool -dir DIR -name NAME reset start|end|FILENUM:POS
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"twist/diskqueue"
+)
+
+var (
+	dir        = flag.String("dir", ".", "directory holding the queue files")
+	name       = flag.String("name", "", "name of the queue")
+	minMsgSize = flag.Int("min-msg-size", 0, "minimum message size the queue was opened with")
+	maxMsgSize = flag.Int("max-msg-size", 1024*1024, "maximum message size the queue was opened with")
+)
+
+var errStop = errors.New("stop")
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `usage: dqtool -dir DIR -name NAME [flags] command [args]
+
+commands:
+  meta                        print the metadata
+  count [-all]                count the messages left to read, or all on disk
+  dump [-all] [-n N] [-hex]   print the messages left to read, or all on disk
+  verify                      check every record of every data file
+  truncate                    cut a corrupt tail off the newest data file
+  reset start|end|FILE:POS    move the read position
+
+flags:
+`)
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if *name == "" || flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+
+	in := diskqueue.NewInspector(*name, *dir, int32(*minMsgSize), int32(*maxMsgSize))
+	cmd, args := flag.Arg(0), flag.Args()[1:]
+
+	var err error
+	switch cmd {
+	case "meta":
+		err = meta(in)
+	case "count":
+		err = count(in, args)
+	case "dump":
+		err = dump(in, args)
+	case "verify":
+		err = verify(in)
+	case "truncate":
+		err = truncate(in)
+	case "reset":
+		err = reset(in, args)
+	default:
+		usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "dqtool:", err)
+		os.Exit(1)
+	}
+}
+
+func meta(in *diskqueue.Inspector) error {
+	m, err := in.Meta()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("depth:  %d\n", m.Depth)
+	fmt.Printf("read:   %s\n", offset(m.Read))
+	fmt.Printf("write:  %s\n", offset(m.Write))
+	for _, c := range m.Consumers {
+		fmt.Printf("consumer %s: depth %d, read %s\n", c.Name, c.Depth, offset(c.Read))
+	}
+
+	segments, err := in.Segments()
+	if err != nil {
+		return err
+	}
+	for _, s := range segments {
+		fmt.Printf("segment %06d: %d bytes, version %d, compression %s\n",
+			s.FileNum, s.Size, s.Version, s.Compression)
+	}
+	return nil
+}
+
+// from returns where count and dump start: the read position, or with -all
+// the oldest message on disk
+func from(in *diskqueue.Inspector, all bool) (diskqueue.Offset, error) {
+	if all {
+		return in.Start()
+	}
+	m, err := in.Meta()
+	if err != nil {
+		return diskqueue.Offset{}, err
+	}
+	return m.Read, nil
+}
+
+func count(in *diskqueue.Inspector, args []string) error {
+	fs := flag.NewFlagSet("count", flag.ExitOnError)
+	all := fs.Bool("all", false, "count every message on disk, not just those left to read")
+	fs.Parse(args)
+
+	start, err := from(in, *all)
+	if err != nil {
+		return err
+	}
+	n, err := in.Count(start)
+	fmt.Println(n)
+	return err
+}
+
+func dump(in *diskqueue.Inspector, args []string) error {
+	fs := flag.NewFlagSet("dump", flag.ExitOnError)
+	all := fs.Bool("all", false, "dump every message on disk, not just those left to read")
+	limit := fs.Int("n", 0, "stop after this many messages, 0 for no limit")
+	asHex := fs.Bool("hex", false, "print message bodies as hex dumps")
+	fs.Parse(args)
+
+	start, err := from(in, *all)
+	if err != nil {
+		return err
+	}
+	n := 0
+	err = in.Scan(start, func(r diskqueue.Record) error {
+		if *asHex {
+			fmt.Printf("%s %d bytes\n%s", offset(r.Offset), len(r.Body), hex.Dump(r.Body))
+		} else {
+			fmt.Printf("%s %s\n", offset(r.Offset), r.Body)
+		}
+		n++
+		if *limit > 0 && n >= *limit {
+			return errStop
+		}
+		return nil
+	})
+	if err == errStop {
+		return nil
+	}
+	return err
+}
+
+func verify(in *diskqueue.Inspector) error {
+	reports, err := in.Verify()
+	if err != nil {
+		return err
+	}
+	bad := 0
+	for _, r := range reports {
+		status := "ok"
+		if r.Err != nil {
+			status = r.Err.Error()
+			bad++
+		}
+		fmt.Printf("segment %06d: %d records, %d/%d bytes valid: %s\n",
+			r.FileNum, r.Records, r.ValidBytes, r.Size, status)
+	}
+	if bad > 0 {
+		return fmt.Errorf("%d corrupt segments", bad)
+	}
+	return nil
+}
+
+func truncate(in *diskqueue.Inspector) error {
+	n, err := in.TruncateTail()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("truncated %d bytes\n", n)
+	return nil
+}
+
+func reset(in *diskqueue.Inspector, args []string) error {
+	if len(args) != 1 {
+		return errors.New("reset needs one of start, end or FILE:POS")
+	}
+
+	var to diskqueue.Offset
+	var err error
+	switch args[0] {
+	case "start":
+		to, err = in.Start()
+	case "end":
+		to, err = in.End()
+	default:
+		to, err = parseOffset(args[0])
+	}
+	if err != nil {
+		return err
+	}
+
+	err = in.ResetCursor(to)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("read position reset to %s\n", offset(to))
+	return nil
+}
+
+func offset(o diskqueue.Offset) string {
+	return fmt.Sprintf("%06d:%d", o.FileNum, o.Pos)
+}
+
+func parseOffset(s string) (diskqueue.Offset, error) {
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 {
+		return diskqueue.Offset{}, fmt.Errorf("invalid offset %q, want FILE:POS", s)
+	}
+	fileNum, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return diskqueue.Offset{}, fmt.Errorf("invalid offset %q - %s", s, err)
+	}
+	pos, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return diskqueue.Offset{}, fmt.Errorf("invalid offset %q - %s", s, err)
+	}
+	return diskqueue.Offset{FileNum: fileNum, Pos: pos}, nil
+}
@@ -0,0 +1,191 @@
+package diskqueue
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// Compression selects how the payloads of the records in a data file are
+// compressed. It is recorded in the low bits of the file header's flags byte
+// when a file is created, so files written with different settings can be
+// read side by side and changing it only affects new files.
+//
+// Each record of a compressed file is compressed on its own, so offsets,
+// checksums and corruption recovery work exactly as for plain files. Its
+// payload starts with a byte saying whether the rest is compressed, which
+// it is not when compression would not make it any smaller.
+//数据文件的压缩方式，记录在文件头的flags里
+type Compression byte
+
+const (
+	NoCompression Compression = iota
+	Flate
+	Gzip
+)
+
+const (
+	compressionMask = 0x03
+
+	// first byte of the payload of a record in a compressed file
+	payloadStored     = 0
+	payloadCompressed = 1
+)
+
+func (c Compression) String() string {
+	switch c {
+	case NoCompression:
+		return "none"
+	case Flate:
+		return "flate"
+	case Gzip:
+		return "gzip"
+	}
+	return fmt.Sprintf("Compression(%d)", byte(c))
+}
+
+// fileCompression returns the compression recorded in a file header's flags
+func fileCompression(flags byte) Compression {
+	return Compression(flags & compressionMask)
+}
+
+// storedSizeBounds returns the bounds on the size of a record as stored in a
+// file with the given compression, allowing for the payload prefix and, if
+// the file has them, the record header
+func storedSizeBounds(c Compression, headers bool, minMsgSize int32, maxMsgSize int32) (int32, int32) {
+	if headers {
+		minMsgSize += recordHeaderSize
+		maxMsgSize += recordHeaderSize
+	}
+	if c == NoCompression {
+		return minMsgSize, maxMsgSize
+	}
+	return 1, maxMsgSize + 1
+}
+
+// compressor compresses record payloads, reusing its buffers and writers
+// from one record to the next
+type compressor struct {
+	buf bytes.Buffer
+	fw  *flate.Writer
+	gw  *gzip.Writer
+}
+
+// compress returns the payload to store for data in a file with the given
+// compression. The result is only valid until the next call.
+func (z *compressor) compress(c Compression, data []byte) ([]byte, error) {
+	if c == NoCompression {
+		return data, nil
+	}
+
+	z.buf.Reset()
+	z.buf.WriteByte(payloadCompressed)
+
+	var w io.WriteCloser
+	switch c {
+	case Flate:
+		if z.fw == nil {
+			fw, err := flate.NewWriter(&z.buf, flate.BestSpeed)
+			if err != nil {
+				return nil, err
+			}
+			z.fw = fw
+		} else {
+			z.fw.Reset(&z.buf)
+		}
+		w = z.fw
+	case Gzip:
+		if z.gw == nil {
+			z.gw, _ = gzip.NewWriterLevel(&z.buf, gzip.BestSpeed)
+		} else {
+			z.gw.Reset(&z.buf)
+		}
+		w = z.gw
+	default:
+		return nil, fmt.Errorf("unknown compression %s", c)
+	}
+
+	_, err := w.Write(data)
+	if err != nil {
+		return nil, err
+	}
+	err = w.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	//压缩后没有变小就直接存原文
+	if z.buf.Len() > len(data) {
+		z.buf.Reset()
+		z.buf.WriteByte(payloadStored)
+		z.buf.Write(data)
+	}
+	return z.buf.Bytes(), nil
+}
+
+// decompressor decompresses record payloads, reusing its readers from one
+// record to the next
+type decompressor struct {
+	fr io.ReadCloser
+	gr *gzip.Reader
+}
+
+var errBadPayload = errors.New("invalid compressed payload")
+
+// decompress returns the message stored as payload in a file with the given
+// compression, failing if it would be longer than maxMsgSize
+func (x *decompressor) decompress(c Compression, payload []byte, maxMsgSize int32) ([]byte, error) {
+	if c == NoCompression {
+		return payload, nil
+	}
+	if len(payload) == 0 {
+		return nil, errBadPayload
+	}
+
+	switch payload[0] {
+	case payloadStored:
+		return payload[1:], nil
+	case payloadCompressed:
+	default:
+		return nil, errBadPayload
+	}
+
+	src := bytes.NewReader(payload[1:])
+	var r io.Reader
+	switch c {
+	case Flate:
+		if x.fr == nil {
+			x.fr = flate.NewReader(src)
+		} else {
+			x.fr.(flate.Resetter).Reset(src, nil)
+		}
+		r = x.fr
+	case Gzip:
+		if x.gr == nil {
+			gr, err := gzip.NewReader(src)
+			if err != nil {
+				return nil, err
+			}
+			x.gr = gr
+		} else if err := x.gr.Reset(src); err != nil {
+			return nil, err
+		}
+		r = x.gr
+	default:
+		return nil, fmt.Errorf("unknown compression %s", c)
+	}
+
+	//限制解压后的长度
+	data, err := ioutil.ReadAll(io.LimitReader(r, int64(maxMsgSize)+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > int64(maxMsgSize) {
+		return nil, fmt.Errorf("decompressed message larger than %d", maxMsgSize)
+	}
+	return data, nil
+}
@@ -0,0 +1,284 @@
+package diskqueue
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+)
+
+// Consumer is a named reader of a queue. Every consumer sees every message
+// written after it was first opened, independently of the queue's own reader
+// and of other consumers, and its committed position is persisted so that it
+// picks up where it left off after a restart. Data files are only removed
+// once the slowest consumer, and the queue's own reader unless the queue was
+// opened WithConsumersOnly, has acknowledged everything in them.
+//命名消费者，各自独立地读取队列并持久化自己的位置
+type Consumer interface {
+	Name() string
+	Get() (*Message, error)
+	Ack(Offset) error
+	Depth() int64
+	Expired() int64
+}
+
+// ErrConsumerRemoved is returned by a Consumer after RemoveConsumer
+var ErrConsumerRemoved = errors.New("consumer removed")
+
+var errConsumersOnly = errors.New("queue only read by named consumers, see WithConsumersOnly")
+
+// getRequest asks the ioLoop for the next message of a named consumer
+type getRequest struct {
+	c    *cursor
+	resp chan *Message // buffered, receives nil if the consumer is removed
+}
+
+// consumer is the handle returned by diskQueue.Consumer
+type consumer struct {
+	c *cursor
+}
+
+// Consumer returns the named consumer, creating it at the current write
+// position if it does not exist yet.
+//获取命名消费者，不存在时从当前写位置开始创建
+func (d *diskQueue) Consumer(name string) (Consumer, error) {
+	if name == "" || strings.ContainsAny(name, `/\`) {
+		return nil, fmt.Errorf("invalid consumer name %q", name)
+	}
+
+	d.RLock()
+	defer d.RUnlock()
+
+	if d.exitFlag == 1 {
+		return nil, errors.New("exiting")
+	}
+
+	d.openConsumerChan <- name
+	return &consumer{c: <-d.openConsumerResponseChan}, nil
+}
+
+// RemoveConsumer forgets the named consumer and its persisted position,
+// releasing any data files only it was holding on to.
+//删除命名消费者
+func (d *diskQueue) RemoveConsumer(name string) error {
+	d.RLock()
+	defer d.RUnlock()
+
+	if d.exitFlag == 1 {
+		return errors.New("exiting")
+	}
+
+	d.removeConsumerChan <- name
+	return <-d.removeConsumerResponseChan
+}
+
+func (c *consumer) Name() string {
+	return c.c.name
+}
+
+// Get returns the consumer's next message, blocking until one is available.
+// It is redelivered after a restart unless passed to Ack first.
+func (c *consumer) Get() (*Message, error) {
+	d := c.c.dq
+	req := getRequest{c: c.c, resp: make(chan *Message, 1)}
+
+	d.RLock()
+	if d.exitFlag == 1 {
+		d.RUnlock()
+		return nil, errors.New("exiting")
+	}
+	d.consumerGetChan <- req
+	d.RUnlock()
+
+	select {
+	case m := <-req.resp:
+		if m == nil {
+			return nil, ErrConsumerRemoved
+		}
+		return m, nil
+	case <-d.exitChan:
+		return nil, errors.New("exiting")
+	}
+}
+
+// Ack acknowledges the consumer's message at the given offset
+func (c *consumer) Ack(offset Offset) error {
+	d := c.c.dq
+	d.RLock()
+	defer d.RUnlock()
+
+	if d.exitFlag == 1 {
+		return errors.New("exiting")
+	}
+
+	d.ackChan <- ackRequest{c: c.c, offset: offset}
+	return <-d.ackResponseChan
+}
+
+// Depth returns the number of messages the consumer has not acknowledged
+func (c *consumer) Depth() int64 {
+	return atomic.LoadInt64(&c.c.depth)
+}
+
+// Expired returns the number of expired messages the consumer has skipped
+// since the queue was opened
+func (c *consumer) Expired() int64 {
+	return atomic.LoadInt64(&c.c.expired)
+}
+
+// openConsumer returns the named cursor, creating it if necessary
+func (d *diskQueue) openConsumer(name string) *cursor {
+	if c, ok := d.consumers[name]; ok {
+		return c
+	}
+	c := newCursor(d, name)
+	c.reset(d.writeFileNum, d.writePos)
+	d.consumers[name] = c
+	d.needSync = true
+	d.logf(INFO, "DISKQUEUE(%s): added consumer %s", d.name, name)
+	return c
+}
+
+// removeConsumer drops the named cursor, failing any Get waiting on it
+func (d *diskQueue) removeConsumer(name string) error {
+	c, ok := d.consumers[name]
+	if !ok {
+		return fmt.Errorf("no consumer %q", name)
+	}
+	delete(d.consumers, name)
+	c.closeFile()
+	for _, w := range c.waiting {
+		w <- nil
+	}
+	c.waiting = nil
+
+	d.logf(INFO, "DISKQUEUE(%s): removed consumer %s", d.name, name)
+	err := os.Remove(d.consumerMetaDataFileName(name))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	d.removeConsumedFiles()
+	return nil
+}
+
+// ackConsumer acknowledges an offset on the queue's own cursor or on a
+// consumer that still exists
+func (d *diskQueue) ackConsumer(req ackRequest) error {
+	if req.c.name != "" && d.consumers[req.c.name] != req.c {
+		return ErrConsumerRemoved
+	}
+	return req.c.ack(req.offset)
+}
+
+// getConsumer answers a Get at once if there is data, or parks it until the
+// next write
+func (d *diskQueue) getConsumer(req getRequest) {
+	if d.consumers[req.c.name] != req.c {
+		req.resp <- nil
+		return
+	}
+	req.c.waiting = append(req.c.waiting, req.resp)
+	d.serveConsumers()
+}
+
+// serveConsumers hands out messages to any consumers waiting for them
+func (d *diskQueue) serveConsumers() {
+	for _, c := range d.consumers {
+		for len(c.waiting) > 0 {
+			m := c.next()
+			if m == nil {
+				break
+			}
+			c.waiting[0] <- m
+			c.waiting[0] = nil
+			c.waiting = c.waiting[1:]
+		}
+	}
+}
+
+// removeConsumedFiles removes the data files that every cursor has
+// acknowledged
+//删除所有游标都已确认完的文件
+func (d *diskQueue) removeConsumedFiles() {
+	oldest := d.retainFileNum()
+	if d.consumersOnly {
+		//队列自身的游标不读取，只看命名消费者
+		oldest = d.writeFileNum
+	}
+	for _, c := range d.consumers {
+		if fileNum := c.retainFileNum(); fileNum < oldest {
+			oldest = fileNum
+		}
+	}
+
+	for ; d.oldestFileNum < oldest; d.oldestFileNum++ {
+		err := d.removeDataFile(d.oldestFileNum)
+		if err != nil {
+			d.logf(ERROR, "DISKQUEUE(%s) failed to Remove(%s) - %s", d.name, d.fileName(d.oldestFileNum), err)
+		}
+		d.needSync = true
+	}
+}
+
+// retrieveConsumers loads the persisted positions of all named consumers
+//读取所有命名消费者的元数据
+func (d *diskQueue) retrieveConsumers() error {
+	prefix := d.name + ".diskqueue.consumer."
+	const suffix = ".meta.dat"
+	matches, err := filepath.Glob(path.Join(d.dataPath, prefix+"*"+suffix))
+	if err != nil {
+		return err
+	}
+
+	for _, fn := range matches {
+		name := strings.TrimSuffix(strings.TrimPrefix(path.Base(fn), prefix), suffix)
+		c := newCursor(d, name)
+
+		f, err := os.OpenFile(fn, os.O_RDONLY, 0600)
+		if err != nil {
+			return err
+		}
+		r := bufio.NewReader(f)
+		var depth, fileNum, pos int64
+		_, err = fmt.Fscanf(r, "%d\n%d,%d\n", &depth, &fileNum, &pos)
+		held := scanHeld(r)
+		f.Close()
+		if err != nil {
+			d.logf(ERROR, "DISKQUEUE(%s) failed to read consumer metadata %s - %s", d.name, fn, err)
+			continue
+		}
+
+		if fileNum > d.writeFileNum || (fileNum == d.writeFileNum && pos > d.writePos) {
+			d.logf(ERROR, "DISKQUEUE(%s) consumer %s beyond write position, resetting...", d.name, name)
+			fileNum, pos, depth, held = d.writeFileNum, d.writePos, 0, nil
+		}
+		c.reset(fileNum, pos)
+		c.held = held
+		atomic.StoreInt64(&c.depth, depth)
+		d.consumers[name] = c
+	}
+	return nil
+}
+
+// persistConsumers atomically writes the position of every named consumer
+//持久化命名消费者的元数据
+func (d *diskQueue) persistConsumers() error {
+	for name, c := range d.consumers {
+		err := writeFileAtomic(d.consumerMetaDataFileName(name), fmt.Sprintf("%d\n%d,%d\n",
+			atomic.LoadInt64(&c.depth),
+			c.ackFileNum, c.ackPos)+c.heldLines())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//获取命名消费者的元数据文件名
+func (d *diskQueue) consumerMetaDataFileName(name string) string {
+	return path.Join(d.dataPath, fmt.Sprintf("%s.diskqueue.consumer.%s.meta.dat", d.name, name))
+}
@@ -0,0 +1,466 @@
+package diskqueue
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// cursor is a read position over the data files of a diskQueue, together
+// with the messages it has delivered but not yet committed. The queue's own
+// reader (ReadChan and Get) is a cursor, and so is every named consumer.
+//
+// cursors are only touched from the ioLoop goroutine, except for depth.
+//读游标，队列自身和每个命名消费者各有一个
+type cursor struct {
+	// 64bit atomic vars need to be first for proper alignment on 32bit platforms
+	depth   int64 //未确认消息的数量
+	expired int64 //跳过的过期消息数量
+
+	// run-time state (also persisted to disk)
+	readPos     int64 //当前文件读取的位置
+	readFileNum int64 //正在读取的文件索引
+	ackPos      int64 //已确认的位置(持久化的读位置)
+	ackFileNum  int64 //已确认的文件索引
+
+	// keeps track of the position where we have read
+	// (but not yet delivered)
+	nextReadPos     int64 //下一次读的位置
+	nextReadFileNum int64 //下一次读的文件索引
+
+	readFile        *os.File    //读文件的对象
+	readVersion     int         //读文件的格式版本
+	readCompression Compression //读文件的压缩方式
+	readHeaders     bool        //读文件是否有记录头
+	reader          *bufio.Reader
+	inflate         decompressor
+	header          recordHeader //最近读到的记录头
+
+	// messages delivered but not yet committed, oldest first
+	inFlight      []*inFlightMsg
+	inFlightIndex map[Offset]*inFlightMsg
+
+	// messages read before they are due, see schedule, and those of them
+	// handed out by Get until acknowledged
+	held    heldQueue
+	heldOut map[Offset]heldMsg
+
+	name    string          //消费者名，队列自身的游标为空
+	waiting []chan *Message //等待消息的Get请求
+	dq      *diskQueue
+}
+
+func newCursor(dq *diskQueue, name string) *cursor {
+	return &cursor{
+		name:          name,
+		inFlightIndex: make(map[Offset]*inFlightMsg),
+		heldOut:       make(map[Offset]heldMsg),
+		dq:            dq,
+	}
+}
+
+// hasData returns true if there are records between the read and write
+// positions
+func (c *cursor) hasData() bool {
+	return c.readFileNum < c.dq.writeFileNum || c.readPos < c.dq.writePos
+}
+
+// readOne performs a low level filesystem read for a single []byte
+// while advancing read positions and rolling files, if necessary
+func (c *cursor) readOne() ([]byte, error) {
+	var err error
+	var msgSize int32
+	var flags byte
+	d := c.dq
+
+	if c.readFile == nil {
+		curFileName := d.fileName(c.readFileNum)
+		//打开当前读到的文件
+		c.readFile, err = os.OpenFile(curFileName, os.O_RDONLY, 0600)
+		if err != nil {
+			return nil, err
+		}
+
+		d.logf(INFO, "DISKQUEUE(%s): readOne() opened %s", c.logName(), curFileName)
+
+		//识别文件格式，新格式跳过文件头
+		c.readVersion, flags, err = readFileHeader(c.readFile)
+		if err != nil {
+			c.closeFile()
+			return nil, err
+		}
+		c.readCompression = fileCompression(flags)
+		c.readHeaders = flags&flagRecordHeader != 0
+
+		//移动到要读的位置
+		if pos := c.recordPos(); pos > 0 {
+			_, err = c.readFile.Seek(pos, 0)
+			if err != nil {
+				c.closeFile()
+				return nil, err
+			}
+		}
+
+		c.reader = bufio.NewReader(c.readFile)
+	}
+
+	//读取消息的长度(不包含这个uint32)
+	err = binary.Read(c.reader, binary.BigEndian, &msgSize)
+	if err == io.EOF && c.readFileNum < d.writeFileNum {
+		// the writer moved on to a new file before this one was full
+		//写入方提前换了文件，接着读下一个文件
+		c.closeFile()
+		c.readFileNum++
+		c.readPos = 0
+		c.nextReadFileNum = c.readFileNum
+		c.nextReadPos = 0
+		d.needSync = true
+		return c.readOne()
+	}
+	if err != nil {
+		c.closeFile()
+		return nil, err
+	}
+
+	//新格式的校验和
+	var checksum uint32
+	if c.readVersion >= formatV2 {
+		err = binary.Read(c.reader, binary.BigEndian, &checksum)
+		if err != nil {
+			c.closeFile()
+			return nil, err
+		}
+	}
+
+	//检测文件是损坏
+	minSize, maxSize := storedSizeBounds(c.readCompression, c.readHeaders, d.minMsgSize, d.maxMsgSize)
+	if msgSize < minSize || msgSize > maxSize {
+		// this file is corrupt and we have no reasonable guarantee on
+		// where a new message should begin
+		c.closeFile()
+		return nil, fmt.Errorf("invalid message read size (%d)", msgSize)
+	}
+	//读取消息内容
+	readBuf := make([]byte, msgSize)
+	_, err = io.ReadFull(c.reader, readBuf)
+	if err != nil {
+		c.closeFile()
+		return nil, err
+	}
+
+	if c.readVersion >= formatV2 {
+		var size [4]byte
+		binary.BigEndian.PutUint32(size[:], uint32(msgSize))
+		if recordChecksum(size[:], readBuf) != checksum {
+			c.closeFile()
+			return nil, fmt.Errorf("message checksum mismatch at %d", c.readPos)
+		}
+	}
+
+	//解压消息
+	readBuf, err = c.inflate.decompress(c.readCompression, readBuf, d.maxMsgSize+c.headerSize())
+	if err != nil {
+		c.closeFile()
+		return nil, err
+	}
+
+	//拆出记录头
+	c.header = recordHeader{}
+	if c.readHeaders {
+		c.header, readBuf, err = splitRecordHeader(readBuf)
+		if err != nil {
+			c.closeFile()
+			return nil, err
+		}
+	}
+
+	//消息和头的总长度
+	totalBytes := recordOverhead(c.readVersion) + int64(msgSize)
+
+	// we only advance next* because we have not yet sent this to consumers
+	// (where readFileNum, readPos will actually be advanced)
+	//更新下次的阅读位置
+	c.nextReadPos = c.recordPos() + totalBytes
+	c.nextReadFileNum = c.readFileNum
+
+	// TODO: each data file should embed the maxBytesPerFile
+	// as the first 8 bytes (at creation time) ensuring that
+	// the value can change without affecting runtime
+	//判断是否要读下个文件
+	if c.nextReadPos > d.maxBytesPerFile {
+		c.closeFile()
+		c.nextReadFileNum++
+		c.nextReadPos = 0
+	}
+
+	return readBuf, nil
+}
+
+// headerSize returns the size of the record header in the read file
+func (c *cursor) headerSize() int32 {
+	if c.readHeaders {
+		return recordHeaderSize
+	}
+	return 0
+}
+
+// recordPos returns the offset of the next record in the read file, which
+// for version 2 files is never inside the file header
+func (c *cursor) recordPos() int64 {
+	if c.readVersion >= formatV2 && c.readPos < fileHeaderSize {
+		return fileHeaderSize
+	}
+	return c.readPos
+}
+
+func (c *cursor) closeFile() {
+	if c.readFile != nil {
+		c.readFile.Close()
+		c.readFile = nil
+	}
+}
+
+// logName returns the name used for the cursor in log messages
+func (c *cursor) logName() string {
+	if c.name == "" {
+		return c.dq.name
+	}
+	return c.dq.name + ":" + c.name
+}
+
+// moveForward advances the read position past the message just delivered,
+// which is committed at once if acked, or else once passed to Ack
+func (c *cursor) moveForward(acked bool) {
+	offset := Offset{FileNum: c.readFileNum, Pos: c.recordPos()}
+	c.readFileNum = c.nextReadFileNum
+	c.readPos = c.nextReadPos
+	c.delivered(offset, acked)
+}
+
+// next reads and delivers the next record for a named consumer, skipping
+// anything unreadable. It returns nil if there is nothing left to read.
+func (c *cursor) next() *Message {
+	now := time.Now()
+	if m := c.due(now); m != nil {
+		c.popHeld(false)
+		return m
+	}
+	for c.hasData() {
+		data, err := c.readOne()
+		if err != nil {
+			c.dq.logf(ERROR, "DISKQUEUE(%s) reading at %d of %s - %s",
+				c.logName(), c.readPos, c.dq.fileName(c.readFileNum), err)
+			c.handleReadError()
+			continue
+		}
+		m := c.message(data)
+		if !c.schedule(m, now) {
+			continue
+		}
+		c.moveForward(false)
+		return m
+	}
+	return nil
+}
+
+//读取时的异常处理
+func (c *cursor) handleReadError() {
+	// version 2 records carry a checksum, so rather than give up on the rest
+	// of the file we can look for the next intact record
+	//新格式的文件尝试跳到下一条完好的消息
+	if c.readVersion >= formatV2 && c.resync() {
+		c.recount()
+		c.dq.needSync = true
+		return
+	}
+
+	if c.name == "" {
+		c.dq.skipBadFile()
+		c.recount()
+		return
+	}
+
+	// the queue's own reader takes care of renaming bad files, a named
+	// consumer just moves on to whatever comes after
+	//命名消费者不处理坏文件，直接跳过
+	c.closeFile()
+	if c.readFileNum < c.dq.writeFileNum {
+		c.readFileNum++
+		c.readPos = 0
+	} else {
+		c.readPos = c.dq.writePos
+	}
+	c.nextReadFileNum = c.readFileNum
+	c.nextReadPos = c.readPos
+	c.recount()
+	c.dq.needSync = true
+}
+
+// recount sets the depth from the records left to read, after skipping over
+// unreadable data whose records cannot be told apart
+//跳过损坏的数据后重新计算深度
+func (c *cursor) recount() {
+	d := c.dq
+	depth := int64(len(c.inFlight))
+	for fileNum := c.readFileNum; fileNum <= d.writeFileNum; fileNum++ {
+		var pos int64
+		if fileNum == c.readFileNum {
+			pos = c.readPos
+		}
+		depth += d.countRecords(fileNum, pos)
+	}
+	atomic.StoreInt64(&c.depth, depth)
+}
+
+// resync moves the read position past a corrupt record to the next intact
+// one in the current read file. It returns false if the rest of a finished
+// file holds nothing readable, leaving handleReadError to skip the file.
+func (c *cursor) resync() bool {
+	d := c.dq
+	c.closeFile()
+
+	fn := d.fileName(c.readFileNum)
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		d.logf(ERROR, "DISKQUEUE(%s) failed to read %s for resync - %s", c.logName(), fn, err)
+		return false
+	}
+
+	start := c.recordPos() + 1
+	var off int
+	found := false
+	if start < int64(len(data)) {
+		minSize, maxSize := storedSizeBounds(c.readCompression, c.readHeaders, d.minMsgSize, d.maxMsgSize)
+		off, found = findRecord(data[start:], minSize, maxSize)
+	}
+
+	var newPos int64
+	switch {
+	case found:
+		newPos = start + int64(off)
+	case c.readFileNum == d.writeFileNum && c.readPos < d.writePos:
+		// nothing intact left in the current write file, wait for new writes
+		newPos = d.writePos
+	default:
+		return false
+	}
+
+	d.logf(WARN, "DISKQUEUE(%s) skipped %d corrupt bytes at %d of %s",
+		c.logName(), newPos-c.readPos, c.readPos, fn)
+	c.readPos = newPos
+	c.nextReadPos = newPos
+	c.nextReadFileNum = c.readFileNum
+	return true
+}
+
+// delivered records a message handed to a consumer, starting at offset
+func (c *cursor) delivered(offset Offset, acked bool) {
+	m := &inFlightMsg{offset: offset, acked: acked}
+	c.inFlight = append(c.inFlight, m)
+	if !acked {
+		c.inFlightIndex[offset] = m
+	}
+	c.commit()
+}
+
+// ack marks the in-flight message at offset as acknowledged
+func (c *cursor) ack(offset Offset) error {
+	if _, ok := c.heldOut[offset]; ok {
+		delete(c.heldOut, offset)
+		c.releaseHeld()
+		return nil
+	}
+	m, ok := c.inFlightIndex[offset]
+	if !ok {
+		return ErrUnknownOffset
+	}
+	delete(c.inFlightIndex, offset)
+	m.acked = true
+	c.commit()
+	return nil
+}
+
+// commit advances the committed position over the acknowledged prefix of the
+// in-flight messages, removing data files no cursor needs any more
+//推进已确认的位置，删除所有游标都已确认完的文件
+func (c *cursor) commit() {
+	n := 0
+	for n < len(c.inFlight) && c.inFlight[n].acked {
+		c.inFlight[n] = nil
+		n++
+	}
+	c.inFlight = c.inFlight[n:]
+	depth := atomic.AddInt64(&c.depth, -int64(n))
+	if n > 0 {
+		c.dq.notifySpace()
+	}
+
+	oldAckFileNum := c.ackFileNum
+	if len(c.inFlight) == 0 {
+		// everything before the read position has been dealt with
+		c.ackFileNum = c.readFileNum
+		c.ackPos = c.readPos
+	} else {
+		c.ackFileNum = c.inFlight[0].offset.FileNum
+		c.ackPos = c.inFlight[0].offset.Pos
+	}
+
+	// see if we need to clean up old files
+	if c.ackFileNum != oldAckFileNum {
+		// sync every time we start reading from a new file
+		c.dq.needSync = true
+		c.dq.removeConsumedFiles()
+	}
+
+	if len(c.inFlight) == 0 {
+		c.checkTail(depth - int64(c.heldCount()))
+	}
+}
+
+// checkTail makes sure the depth, less the held messages, and positions
+// agree once the cursor has caught up with the writer
+func (c *cursor) checkTail(depth int64) {
+	if c.name == "" {
+		c.dq.checkTailCorruption(depth)
+		return
+	}
+	if c.hasData() {
+		return
+	}
+
+	d := c.dq
+	if depth != 0 {
+		d.logf(ERROR, "DISKQUEUE(%s) depth at tail (%d), resetting 0...", c.logName(), depth)
+		atomic.StoreInt64(&c.depth, int64(c.heldCount()))
+		d.needSync = true
+	}
+	if c.readFileNum != d.writeFileNum || c.readPos != d.writePos {
+		d.logf(ERROR,
+			"DISKQUEUE(%s) read position (%d,%d) beyond write position (%d,%d), corruption, resetting...",
+			c.logName(), c.readFileNum, c.readPos, d.writeFileNum, d.writePos)
+		c.reset(d.writeFileNum, d.writePos)
+		d.needSync = true
+	}
+}
+
+// reset moves the cursor to the given position, forgetting anything in
+// flight, e.g. once the queue is emptied
+func (c *cursor) reset(fileNum int64, pos int64) {
+	c.closeFile()
+	c.readFileNum = fileNum
+	c.readPos = pos
+	c.nextReadFileNum = fileNum
+	c.nextReadPos = pos
+	c.ackFileNum = fileNum
+	c.ackPos = pos
+	c.inFlight = nil
+	c.inFlightIndex = make(map[Offset]*inFlightMsg)
+	c.held = nil
+	c.heldOut = make(map[Offset]heldMsg)
+	atomic.StoreInt64(&c.depth, 0)
+}
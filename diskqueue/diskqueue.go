@@ -6,7 +6,6 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
-	"io"
 	"math/rand"
 	"os"
 	"path"
@@ -48,60 +47,107 @@ func (l LogLevel) String() string {
 //队列的接口定义
 type Interface interface {
 	Put([]byte) error
-	ReadChan() chan []byte // this is expected to be an *unbuffered* channel
+	PutBatch([][]byte) error
+	PutWithOptions([]byte, PutOptions) error
+	ReadChan() <-chan []byte // this is expected to be an *unbuffered* channel
+	ReadBatch(max int, wait time.Duration) ([][]byte, error)
+	Get() (*Message, error)
+	Ack(Offset) error
+	Consumer(name string) (Consumer, error)
+	RemoveConsumer(name string) error
 	Close() error
 	Delete() error
+	Sync() error
 	Depth() int64
+	DiskUsage() int64
+	Expired() int64
 	Empty() error
 }
 
 // diskQueue implements a filesystem backed FIFO queue
-// 文件队列FIFO
+//文件队列FIFO
 type diskQueue struct {
 	// 64bit atomic vars need to be first for proper alignment on 32bit platforms
+	diskBytes int64 //数据文件占用的字节数
+
+	// the queue's own reader, exposed via ReadChan() and Get()
+	cursor //队列自身的读游标
 
 	// run-time state (also persisted to disk)
-	readPos      int64 //当前文件读取的位置
 	writePos     int64 //当前文件写入的位置
-	readFileNum  int64 //正在读取的文件索引
 	writeFileNum int64 //正在写入的文件索引
-	depth        int64 //当前消息的数量(队列的大小)
+
+	oldestFileNum int64 //还没删除的最早的数据文件
 
 	sync.RWMutex
 
 	// instantiation time metadata
 	name            string
-	dataPath        string		  // 文件保存的路径
-	maxBytesPerFile int64         // currently this cannot change once created 单个文件最大存储
-	minMsgSize      int32         //消息最小值
-	maxMsgSize      int32         //消息最大值
-	syncEvery       int64         // number of writes per fsync  写入多少条数据后同步
-	syncTimeout     time.Duration // duration of time per fsync	 同步时间间隔
-	exitFlag        int32		  // 标记是否退出
-	needSync        bool //是否需要同步数据
-
-	// keeps track of the position where we have read
-	// (but not yet sent over readChan)
-	nextReadPos     int64 //下一次读的位置
-	nextReadFileNum int64 //下一次读的文件索引
-
-	readFile  *os.File //读文件的对象
-	writeFile *os.File //写文件的对象
-	reader    *bufio.Reader
-	writeBuf  bytes.Buffer
+	dataPath        string         // 文件保存的路径
+	maxBytesPerFile int64          // currently this cannot change once created 单个文件最大存储
+	minMsgSize      int32          //消息最小值
+	maxMsgSize      int32          //消息最大值
+	syncEvery       int64          // number of writes per fsync  写入多少条数据后同步
+	syncTimeout     time.Duration  // duration of time per fsync	 同步时间间隔
+	compression     Compression    // compression of new data files 新文件的压缩方式
+	readTimeout     time.Duration  // interval to retry reads while idle 空闲时重试读取的间隔
+	exitFlag        int32          // 标记是否退出
+	maxBytes        int64          // limit on diskBytes, 0 for none 磁盘占用上限
+	maxDepth        int64          // limit on depth, 0 for none 深度上限
+	overflow        OverflowPolicy // what to do when over a limit 超出限制时的策略
+	overflowTimeout time.Duration  // how long OverflowBlock waits 阻塞等待的时间
+	recordHeader    bool           // give new data files record headers 新文件是否带记录头
+	consumersOnly   bool           // only named consumers read 只有命名消费者读取
+	needSync        bool           //是否需要同步数据
+
+	writeFile        *os.File    //写文件的对象
+	writeVersion     int         //写文件的格式版本
+	writeCompression Compression //写文件的压缩方式
+	writeHeaders     bool        //写文件是否有记录头
+	deflate          compressor
+	writeBuf         bytes.Buffer
+	headerBuf        []byte
 
 	// exposed via ReadChan()
 	readChan chan []byte //读取消息的chan通过ReadChan()暴露
 
+	getChan chan *Message //Get()读取需要确认的消息
+
+	// named consumers, each with its own cursor
+	consumers map[string]*cursor //命名消费者
+
 	// internal channels
-	writeChan         chan []byte
-	writeResponseChan chan error
-	emptyChan         chan int
-	emptyResponseChan chan error
-	exitChan          chan int
-	exitSyncChan      chan int
+	writeChan             chan []byte
+	writeBatchChan        chan writeRequest
+	writeResponseChan     chan error
+	readBatchChan         chan int
+	readBatchResponseChan chan [][]byte
+	ackChan               chan ackRequest
+	ackResponseChan       chan error
+	consumerGetChan       chan getRequest
+
+	openConsumerChan           chan string
+	openConsumerResponseChan   chan *cursor
+	removeConsumerChan         chan string
+	removeConsumerResponseChan chan error
+	emptyChan                  chan int
+	emptyResponseChan          chan error
+	syncChan                   chan int
+	syncResponseChan           chan error
+	exitChan                   chan int
+	exitSyncChan               chan int
+
+	// closed when readers make room, see waitForRoom
+	spaceMu   sync.Mutex
+	spaceChan chan struct{}
+
+	logf AppLogFunc //日志函数
+}
 
-	logf AppLogFunc	//日志函数
+// writeRequest asks the ioLoop to write a batch of messages
+type writeRequest struct {
+	batch [][]byte
+	opts  PutOptions
 }
 
 // New instantiates an instance of diskQueue, retrieving metadata
@@ -110,48 +156,112 @@ type diskQueue struct {
 func New(name string, dataPath string, maxBytesPerFile int64,
 	minMsgSize int32, maxMsgSize int32,
 	syncEvery int64, syncTimeout time.Duration, logf AppLogFunc) Interface {
-	d := diskQueue{
-		name:              name,
-		dataPath:          dataPath,
-		maxBytesPerFile:   maxBytesPerFile,
-		minMsgSize:        minMsgSize,
-		maxMsgSize:        maxMsgSize,
-		readChan:          make(chan []byte),
-		writeChan:         make(chan []byte),
-		writeResponseChan: make(chan error),	//写的应答channel
+	return Open(name, dataPath,
+		WithMaxBytesPerFile(maxBytesPerFile),
+		WithMsgSize(minMsgSize, maxMsgSize),
+		WithSync(syncEvery, syncTimeout),
+		WithLogger(logf))
+}
+
+// Open instantiates an instance of diskQueue configured by opts, retrieving
+// metadata from the filesystem and starting the read ahead goroutine
+//按配置项创建diskQueue的实例
+func Open(name string, dataPath string, opts ...Option) Interface {
+	d := &diskQueue{
+		name:                  name,
+		dataPath:              dataPath,
+		maxBytesPerFile:       defaultMaxBytesPerFile,
+		minMsgSize:            defaultMinMsgSize,
+		maxMsgSize:            defaultMaxMsgSize,
+		readChan:              make(chan []byte),
+		getChan:               make(chan *Message),
+		consumers:             make(map[string]*cursor),
+		writeChan:             make(chan []byte),
+		writeBatchChan:        make(chan writeRequest),
+		readBatchChan:         make(chan int),
+		readBatchResponseChan: make(chan [][]byte),
+		writeResponseChan:     make(chan error), //写的应答channel
+		ackChan:               make(chan ackRequest),
+		ackResponseChan:       make(chan error),
+		consumerGetChan:       make(chan getRequest),
+
+		openConsumerChan:           make(chan string),
+		openConsumerResponseChan:   make(chan *cursor),
+		removeConsumerChan:         make(chan string),
+		removeConsumerResponseChan: make(chan error),
+
 		emptyChan:         make(chan int),
-		emptyResponseChan: make(chan error),	//清空的应答channel
+		emptyResponseChan: make(chan error), //清空的应答channel
+		syncChan:          make(chan int),
+		syncResponseChan:  make(chan error),
 		exitChan:          make(chan int),
 		exitSyncChan:      make(chan int),
-		syncEvery:         syncEvery,
-		syncTimeout:       syncTimeout,
-		logf:              logf,
+		syncEvery:         defaultSyncEvery,
+		syncTimeout:       defaultSyncTimeout,
+		logf:              discardLog,
+	}
+	for _, opt := range opts {
+		opt(d)
 	}
+	d.cursor = *newCursor(d, "")
 
 	// no need to lock here, nothing else could possibly be touching this instance
 	err := d.retrieveMetaData()
 	if err != nil && !os.IsNotExist(err) {
 		d.logf(ERROR, "DISKQUEUE(%s) failed to retrieveMetaData - %s", d.name, err)
 	}
+	if d.consumersOnly {
+		//队列自身的游标不读取，停在写位置上
+		d.cursor.reset(d.writeFileNum, d.writePos)
+	}
+	err = d.retrieveConsumers()
+	if err != nil {
+		d.logf(ERROR, "DISKQUEUE(%s) failed to retrieveConsumers - %s", d.name, err)
+	}
+	//最早的文件由最慢的游标决定
+	d.oldestFileNum = d.retainFileNum()
+	for _, c := range d.consumers {
+		if fileNum := c.retainFileNum(); fileNum < d.oldestFileNum {
+			d.oldestFileNum = fileNum
+		}
+	}
+	for i := d.oldestFileNum; i <= d.writeFileNum; i++ {
+		d.diskBytes += d.dataFileSize(i)
+	}
 
 	go d.ioLoop()
-	return &d
+	return d
 }
 
-// Depth returns the depth of the queue
+// Depth returns the depth of the queue, counting messages handed out by Get
+// until they are acknowledged. It stays zero if the queue was opened
+// WithConsumersOnly; see the Depth of each Consumer instead.
 //获取队列的深度
 func (d *diskQueue) Depth() int64 {
 	return atomic.LoadInt64(&d.depth)
 }
 
-// ReadChan returns the []byte channel for reading data
-func (d *diskQueue) ReadChan() chan []byte {
+// DiskUsage returns the number of bytes the queue's data files take up
+//获取数据文件占用的磁盘大小
+func (d *diskQueue) DiskUsage() int64 {
+	return atomic.LoadInt64(&d.diskBytes)
+}
+
+// ReadChan returns the receive-only []byte channel for reading data. Nothing
+// is sent on it if the queue was opened WithConsumersOnly.
+func (d *diskQueue) ReadChan() <-chan []byte {
 	return d.readChan
 }
 
 // Put writes a []byte to the queue
 //将一个[]byte数据推入队列
 func (d *diskQueue) Put(data []byte) error {
+	return d.waitForRoom(func() error {
+		return d.put(data)
+	})
+}
+
+func (d *diskQueue) put(data []byte) error {
 	d.RLock()
 	defer d.RUnlock()
 
@@ -165,6 +275,102 @@ func (d *diskQueue) Put(data []byte) error {
 	return <-d.writeResponseChan
 }
 
+// PutBatch writes a batch of []byte to the queue. If any message is outside
+// the size bounds nothing is written. A batch that fits in a data file is
+// written whole with a single buffered write, to a new file if it does not
+// fit in the current one, so it is written whole or not at all; a larger
+// one is split across files and may be partly written if a write fails.
+//批量推入数据
+func (d *diskQueue) PutBatch(batch [][]byte) error {
+	if len(batch) == 0 {
+		return nil
+	}
+	return d.waitForRoom(func() error {
+		return d.putBatch(batch)
+	})
+}
+
+func (d *diskQueue) putBatch(batch [][]byte) error {
+	d.RLock()
+	defer d.RUnlock()
+
+	if d.exitFlag == 1 {
+		return errors.New("exiting")
+	}
+
+	d.writeBatchChan <- writeRequest{batch: batch}
+	return <-d.writeResponseChan
+}
+
+// ReadBatch returns up to max messages that are ready to be read, waiting
+// at most wait for the first one. It returns an empty batch if nothing
+// arrives in time. Like ReadChan, messages are removed as they are read.
+//批量读取消息
+func (d *diskQueue) ReadBatch(max int, wait time.Duration) ([][]byte, error) {
+	if d.consumersOnly {
+		return nil, errConsumersOnly
+	}
+	if max <= 0 {
+		return nil, nil
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case d.readBatchChan <- max:
+		return <-d.readBatchResponseChan, nil
+	case <-timer.C:
+		return nil, nil
+	case <-d.exitChan:
+		return nil, errors.New("exiting")
+	}
+}
+
+// readBatch delivers up to max messages: the due held message held, if not
+// nil, and any others due, then dataRead if it was read ahead, and then
+// those that follow
+func (d *diskQueue) readBatch(dataRead []byte, held *Message, max int) [][]byte {
+	now := time.Now()
+	var batch [][]byte
+	if held == nil {
+		batch = append(batch, dataRead)
+		d.moveForward(true)
+	} else {
+		batch = append(batch, held.Body)
+		d.popHeld(true)
+		//先取其余到期的延迟消息
+		for len(batch) < max {
+			m := d.due(now)
+			if m == nil {
+				break
+			}
+			batch = append(batch, m.Body)
+			d.popHeld(true)
+		}
+		//已预读的消息
+		if len(batch) < max && d.nextReadPos != d.readPos {
+			batch = append(batch, dataRead)
+			d.moveForward(true)
+		}
+	}
+	for len(batch) < max && !d.consumersOnly && d.hasData() {
+		data, err := d.readOne()
+		if err != nil {
+			d.logf(ERROR, "DISKQUEUE(%s) reading at %d of %s - %s",
+				d.name, d.readPos, d.fileName(d.readFileNum), err)
+			d.handleReadError()
+			break
+		}
+		if !d.schedule(d.message(data), now) {
+			continue
+		}
+		batch = append(batch, data)
+		d.moveForward(true)
+	}
+	return batch
+}
+
 // Close cleans up the queue and persists metadata
 //关闭队列并持久化元数据
 func (d *diskQueue) Close() error {
@@ -199,9 +405,9 @@ func (d *diskQueue) exit(deleted bool) error {
 	//阻塞直到收到exitSyncChan的消息
 	<-d.exitSyncChan
 
-	if d.readFile != nil {
-		d.readFile.Close()
-		d.readFile = nil
+	d.closeFile()
+	for _, c := range d.consumers {
+		c.closeFile()
 	}
 
 	if d.writeFile != nil {
@@ -212,6 +418,21 @@ func (d *diskQueue) exit(deleted bool) error {
 	return nil
 }
 
+// Sync fsyncs everything written so far together with the metadata,
+// rather than waiting for the sync policy to do so
+//立即同步数据和元数据到磁盘
+func (d *diskQueue) Sync() error {
+	d.RLock()
+	defer d.RUnlock()
+
+	if d.exitFlag == 1 {
+		return errors.New("exiting")
+	}
+
+	d.syncChan <- 1
+	return <-d.syncResponseChan
+}
+
 // Empty destructively clears out any pending data in the queue
 // by fast forwarding read positions and removing intermediate files
 //清空队列
@@ -247,20 +468,14 @@ func (d *diskQueue) deleteAllFiles() error {
 func (d *diskQueue) skipToNextRWFile() error {
 	var err error
 
-	if d.readFile != nil {
-		d.readFile.Close()
-		d.readFile = nil
-	}
-
 	if d.writeFile != nil {
 		d.writeFile.Close()
 		d.writeFile = nil
 	}
-	//删除没有读取过内容的文件
-	for i := d.readFileNum; i <= d.writeFileNum; i++ {
-		fn := d.fileName(i)
-		innerErr := os.Remove(fn)
-		if innerErr != nil && !os.IsNotExist(innerErr) {
+	//删除所有还没删除的文件
+	for i := d.oldestFileNum; i <= d.writeFileNum; i++ {
+		innerErr := d.removeDataFile(i)
+		if innerErr != nil {
 			d.logf(ERROR, "DISKQUEUE(%s) failed to remove data file - %s", d.name, innerErr)
 			err = innerErr
 		}
@@ -269,171 +484,239 @@ func (d *diskQueue) skipToNextRWFile() error {
 	//设置状态
 	d.writeFileNum++
 	d.writePos = 0
-	d.readFileNum = d.writeFileNum
-	d.readPos = 0
-	d.nextReadFileNum = d.writeFileNum
-	d.nextReadPos = 0
-	atomic.StoreInt64(&d.depth, 0)
+	d.oldestFileNum = d.writeFileNum
+	d.reset(d.writeFileNum, 0)
+	for _, c := range d.consumers {
+		c.reset(d.writeFileNum, 0)
+	}
 
 	return err
 }
 
-// readOne performs a low level filesystem read for a single []byte
-// while advancing read positions and rolling files, if necessary
-func (d *diskQueue) readOne() ([]byte, error) {
+// writeOne performs a low level filesystem write for a single []byte
+// while advancing write positions and rolling files, if necessary
+func (d *diskQueue) writeOne(data []byte) error {
+	return d.writeBatch([][]byte{data}, PutOptions{})
+}
+
+// writeBatch performs a low level filesystem write for a batch of []byte,
+// writing all the records that go to the same file at once, while advancing
+// write positions and rolling files, if necessary
+//批量写入，同一个文件里的消息只写一次
+func (d *diskQueue) writeBatch(batch [][]byte, opts PutOptions) error {
 	var err error
-	var msgSize int32
 
-	if d.readFile == nil {
-		curFileName := d.fileName(d.readFileNum)
-		//打开当前读到的文件
-		d.readFile, err = os.OpenFile(curFileName, os.O_RDONLY, 0600)
+	for _, data := range batch {
+		dataLen := int32(len(data))
+		//判断消息长度的合法性
+		if dataLen < d.minMsgSize || dataLen > d.maxMsgSize {
+			return fmt.Errorf("invalid message write size (%d) maxMsgSize=%d", dataLen, d.maxMsgSize)
+		}
+	}
+
+	//检查磁盘和深度限制
+	if d.maxBytes > 0 || d.maxDepth > 0 {
+		var size int64
+		if d.writePos == 0 {
+			size = fileHeaderSize
+		}
+		for _, data := range batch {
+			size += recordOverhead(formatV2) + int64(len(data))
+			if d.recordHeader {
+				size += recordHeaderSize
+			}
+		}
+		err = d.makeRoom(int64(len(batch)), size)
 		if err != nil {
-			return nil, err
+			return err
 		}
+	}
 
-		d.logf(INFO, "DISKQUEUE(%s): readOne() opened %s", d.name, curFileName)
-		//移动到要读的位置
-		if d.readPos > 0 {
-			_, err = d.readFile.Seek(d.readPos, 0)
+	//带过期或延迟的消息不能写进没有记录头的文件
+	if opts.scheduled() {
+		if d.writeFile == nil {
+			err = d.openWriteFile()
 			if err != nil {
-				d.readFile.Close()
-				d.readFile = nil
-				return nil, err
+				return err
 			}
 		}
-
-		d.reader = bufio.NewReader(d.readFile)
+		if !d.writeHeaders && d.writePos > 0 {
+			d.rollWriteFile()
+		}
 	}
 
-	//读取消息的长度(不包含这个uint32)
-	err = binary.Read(d.reader, binary.BigEndian, &msgSize)
-	if err != nil {
-		d.readFile.Close()
-		d.readFile = nil
-		return nil, err
-	}
-
-	//检测文件是损坏
-	if msgSize < d.minMsgSize || msgSize > d.maxMsgSize {
-		// this file is corrupt and we have no reasonable guarantee on
-		// where a new message should begin
-		d.readFile.Close()
-		d.readFile = nil
-		return nil, fmt.Errorf("invalid message read size (%d)", msgSize)
-	}
-	//读取消息内容
-	readBuf := make([]byte, msgSize)
-	_, err = io.ReadFull(d.reader, readBuf)
-	if err != nil {
-		d.readFile.Close()
-		d.readFile = nil
-		return nil, err
+	//整批放得进一个新文件时，当前文件放不下就先换文件，让整批一次写入
+	if len(batch) > 1 && d.writePos > 0 {
+		if d.writeFile == nil {
+			err = d.openWriteFile()
+			if err != nil {
+				return err
+			}
+		}
+		size := d.batchBytes(batch)
+		if d.writePos+size > d.maxBytesPerFile && fileHeaderSize+size <= d.maxBytesPerFile {
+			d.rollWriteFile()
+		}
 	}
 
-	//消息和头的总长度
-	totalBytes := int64(4 + msgSize)
-
-	// we only advance next* because we have not yet sent this to consumers
-	// (where readFileNum, readPos will actually be advanced)
-	//更新下次的阅读位置
-	d.nextReadPos = d.readPos + totalBytes
-	d.nextReadFileNum = d.readFileNum
+	header := newRecordHeader(time.Now(), opts)
+	d.writeBuf.Reset()
+	buffered := 0
+	for _, data := range batch {
+		if d.writeFile == nil {
+			err = d.openWriteFile()
+			if err != nil {
+				return err
+			}
+		}
 
-	// TODO: each data file should embed the maxBytesPerFile
-	// as the first 8 bytes (at creation time) ensuring that
-	// the value can change without affecting runtime
-	//判断是否要读下个文件
-	if d.nextReadPos > d.maxBytesPerFile {
-		if d.readFile != nil {
-			d.readFile.Close()
-			d.readFile = nil
+		//新文件先写文件头，和第一条消息一起落盘
+		if d.writePos == 0 && d.writeBuf.Len() == 0 && d.writeVersion >= formatV2 {
+			flags := byte(d.writeCompression)
+			if d.writeHeaders {
+				flags |= flagRecordHeader
+			}
+			d.writeBuf.Write(fileHeader(flags))
 		}
+		if d.writeVersion >= formatV2 {
+			if d.writeHeaders {
+				d.headerBuf = append(header.appendTo(d.headerBuf[:0]), data...)
+				data = d.headerBuf
+			}
+			//按文件的压缩方式压缩消息
+			payload, err := d.deflate.compress(d.writeCompression, data)
+			if err != nil {
+				return err
+			}
+			appendRecord(&d.writeBuf, payload)
+		} else {
+			//写入消息长度
+			err = binary.Write(&d.writeBuf, binary.BigEndian, int32(len(data)))
+			if err != nil {
+				return err
+			}
+			//写入消息内容
+			_, err = d.writeBuf.Write(data)
+			if err != nil {
+				return err
+			}
+		}
+		buffered++
 
-		d.nextReadFileNum++
-		d.nextReadPos = 0
+		//写入文件大于最大字节后创建新文件
+		if d.writePos+int64(d.writeBuf.Len()) > d.maxBytesPerFile {
+			err = d.flushWrites(buffered)
+			if err != nil {
+				return err
+			}
+			buffered = 0
+			d.rollWriteFile()
+		}
 	}
 
-	return readBuf, nil
+	if buffered > 0 {
+		return d.flushWrites(buffered)
+	}
+	return nil
 }
 
-// writeOne performs a low level filesystem write for a single []byte
-// while advancing write positions and rolling files, if necessary
-func (d *diskQueue) writeOne(data []byte) error {
-	var err error
-
-	if d.writeFile == nil {
-		curFileName := d.fileName(d.writeFileNum)
-		//创建新的存储文件
-		d.writeFile, err = os.OpenFile(curFileName, os.O_RDWR|os.O_CREATE, 0600)
-		if err != nil {
-			return err
+// batchBytes returns at most how many bytes the records of batch take,
+// in the current write file or in a new one
+func (d *diskQueue) batchBytes(batch [][]byte) int64 {
+	var size int64
+	for _, data := range batch {
+		size += recordOverhead(formatV2) + int64(len(data))
+		if d.recordHeader || d.writeHeaders {
+			size += recordHeaderSize
+		}
+		//压缩过的消息多一个字节的标记
+		if d.compression != NoCompression || d.writeCompression != NoCompression {
+			size++
 		}
+	}
+	return size
+}
 
-		d.logf(INFO, "DISKQUEUE(%s): writeOne() opened %s", d.name, curFileName)
+// rollWriteFile moves the writer on to a new data file
+func (d *diskQueue) rollWriteFile() {
+	d.writeFileNum++
+	d.writePos = 0
 
-		if d.writePos > 0 {
-			//根据文件原点偏移
-			_, err = d.writeFile.Seek(d.writePos, 0)
-			if err != nil {
-				d.writeFile.Close()
-				d.writeFile = nil
-				return err
-			}
-		}
+	// sync every time we start writing to a new file
+	//创建之前先同步当前的数据
+	err := d.sync()
+	if err != nil {
+		d.logf(ERROR, "DISKQUEUE(%s) failed to sync - %s", d.name, err)
 	}
 
-	dataLen := int32(len(data))
-	//判断消息长度的合法性
-	if dataLen < d.minMsgSize || dataLen > d.maxMsgSize {
-		return fmt.Errorf("invalid message write size (%d) maxMsgSize=%d", dataLen, d.maxMsgSize)
+	if d.writeFile != nil {
+		d.writeFile.Close()
+		d.writeFile = nil
 	}
+}
 
-	d.writeBuf.Reset()
-	//写入消息长度
-	err = binary.Write(&d.writeBuf, binary.BigEndian, dataLen)
+// openWriteFile opens the current write file, creating it if necessary
+func (d *diskQueue) openWriteFile() error {
+	var err error
+
+	curFileName := d.fileName(d.writeFileNum)
+	//创建新的存储文件
+	d.writeFile, err = os.OpenFile(curFileName, os.O_RDWR|os.O_CREATE, 0600)
 	if err != nil {
 		return err
 	}
-	//写入消息内容
-	_, err = d.writeBuf.Write(data)
-	if err != nil {
-		return err
+
+	d.logf(INFO, "DISKQUEUE(%s): writeOne() opened %s", d.name, curFileName)
+
+	if d.writePos > 0 {
+		//续写已有文件时沿用它的格式
+		var flags byte
+		d.writeVersion, flags, err = readFileHeader(d.writeFile)
+		if err != nil {
+			d.writeFile.Close()
+			d.writeFile = nil
+			return err
+		}
+		d.writeCompression = fileCompression(flags)
+		d.writeHeaders = flags&flagRecordHeader != 0
+		//根据文件原点偏移
+		_, err = d.writeFile.Seek(d.writePos, 0)
+		if err != nil {
+			d.writeFile.Close()
+			d.writeFile = nil
+			return err
+		}
+	} else {
+		d.writeVersion = formatV2
+		d.writeCompression = d.compression
+		d.writeHeaders = d.recordHeader
 	}
+	return nil
+}
 
+// flushWrites writes the buffered records, n messages, to the write file
+func (d *diskQueue) flushWrites(n int) error {
 	// only write to the file once
 	//只写入一次
-	_, err = d.writeFile.Write(d.writeBuf.Bytes())
+	_, err := d.writeFile.Write(d.writeBuf.Bytes())
 	if err != nil {
 		d.writeFile.Close()
 		d.writeFile = nil
 		return err
 	}
 
-	totalBytes := int64(4 + dataLen)
+	totalBytes := int64(d.writeBuf.Len())
 	d.writePos += totalBytes
+	atomic.AddInt64(&d.diskBytes, totalBytes)
+	d.writeBuf.Reset()
 	//增加写入条数
-	atomic.AddInt64(&d.depth, 1)
-
-	//写入文件大于最大字节后创建新文件
-	if d.writePos > d.maxBytesPerFile {
-		d.writeFileNum++
-		d.writePos = 0
-
-		// sync every time we start writing to a new file
-		//创建之前先同步当前的数据
-		err = d.sync()
-		if err != nil {
-			d.logf(ERROR, "DISKQUEUE(%s) failed to sync - %s", d.name, err)
-		}
-
-		if d.writeFile != nil {
-			d.writeFile.Close()
-			d.writeFile = nil
-		}
+	if !d.consumersOnly {
+		atomic.AddInt64(&d.depth, int64(n))
 	}
-
-	return err
+	for _, c := range d.consumers {
+		atomic.AddInt64(&c.depth, int64(n))
+	}
+	return nil
 }
 
 // sync fsyncs the current writeFile and persists metadata
@@ -452,6 +735,10 @@ func (d *diskQueue) sync() error {
 	if err != nil {
 		return err
 	}
+	err = d.persistConsumers()
+	if err != nil {
+		return err
+	}
 
 	d.needSync = false
 	return nil
@@ -469,9 +756,10 @@ func (d *diskQueue) retrieveMetaData() error {
 		return err
 	}
 	defer f.Close()
+	r := bufio.NewReader(f)
 
 	var depth int64
-	_, err = fmt.Fscanf(f, "%d\n%d,%d\n%d,%d\n",
+	_, err = fmt.Fscanf(r, "%d\n%d,%d\n%d,%d\n",
 		&depth,
 		&d.readFileNum, &d.readPos,
 		&d.writeFileNum, &d.writePos)
@@ -481,6 +769,10 @@ func (d *diskQueue) retrieveMetaData() error {
 	atomic.StoreInt64(&d.depth, depth)
 	d.nextReadFileNum = d.readFileNum
 	d.nextReadPos = d.readPos
+	d.ackFileNum = d.readFileNum
+	d.ackPos = d.readPos
+	//延迟消息的位置
+	d.held = scanHeld(r)
 
 	return nil
 }
@@ -488,11 +780,21 @@ func (d *diskQueue) retrieveMetaData() error {
 // persistMetaData atomically writes state to the filesystem
 //持久化状态的元数据
 func (d *diskQueue) persistMetaData() error {
+	//数据写入，读位置只记录已确认的位置，未确认的消息重启后重新投递
+	return writeFileAtomic(d.metaDataFileName(), fmt.Sprintf("%d\n%d,%d\n%d,%d\n",
+		atomic.LoadInt64(&d.depth),
+		d.ackFileNum, d.ackPos,
+		d.writeFileNum, d.writePos)+d.heldLines())
+}
+
+// writeFileAtomic replaces the contents of a file via a synced temporary
+// file and a rename
+//通过临时文件原子地写入文件
+func writeFileAtomic(fileName string, content string) error {
 	var f *os.File
 	var err error
 
 	//获取零时文件名
-	fileName := d.metaDataFileName()
 	tmpFileName := fmt.Sprintf("%s.%d.tmp", fileName, rand.Int())
 
 	// write to tmp file
@@ -503,10 +805,7 @@ func (d *diskQueue) persistMetaData() error {
 	}
 
 	//数据写入
-	_, err = fmt.Fprintf(f, "%d\n%d,%d\n%d,%d\n",
-		atomic.LoadInt64(&d.depth),
-		d.readFileNum, d.readPos,
-		d.writeFileNum, d.writePos)
+	_, err = f.WriteString(content)
 	if err != nil {
 		f.Close()
 		return err
@@ -551,8 +850,8 @@ func (d *diskQueue) checkTailCorruption(depth int64) {
 				d.name, depth)
 		}
 		// force set depth 0
-		//深度设置为0
-		atomic.StoreInt64(&d.depth, 0)
+		//深度设置为0，延迟消息除外
+		atomic.StoreInt64(&d.depth, int64(d.heldCount()))
 		d.needSync = true
 	}
 
@@ -576,30 +875,9 @@ func (d *diskQueue) checkTailCorruption(depth int64) {
 	}
 }
 
-func (d *diskQueue) moveForward() {
-	oldReadFileNum := d.readFileNum
-	d.readFileNum = d.nextReadFileNum
-	d.readPos = d.nextReadPos
-	depth := atomic.AddInt64(&d.depth, -1)
-
-	// see if we need to clean up the old file
-	//如果读的文件变了，删除已经读的文件
-	if oldReadFileNum != d.nextReadFileNum {
-		// sync every time we start reading from a new file
-		d.needSync = true
-
-		fn := d.fileName(oldReadFileNum)
-		err := os.Remove(fn)
-		if err != nil {
-			d.logf(ERROR, "DISKQUEUE(%s) failed to Remove(%s) - %s", d.name, fn, err)
-		}
-	}
-
-	d.checkTailCorruption(depth)
-}
-
-//读取时的异常处理
-func (d *diskQueue) handleReadError() {
+// skipBadFile moves the queue's own reader past a file it cannot read
+//跳过读取失败的文件
+func (d *diskQueue) skipBadFile() {
 	// jump to the next read file and rename the current (bad) file
 	//跳转到下一个阅读文件,将当前读的文件以.bad命名
 	if d.readFileNum == d.writeFileNum {
@@ -617,6 +895,7 @@ func (d *diskQueue) handleReadError() {
 	//获取坏掉的文件名
 	badFn := d.fileName(d.readFileNum)
 	badRenameFn := badFn + ".bad"
+	badSize := d.dataFileSize(d.readFileNum)
 
 	d.logf(WARN,
 		"DISKQUEUE(%s) jump to next file and saving bad file as %s",
@@ -628,6 +907,8 @@ func (d *diskQueue) handleReadError() {
 		d.logf(ERROR,
 			"DISKQUEUE(%s) failed to rename bad diskqueue file %s to %s",
 			d.name, badFn, badRenameFn)
+	} else {
+		atomic.AddInt64(&d.diskBytes, -badSize)
 	}
 
 	//初始化下一文件的状态
@@ -651,15 +932,30 @@ func (d *diskQueue) handleReadError() {
 // conveniently this also means that we're asynchronously reading from the filesystem
 func (d *diskQueue) ioLoop() {
 	var dataRead []byte
+	var msgRead *Message
+	var out []byte
+	var outMsg *Message
+	var held bool
 	var err error
 	var count int64
 	var r chan []byte
+	var g chan *Message
+	var rb chan int
 
 	syncTicker := time.NewTicker(d.syncTimeout)
+	dueTimer := time.NewTimer(time.Hour)
+	dueTimer.Stop()
+	defer dueTimer.Stop()
+	var readTick <-chan time.Time
+	if d.readTimeout > 0 {
+		readTicker := time.NewTicker(d.readTimeout)
+		defer readTicker.Stop()
+		readTick = readTicker.C
+	}
 
 	for {
 		// dont sync all the time :)
-		if count == d.syncEvery {
+		if count >= d.syncEvery {
 			d.needSync = true
 		}
 
@@ -671,8 +967,16 @@ func (d *diskQueue) ioLoop() {
 			count = 0
 		}
 
-		//读写位置合法判断
-		if (d.readFileNum < d.writeFileNum) || (d.readPos < d.writePos) {
+		//到期的延迟消息优先投递
+		outMsg = d.due(time.Now())
+		held = outMsg != nil
+		if held {
+			out = outMsg.Body
+			r = d.readChan
+			g = d.getChan
+			rb = d.readBatchChan
+		} else if !d.consumersOnly && d.hasData() {
+			//读写位置合法判断
 			if d.nextReadPos == d.readPos {
 				dataRead, err = d.readOne()
 				//读取出现异常
@@ -683,29 +987,94 @@ func (d *diskQueue) ioLoop() {
 					d.handleReadError()
 					continue
 				}
+				msgRead = d.message(dataRead)
+				//过期的跳过，没到时间的先放着
+				if !d.schedule(msgRead, time.Now()) {
+					continue
+				}
 			}
+			out, outMsg = dataRead, msgRead
 			r = d.readChan
+			g = d.getChan
+			rb = d.readBatchChan
 		} else {
 			r = nil
+			g = nil
+			rb = nil
+		}
+
+		//下一条延迟消息到期时唤醒
+		var due <-chan time.Time
+		if wait, ok := d.dueWait(held); ok {
+			if !dueTimer.Stop() {
+				select {
+				case <-dueTimer.C:
+				default:
+				}
+			}
+			dueTimer.Reset(wait)
+			due = dueTimer.C
 		}
 
 		select {
 		// the Go channel spec dictates that nil channel operations (read or write)
 		// in a select are skipped, we set r to d.readChan only when there is data to read
 		//读取消息
-		case r <- dataRead:
+		case r <- out:
 			count++
+			if held {
+				d.popHeld(true)
+				continue
+			}
 			// moveForward sets needSync flag if a file is removed
 			//删除已读文件，检测读取状态
-			d.moveForward()
+			d.moveForward(true)
+		case max := <-rb:
+			var heldMsg *Message
+			if held {
+				heldMsg = outMsg
+			}
+			batch := d.readBatch(dataRead, heldMsg, max)
+			count += int64(len(batch))
+			d.readBatchResponseChan <- batch
+		case g <- outMsg:
+			count++
+			if held {
+				d.popHeld(false)
+				continue
+			}
+			//等待确认后再推进已确认的位置
+			d.moveForward(false)
+		case req := <-d.ackChan:
+			d.ackResponseChan <- d.ackConsumer(req)
+		case req := <-d.consumerGetChan:
+			d.getConsumer(req)
+		case name := <-d.openConsumerChan:
+			d.openConsumerResponseChan <- d.openConsumer(name)
+		case name := <-d.removeConsumerChan:
+			d.removeConsumerResponseChan <- d.removeConsumer(name)
 			//清空的消息
 		case <-d.emptyChan:
 			d.emptyResponseChan <- d.deleteAllFiles()
 			count = 0
+		case <-d.syncChan:
+			err = d.sync()
+			if err != nil {
+				d.logf(ERROR, "DISKQUEUE(%s) failed to sync - %s", d.name, err)
+			} else {
+				count = 0
+			}
+			d.syncResponseChan <- err
 			//写入消息
 		case dataWrite := <-d.writeChan:
 			count++
 			d.writeResponseChan <- d.writeOne(dataWrite)
+			//唤醒等待中的命名消费者
+			d.serveConsumers()
+		case req := <-d.writeBatchChan:
+			count += int64(len(req.batch))
+			d.writeResponseChan <- d.writeBatch(req.batch, req.opts)
+			d.serveConsumers()
 		case <-syncTicker.C:
 			if count == 0 {
 				// avoid sync when there's no activity
@@ -713,6 +1082,12 @@ func (d *diskQueue) ioLoop() {
 				continue
 			}
 			d.needSync = true
+		case <-readTick:
+			//定期重试等待中的命名消费者
+			d.serveConsumers()
+		case <-due:
+			//延迟消息到期
+			d.serveConsumers()
 			//收到退出消息
 		case <-d.exitChan:
 			goto exit
@@ -724,4 +1099,4 @@ exit:
 	//停止定时器
 	syncTicker.Stop()
 	d.exitSyncChan <- 1
-}
\ No newline at end of file
+}
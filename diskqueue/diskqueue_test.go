@@ -3,6 +3,7 @@ package diskqueue
 import (
 	"bufio"
 	"bytes"
+	"encoding/binary"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -100,6 +101,38 @@ func TestDiskQueue(t *testing.T) {
 	Equal(t, msg, msgOut)
 }
 
+func TestDiskQueueOpenOptions(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_options" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := Open(dqName, tmpDir,
+		WithMaxBytesPerFile(40),
+		WithMsgSize(1, 16),
+		WithSync(1, time.Second),
+		WithReadTimeout(10*time.Millisecond),
+		WithLogger(l))
+	NotNil(t, dq)
+
+	NotNil(t, dq.Put(make([]byte, 17)))
+	for i := 0; i < 5; i++ {
+		Nil(t, dq.Put([]byte("msg "+strconv.Itoa(i))))
+	}
+	Equal(t, int64(1), dq.(*diskQueue).writeFileNum)
+	dq.Close()
+
+	// reopened with the defaults, the queue carries on where it left off
+	dq = Open(dqName, tmpDir, WithLogger(l))
+	defer dq.Close()
+	Equal(t, int64(5), dq.Depth())
+	for i := 0; i < 5; i++ {
+		Equal(t, []byte("msg "+strconv.Itoa(i)), <-dq.ReadChan())
+	}
+}
+
 func TestDiskQueueRoll(t *testing.T) {
 	l := NewTestLogger(t)
 	dqName := "test_disk_queue_roll" + strconv.Itoa(int(time.Now().Unix()))
@@ -110,7 +143,7 @@ func TestDiskQueueRoll(t *testing.T) {
 	defer os.RemoveAll(tmpDir)
 	msg := bytes.Repeat([]byte{0}, 10)
 	ml := int64(len(msg))
-	dq := New(dqName, tmpDir, 9*(ml+4), int32(ml), 1<<10, 2500, 2*time.Second, l)
+	dq := New(dqName, tmpDir, fileHeaderSize+9*(ml+8), int32(ml), 1<<10, 2500, 2*time.Second, l)
 	defer dq.Close()
 	NotNil(t, dq)
 	Equal(t, int64(0), dq.Depth())
@@ -244,6 +277,124 @@ func TestDiskQueueCorruption(t *testing.T) {
 	Equal(t, msg, <-dq.ReadChan())
 }
 
+func TestDiskQueueChecksumResync(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_checksum" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := New(dqName, tmpDir, 1<<20, 1, 1<<10, 2500, 2*time.Second, l)
+	defer dq.Close()
+
+	for i := 0; i < 5; i++ {
+		dq.Put([]byte("message " + strconv.Itoa(i)))
+	}
+
+	// flip a bit in the payload of the 2nd record
+	// each record is 8 bytes of framing plus a 9 byte payload
+	f, err := os.OpenFile(dq.(*diskQueue).fileName(0), os.O_RDWR, 0600)
+	Nil(t, err)
+	b := make([]byte, 1)
+	f.ReadAt(b, fileHeaderSize+17+8+3)
+	b[0] ^= 0x01
+	f.WriteAt(b, fileHeaderSize+17+8+3)
+	f.Close()
+
+	// the corrupt record is skipped, not the rest of the file, and no
+	// longer counts towards the depth
+	Equal(t, []byte("message 0"), <-dq.ReadChan())
+	Equal(t, []byte("message 2"), <-dq.ReadChan())
+	Nil(t, dq.Sync())
+	Equal(t, int64(2), dq.Depth())
+	for i := 3; i < 5; i++ {
+		Equal(t, []byte("message "+strconv.Itoa(i)), <-dq.ReadChan())
+	}
+	_, err = os.Stat(dq.(*diskQueue).fileName(0) + ".bad")
+	Equal(t, true, os.IsNotExist(err))
+}
+
+func TestDiskQueueReadsVersion1Files(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_v1" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// a queue left behind by the unversioned format: two records in file 0
+	var buf bytes.Buffer
+	for _, m := range []string{"old one", "old two"} {
+		binary.Write(&buf, binary.BigEndian, int32(len(m)))
+		buf.WriteString(m)
+	}
+	dataFn := path.Join(tmpDir, dqName+".diskqueue.000000.dat")
+	Nil(t, ioutil.WriteFile(dataFn, buf.Bytes(), 0600))
+	metaFn := path.Join(tmpDir, dqName+".diskqueue.meta.dat")
+	meta := fmt.Sprintf("%d\n%d,%d\n%d,%d\n", 2, 0, 0, 0, buf.Len())
+	Nil(t, ioutil.WriteFile(metaFn, []byte(meta), 0600))
+
+	dq := New(dqName, tmpDir, 1<<20, 1, 1<<10, 2500, 2*time.Second, l)
+	defer dq.Close()
+	Equal(t, int64(2), dq.Depth())
+
+	// appends to a version 1 file keep its format
+	Nil(t, dq.Put([]byte("new three")))
+
+	Equal(t, []byte("old one"), <-dq.ReadChan())
+	Equal(t, []byte("old two"), <-dq.ReadChan())
+	Equal(t, []byte("new three"), <-dq.ReadChan())
+	Equal(t, formatV1, dq.(*diskQueue).writeVersion)
+}
+
+func TestDiskQueueAckReplay(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_ack" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	// small files so that acknowledged messages span a file boundary
+	dq := New(dqName, tmpDir, 40, 1, 1<<10, 2500, 2*time.Second, l)
+
+	for i := 0; i < 6; i++ {
+		Nil(t, dq.Put([]byte("msg "+strconv.Itoa(i))))
+	}
+
+	var msgs []*Message
+	for i := 0; i < 4; i++ {
+		m, err := dq.Get()
+		Nil(t, err)
+		Equal(t, []byte("msg "+strconv.Itoa(i)), m.Body)
+		msgs = append(msgs, m)
+	}
+	Equal(t, int64(6), dq.Depth())
+
+	// acknowledging out of order only commits the acknowledged prefix
+	Nil(t, dq.Ack(msgs[0].Offset))
+	Nil(t, dq.Ack(msgs[2].Offset))
+	Equal(t, int64(5), dq.Depth())
+	Equal(t, ErrUnknownOffset, dq.Ack(msgs[0].Offset))
+
+	dq.Close()
+
+	// msg 1 was never acknowledged, so it and everything after is replayed
+	dq = New(dqName, tmpDir, 40, 1, 1<<10, 2500, 2*time.Second, l)
+	defer dq.Close()
+	Equal(t, int64(5), dq.Depth())
+	for i := 1; i < 6; i++ {
+		m, err := dq.Get()
+		Nil(t, err)
+		Equal(t, []byte("msg "+strconv.Itoa(i)), m.Body)
+		Nil(t, dq.Ack(m.Offset))
+	}
+	Equal(t, int64(0), dq.Depth())
+	assertFileNotExist(t, dq.(*diskQueue).fileName(0))
+}
+
 type md struct {
 	depth        int64
 	readFileNum  int64
@@ -252,6 +403,503 @@ type md struct {
 	writePos     int64
 }
 
+func TestDiskQueueConsumers(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_consumers" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := New(dqName, tmpDir, 40, 1, 1<<10, 2500, 2*time.Second, l)
+
+	a, err := dq.Consumer("a")
+	Nil(t, err)
+	b, err := dq.Consumer("b")
+	Nil(t, err)
+	_, err = dq.Consumer("../c")
+	NotNil(t, err)
+
+	// a Get issued before any data arrives is answered by the next write
+	got := make(chan *Message)
+	go func() {
+		m, _ := a.Get()
+		got <- m
+	}()
+	for i := 0; i < 6; i++ {
+		Nil(t, dq.Put([]byte("msg "+strconv.Itoa(i))))
+	}
+	m := <-got
+	Equal(t, []byte("msg 0"), m.Body)
+	Nil(t, a.Ack(m.Offset))
+
+	// the queue's own reader and consumer a both see every message
+	for i := 0; i < 6; i++ {
+		Equal(t, []byte("msg "+strconv.Itoa(i)), <-dq.ReadChan())
+	}
+	for i := 1; i < 6; i++ {
+		m, err := a.Get()
+		Nil(t, err)
+		Equal(t, []byte("msg "+strconv.Itoa(i)), m.Body)
+		Nil(t, a.Ack(m.Offset))
+	}
+	Equal(t, int64(0), dq.Depth())
+	Equal(t, int64(0), a.Depth())
+	Equal(t, int64(6), b.Depth())
+
+	// b has not read anything, so the files are kept for it
+	_, err = os.Stat(dq.(*diskQueue).fileName(0))
+	Nil(t, err)
+
+	dq.Close()
+
+	dq = New(dqName, tmpDir, 40, 1, 1<<10, 2500, 2*time.Second, l)
+	defer dq.Close()
+	b, err = dq.Consumer("b")
+	Nil(t, err)
+	Equal(t, int64(6), b.Depth())
+	for i := 0; i < 3; i++ {
+		m, err := b.Get()
+		Nil(t, err)
+		Equal(t, []byte("msg "+strconv.Itoa(i)), m.Body)
+		Nil(t, b.Ack(m.Offset))
+	}
+	assertFileNotExist(t, dq.(*diskQueue).fileName(0))
+
+	// removing the slowest consumer releases the rest of the files
+	Nil(t, dq.RemoveConsumer("b"))
+	_, err = b.Get()
+	Equal(t, ErrConsumerRemoved, err)
+	assertFileNotExist(t, dq.(*diskQueue).fileName(1))
+	assertFileNotExist(t, dq.(*diskQueue).consumerMetaDataFileName("b"))
+}
+
+func TestDiskQueueConsumersOnly(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_consumers_only" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := Open(dqName, tmpDir, WithMaxBytesPerFile(40), WithMsgSize(1, 16), WithLogger(l),
+		WithConsumersOnly(), WithLimits(0, 4), WithOverflow(OverflowReject, 0))
+	defer dq.Close()
+
+	a, err := dq.Consumer("a")
+	Nil(t, err)
+	_, err = dq.Get()
+	NotNil(t, err)
+
+	// nothing reads from the queue itself, so acks by the only consumer
+	// free the files and make room under the depth limit
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 4; i++ {
+			Nil(t, dq.Put([]byte("msg "+strconv.Itoa(i))))
+		}
+		Equal(t, ErrQueueFull, dq.Put([]byte("full")))
+		for i := 0; i < 4; i++ {
+			m, err := a.Get()
+			Nil(t, err)
+			Equal(t, []byte("msg "+strconv.Itoa(i)), m.Body)
+			Nil(t, a.Ack(m.Offset))
+		}
+		Equal(t, int64(0), a.Depth())
+	}
+	Equal(t, int64(0), dq.Depth())
+	assertFileNotExist(t, dq.(*diskQueue).fileName(0))
+	Equal(t, true, dq.DiskUsage() <= 40)
+}
+
+func TestDiskQueueBatch(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_batch" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := New(dqName, tmpDir, 40, 1, 16, 2500, 2*time.Second, l)
+	defer dq.Close()
+
+	// one bad message rejects the whole batch
+	NotNil(t, dq.PutBatch([][]byte{[]byte("ok"), make([]byte, 17)}))
+	Equal(t, int64(0), dq.Depth())
+
+	var batch [][]byte
+	for i := 0; i < 7; i++ {
+		batch = append(batch, []byte("msg "+strconv.Itoa(i)))
+	}
+	Nil(t, dq.PutBatch(batch))
+	Equal(t, int64(7), dq.Depth())
+	// a batch larger than a file is split, three records fit in each
+	Equal(t, int64(2), dq.(*diskQueue).writeFileNum)
+
+	msgs, err := dq.ReadBatch(4, time.Second)
+	Nil(t, err)
+	Equal(t, batch[:4], msgs)
+	msgs, err = dq.ReadBatch(10, time.Second)
+	Nil(t, err)
+	Equal(t, batch[4:], msgs)
+	Equal(t, int64(0), dq.Depth())
+
+	msgs, err = dq.ReadBatch(10, 10*time.Millisecond)
+	Nil(t, err)
+	Equal(t, 0, len(msgs))
+
+	// a batch that fits in a file but not in what is left of the current one
+	// goes whole to the next
+	batch = [][]byte{[]byte("ab"), []byte("cd"), []byte("ef")}
+	Nil(t, dq.PutBatch(batch))
+	Equal(t, int64(3), dq.(*diskQueue).writeFileNum)
+	Equal(t, int64(fileHeaderSize+3*(8+2)), dq.(*diskQueue).writePos)
+	msgs, err = dq.ReadBatch(10, time.Second)
+	Nil(t, err)
+	Equal(t, batch, msgs)
+}
+
+func TestDiskQueueLimits(t *testing.T) {
+	l := NewTestLogger(t)
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	open := func(name string, opts ...Option) Interface {
+		opts = append([]Option{WithMaxBytesPerFile(40), WithMsgSize(1, 16), WithLogger(l)}, opts...)
+		return Open(name+strconv.Itoa(int(time.Now().Unix())), tmpDir, opts...)
+	}
+	msg := func(i int) []byte {
+		return []byte("msg " + strconv.Itoa(i))
+	}
+
+	// reject: writes over the depth limit fail until something is read
+	dq := open("test_limits_reject", WithLimits(0, 3), WithOverflow(OverflowReject, 0))
+	defer dq.Close()
+	for i := 0; i < 3; i++ {
+		Nil(t, dq.Put(msg(i)))
+	}
+	// three records and a file header
+	Equal(t, int64(3*13+8), dq.DiskUsage())
+	Equal(t, ErrQueueFull, dq.Put(msg(3)))
+	Equal(t, ErrQueueFull, dq.PutBatch([][]byte{msg(3)}))
+	Equal(t, msg(0), <-dq.ReadChan())
+	Nil(t, dq.Put(msg(3)))
+
+	// block: a write waits for a reader to make room, or gives up
+	dq = open("test_limits_block", WithLimits(0, 2), WithOverflow(OverflowBlock, time.Second))
+	defer dq.Close()
+	Nil(t, dq.Put(msg(0)))
+	Nil(t, dq.Put(msg(1)))
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		<-dq.ReadChan()
+	}()
+	start := time.Now()
+	Nil(t, dq.Put(msg(2)))
+	Equal(t, true, time.Since(start) >= 50*time.Millisecond)
+	Equal(t, ErrQueueFull, dq.Put(msg(3)))
+	Equal(t, true, time.Since(start) >= time.Second)
+
+	// drop oldest: the first file is dropped, unread, to make room
+	dq = open("test_limits_drop", WithLimits(0, 5), WithOverflow(OverflowDropOldest, 0))
+	defer dq.Close()
+	for i := 0; i < 6; i++ {
+		Nil(t, dq.Put(msg(i)))
+	}
+	Equal(t, int64(3), dq.Depth())
+	Equal(t, int64(3*13+8), dq.DiskUsage())
+	assertFileNotExist(t, dq.(*diskQueue).fileName(0))
+	for i := 3; i < 6; i++ {
+		Equal(t, msg(i), <-dq.ReadChan())
+	}
+}
+
+// jsonMsg returns a verbose JSON payload like those we queue in production
+func TestDiskQueueSchedule(t *testing.T) {
+	l := NewTestLogger(t)
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dqName := "test_disk_queue_schedule" + strconv.Itoa(int(time.Now().Unix()))
+	open := func(opts ...Option) Interface {
+		opts = append([]Option{WithMsgSize(1, 16), WithLogger(l)}, opts...)
+		return Open(dqName, tmpDir, opts...)
+	}
+
+	// without record headers only plain writes are allowed
+	dq := open()
+	Nil(t, dq.Put([]byte("plain")))
+	NotNil(t, dq.PutWithOptions([]byte("late"), PutOptions{TTL: time.Second}))
+	dq.Close()
+
+	// a scheduled write moves on from the plain file
+	dq = open(WithRecordHeader())
+	start := time.Now()
+	Nil(t, dq.PutWithOptions([]byte("stale"), PutOptions{TTL: time.Millisecond}))
+	Nil(t, dq.PutWithOptions([]byte("later"), PutOptions{NotBefore: start.Add(200 * time.Millisecond)}))
+	Nil(t, dq.Put([]byte("now")))
+	Equal(t, int64(1), dq.(*diskQueue).writeFileNum)
+	time.Sleep(5 * time.Millisecond)
+
+	Equal(t, []byte("plain"), <-dq.ReadChan())
+	m, err := dq.Get()
+	Nil(t, err)
+	Equal(t, []byte("now"), m.Body)
+	Equal(t, false, m.Timestamp.Before(start))
+	Nil(t, dq.Ack(m.Offset))
+	Equal(t, int64(1), dq.Expired())
+	// the held message is still queued, but the committed position moves on
+	Nil(t, dq.Sync())
+	Equal(t, int64(1), dq.Depth())
+	d := dq.(*diskQueue)
+	Equal(t, Offset{FileNum: d.writeFileNum, Pos: d.writePos}, Offset{FileNum: d.ackFileNum, Pos: d.ackPos})
+
+	// it is held across a restart too, and what was acknowledged after it is
+	// not delivered again
+	dq.Close()
+	dq = open(WithRecordHeader())
+	Equal(t, int64(1), dq.Depth())
+	Equal(t, []byte("later"), <-dq.ReadChan())
+	Equal(t, true, time.Since(start) >= 200*time.Millisecond)
+	Equal(t, int64(0), dq.Depth())
+	assertFileNotExist(t, dq.(*diskQueue).fileName(0))
+
+	// named consumers skip and hold messages on their own
+	c, err := dq.Consumer("c")
+	Nil(t, err)
+	start = time.Now()
+	Nil(t, dq.PutWithOptions([]byte("later"), PutOptions{NotBefore: start.Add(100 * time.Millisecond)}))
+	Nil(t, dq.PutWithOptions([]byte("stale"), PutOptions{TTL: time.Millisecond}))
+	time.Sleep(5 * time.Millisecond)
+	Nil(t, dq.Put([]byte("now")))
+	m, err = c.Get()
+	Nil(t, err)
+	Equal(t, []byte("now"), m.Body)
+	Nil(t, c.Ack(m.Offset))
+
+	// a held message handed out by Get is delivered again after a restart
+	// unless acknowledged
+	m, err = c.Get()
+	Nil(t, err)
+	Equal(t, []byte("later"), m.Body)
+	Equal(t, true, time.Since(start) >= 100*time.Millisecond)
+	Equal(t, int64(1), c.Depth())
+	dq.Close()
+	dq = open(WithRecordHeader())
+	defer dq.Close()
+	c, err = dq.Consumer("c")
+	Nil(t, err)
+	Equal(t, int64(1), c.Depth())
+	m, err = c.Get()
+	Nil(t, err)
+	Equal(t, []byte("later"), m.Body)
+	Nil(t, c.Ack(m.Offset))
+	Equal(t, int64(0), c.Depth())
+
+	// ReadBatch takes a due held message first, then the one read ahead
+	// while it was held and the ones after
+	//批量读取先取到期的延迟消息
+	bq := Open(dqName+"_batch", tmpDir, WithMsgSize(1, 16), WithLogger(l), WithRecordHeader())
+	defer bq.Close()
+	start = time.Now()
+	Nil(t, bq.PutWithOptions([]byte("later"), PutOptions{NotBefore: start.Add(100 * time.Millisecond)}))
+	Nil(t, bq.Put([]byte("one")))
+	time.Sleep(110 * time.Millisecond)
+	Nil(t, bq.Put([]byte("two")))
+	batch, err := bq.ReadBatch(10, time.Second)
+	Nil(t, err)
+	Equal(t, [][]byte{[]byte("later"), []byte("one"), []byte("two")}, batch)
+	Equal(t, int64(0), bq.Depth())
+}
+
+func jsonMsg(i int) []byte {
+	return []byte(fmt.Sprintf(`{"id":%d,"type":"order.created","status":"pending",`+
+		`"customer":{"name":"customer %d","email":"customer%d@example.com"},`+
+		`"items":[{"sku":"sku-%d","quantity":1,"price":"9.99"}],"created_at":"2020-01-01T00:00:00Z"}`,
+		i, i, i, i))
+}
+
+func TestDiskQueueCompression(t *testing.T) {
+	l := NewTestLogger(t)
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	for _, c := range []Compression{Flate, Gzip} {
+		dqName := "test_disk_queue_compression_" + c.String() + strconv.Itoa(int(time.Now().Unix()))
+		dq := Open(dqName, tmpDir, WithMaxBytesPerFile(1024), WithLogger(l), WithCompression(c))
+
+		var raw int64
+		for i := 0; i < 20; i++ {
+			Nil(t, dq.Put(jsonMsg(i)))
+			raw += int64(len(jsonMsg(i)))
+		}
+		// an incompressible message is stored as is
+		Nil(t, dq.Put([]byte("x")))
+		Equal(t, true, dq.DiskUsage() < raw)
+		dq.Close()
+
+		f, err := os.Open(dq.(*diskQueue).fileName(0))
+		Nil(t, err)
+		_, flags, err := readFileHeader(f)
+		f.Close()
+		Nil(t, err)
+		Equal(t, c, fileCompression(flags))
+
+		// reopened without compression, the file being written keeps its
+		// compression and older files stay readable
+		dq = Open(dqName, tmpDir, WithMaxBytesPerFile(1024), WithLogger(l))
+		Nil(t, dq.Put(jsonMsg(20)))
+		for i := 0; i < 20; i++ {
+			Equal(t, jsonMsg(i), <-dq.ReadChan())
+		}
+		Equal(t, []byte("x"), <-dq.ReadChan())
+		Equal(t, jsonMsg(20), <-dq.ReadChan())
+		dq.Close()
+	}
+}
+
+func TestInspector(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_inspector" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := New(dqName, tmpDir, 40, 1, 16, 2500, 2*time.Second, l)
+	for i := 0; i < 5; i++ {
+		Nil(t, dq.Put([]byte("msg "+strconv.Itoa(i))))
+	}
+	Equal(t, []byte("msg 0"), <-dq.ReadChan())
+	dq.Close()
+
+	in := NewInspector(dqName, tmpDir, 1, 16)
+	m, err := in.Meta()
+	Nil(t, err)
+	Equal(t, int64(4), m.Depth)
+	Equal(t, Offset{FileNum: 1, Pos: 8 + 2*13}, m.Write)
+
+	n, err := in.Count(m.Read)
+	Nil(t, err)
+	Equal(t, int64(4), n)
+	var bodies []string
+	Nil(t, in.Scan(Offset{}, func(r Record) error {
+		bodies = append(bodies, string(r.Body))
+		return nil
+	}))
+	Equal(t, []string{"msg 0", "msg 1", "msg 2", "msg 3", "msg 4"}, bodies)
+
+	// a torn write at the end of the newest file
+	f, err := os.OpenFile(dq.(*diskQueue).fileName(1), os.O_APPEND|os.O_WRONLY, 0600)
+	Nil(t, err)
+	_, err = f.Write([]byte{0, 0, 0, 5, 1, 2})
+	Nil(t, err)
+	f.Close()
+
+	reports, err := in.Verify()
+	Nil(t, err)
+	Equal(t, 2, len(reports))
+	Nil(t, reports[0].Err)
+	Equal(t, int64(3), reports[0].Records)
+	NotNil(t, reports[1].Err)
+	Equal(t, int64(8+2*13), reports[1].ValidBytes)
+
+	cut, err := in.TruncateTail()
+	Nil(t, err)
+	Equal(t, int64(6), cut)
+	reports, err = in.Verify()
+	Nil(t, err)
+	Nil(t, reports[1].Err)
+
+	// replay everything still on disk
+	start, err := in.Start()
+	Nil(t, err)
+	Nil(t, in.ResetCursor(start))
+	m, err = in.Meta()
+	Nil(t, err)
+	Equal(t, int64(5), m.Depth)
+
+	dq = New(dqName, tmpDir, 40, 1, 16, 2500, 2*time.Second, l)
+	defer dq.Close()
+	for i := 0; i < 5; i++ {
+		Equal(t, []byte("msg "+strconv.Itoa(i)), <-dq.ReadChan())
+	}
+}
+
+func TestPriorityQueue(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_priority" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	_, err = NewPriority(dqName, tmpDir, []int{1, 0})
+	NotNil(t, err)
+
+	weights := []int{4, 2, 1}
+	q, err := NewPriority(dqName, tmpDir, weights, WithLogger(l))
+	Nil(t, err)
+	NotNil(t, q.Put(3, []byte("bad")))
+	for lane := len(weights) - 1; lane >= 0; lane-- {
+		for i := 0; i < 10; i++ {
+			Nil(t, q.Put(lane, []byte(strconv.Itoa(lane))))
+		}
+	}
+	// whatever the reader took from a lane before Close is delivered again
+	q.Close()
+
+	q, err = NewPriority(dqName, tmpDir, weights, WithLogger(l))
+	Nil(t, err)
+	defer q.Close()
+	Equal(t, int64(30), q.Depth())
+	Equal(t, []int64{10, 10, 10}, q.LaneDepths())
+
+	// while every lane has messages they are read in proportion to the weights
+	counts := make([]int, len(weights))
+	for i := 0; i < 7; i++ {
+		lane, _ := strconv.Atoi(string(<-q.ReadChan()))
+		counts[lane]++
+	}
+	Equal(t, []int{4, 2, 1}, counts)
+
+	for i := 7; i < 30; i++ {
+		lane, _ := strconv.Atoi(string(<-q.ReadChan()))
+		counts[lane]++
+	}
+	Equal(t, []int{10, 10, 10}, counts)
+
+	// an empty queue wakes up for new messages
+	Nil(t, q.Put(2, []byte("2")))
+	Equal(t, []byte("2"), <-q.ReadChan())
+
+	// a lane with nothing due yet does not hold up the others
+	q, err = NewPriority(dqName+"_held", tmpDir, weights, WithLogger(l), WithRecordHeader())
+	Nil(t, err)
+	Nil(t, q.lanes[0].PutWithOptions([]byte("0"), PutOptions{NotBefore: time.Now().Add(time.Hour)}))
+	Nil(t, q.Put(1, []byte("1")))
+	Nil(t, q.Put(2, []byte("2")))
+	got := map[string]bool{}
+	for len(got) < 2 {
+		select {
+		case body := <-q.ReadChan():
+			got[string(body)] = true
+		case <-time.After(time.Second):
+			t.Fatalf("held up after %v", got)
+		}
+	}
+	Equal(t, map[string]bool{"1": true, "2": true}, got)
+	Nil(t, q.Close())
+	Nil(t, q.Close())
+}
+
 func readMetaDataFile(fileName string, retried int) md {
 	f, err := os.OpenFile(fileName, os.O_RDONLY, 0600)
 	if err != nil {
@@ -297,7 +945,7 @@ func TestDiskQueueSyncAfterRead(t *testing.T) {
 			d.readFileNum == 0 &&
 			d.writeFileNum == 0 &&
 			d.readPos == 0 &&
-			d.writePos == 1004 {
+			d.writePos == 1016 {
 			// success
 			goto next
 		}
@@ -314,8 +962,8 @@ next:
 		if d.depth == 1 &&
 			d.readFileNum == 0 &&
 			d.writeFileNum == 0 &&
-			d.readPos == 1004 &&
-			d.writePos == 2008 {
+			d.readPos == 1016 &&
+			d.writePos == 2024 {
 			// success
 			goto done
 		}
@@ -465,6 +1113,92 @@ func benchmarkDiskQueuePut(size int64, b *testing.B) {
 	}
 }
 
+func BenchmarkDiskQueuePutBatch16(b *testing.B) {
+	benchmarkDiskQueuePutBatch(16, b)
+}
+func BenchmarkDiskQueuePutBatch64(b *testing.B) {
+	benchmarkDiskQueuePutBatch(64, b)
+}
+func BenchmarkDiskQueuePutBatch256(b *testing.B) {
+	benchmarkDiskQueuePutBatch(256, b)
+}
+func BenchmarkDiskQueuePutBatch1024(b *testing.B) {
+	benchmarkDiskQueuePutBatch(1024, b)
+}
+func BenchmarkDiskQueuePutBatch4096(b *testing.B) {
+	benchmarkDiskQueuePutBatch(4096, b)
+}
+
+// batchSize is the number of messages per call in the batch benchmarks
+const batchSize = 64
+
+func benchmarkDiskQueuePutBatch(size int64, b *testing.B) {
+	b.StopTimer()
+	l := NewTestLogger(b)
+	dqName := "bench_disk_queue_put_batch" + strconv.Itoa(b.N) + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := New(dqName, tmpDir, 1024768*100, 0, 1<<20, 2500, 2*time.Second, l)
+	defer dq.Close()
+	b.SetBytes(size)
+	data := make([]byte, size)
+	batch := make([][]byte, batchSize)
+	for i := range batch {
+		batch[i] = data
+	}
+	b.StartTimer()
+
+	for i := 0; i < b.N; i += batchSize {
+		n := b.N - i
+		if n > batchSize {
+			n = batchSize
+		}
+		err := dq.PutBatch(batch[:n])
+		if err != nil {
+			panic(err)
+		}
+	}
+}
+
+func BenchmarkDiskQueuePutJSON(b *testing.B) {
+	benchmarkDiskQueuePutCompressed(NoCompression, b)
+}
+func BenchmarkDiskQueuePutJSONFlate(b *testing.B) {
+	benchmarkDiskQueuePutCompressed(Flate, b)
+}
+func BenchmarkDiskQueuePutJSONGzip(b *testing.B) {
+	benchmarkDiskQueuePutCompressed(Gzip, b)
+}
+
+// benchmarkDiskQueuePutCompressed reports the bytes on disk per message
+// alongside the throughput
+func benchmarkDiskQueuePutCompressed(c Compression, b *testing.B) {
+	b.StopTimer()
+	l := NewTestLogger(b)
+	dqName := "bench_disk_queue_put_compressed" + strconv.Itoa(b.N) + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := Open(dqName, tmpDir, WithLogger(l), WithCompression(c))
+	defer dq.Close()
+	data := jsonMsg(0)
+	b.SetBytes(int64(len(data)))
+	b.StartTimer()
+
+	for i := 0; i < b.N; i++ {
+		err := dq.Put(data)
+		if err != nil {
+			panic(err)
+		}
+	}
+	b.ReportMetric(float64(dq.DiskUsage())/float64(b.N), "disk-B/msg")
+}
+
 func BenchmarkDiskWrite16(b *testing.B) {
 	benchmarkDiskWrite(16, b)
 }
@@ -614,4 +1348,80 @@ func benchmarkDiskQueueGet(size int64, b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		<-dq.ReadChan()
 	}
-}
\ No newline at end of file
+}
+
+func BenchmarkDiskQueueReadBatch16(b *testing.B) {
+	benchmarkDiskQueueReadBatch(16, b)
+}
+func BenchmarkDiskQueueReadBatch64(b *testing.B) {
+	benchmarkDiskQueueReadBatch(64, b)
+}
+func BenchmarkDiskQueueReadBatch256(b *testing.B) {
+	benchmarkDiskQueueReadBatch(256, b)
+}
+func BenchmarkDiskQueueReadBatch1024(b *testing.B) {
+	benchmarkDiskQueueReadBatch(1024, b)
+}
+func BenchmarkDiskQueueReadBatch4096(b *testing.B) {
+	benchmarkDiskQueueReadBatch(4096, b)
+}
+
+func benchmarkDiskQueueReadBatch(size int64, b *testing.B) {
+	b.StopTimer()
+	l := NewTestLogger(b)
+	dqName := "bench_disk_queue_read_batch" + strconv.Itoa(b.N) + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := New(dqName, tmpDir, 1024768, 0, 1<<30, 2500, 2*time.Second, l)
+	defer dq.Close()
+	b.SetBytes(size)
+	data := make([]byte, size)
+	for i := 0; i < b.N; i++ {
+		dq.Put(data)
+	}
+	b.StartTimer()
+
+	for i := 0; i < b.N; {
+		msgs, err := dq.ReadBatch(batchSize, time.Second)
+		if err != nil {
+			panic(err)
+		}
+		i += len(msgs)
+	}
+}
+
+func BenchmarkDiskQueueGetJSON(b *testing.B) {
+	benchmarkDiskQueueGetCompressed(NoCompression, b)
+}
+func BenchmarkDiskQueueGetJSONFlate(b *testing.B) {
+	benchmarkDiskQueueGetCompressed(Flate, b)
+}
+func BenchmarkDiskQueueGetJSONGzip(b *testing.B) {
+	benchmarkDiskQueueGetCompressed(Gzip, b)
+}
+
+func benchmarkDiskQueueGetCompressed(c Compression, b *testing.B) {
+	b.StopTimer()
+	l := NewTestLogger(b)
+	dqName := "bench_disk_queue_get_compressed" + strconv.Itoa(b.N) + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := Open(dqName, tmpDir, WithLogger(l), WithCompression(c))
+	defer dq.Close()
+	data := jsonMsg(0)
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		dq.Put(data)
+	}
+	b.StartTimer()
+
+	for i := 0; i < b.N; i++ {
+		<-dq.ReadChan()
+	}
+}
@@ -0,0 +1,457 @@
+package diskqueue
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Inspector reads and repairs the files of a queue offline. It works on the
+// files directly, so the queue must not be open in any process meanwhile.
+//离线查看和修复队列文件，使用时队列不能被打开
+type Inspector struct {
+	d *diskQueue
+}
+
+// Meta is the persisted state of a queue
+type Meta struct {
+	Depth     int64
+	Read      Offset // committed read position of the queue's own reader
+	Write     Offset
+	Consumers []ConsumerMeta
+}
+
+// ConsumerMeta is the persisted state of a named consumer
+type ConsumerMeta struct {
+	Name  string
+	Depth int64
+	Read  Offset
+}
+
+// Segment describes a data file
+type Segment struct {
+	FileNum     int64
+	Path        string
+	Size        int64
+	Version     int
+	Compression Compression
+}
+
+// SegmentReport is the result of verifying a data file
+type SegmentReport struct {
+	Segment
+	Records    int64
+	ValidBytes int64 // end of the last intact record
+	Err        error // the first problem found, nil if the file is intact
+}
+
+// Record is a message found by Scan
+type Record struct {
+	Offset    Offset
+	Body      []byte
+	Timestamp time.Time // zero unless the file has record headers
+	Expiry    time.Time
+	NotBefore time.Time
+}
+
+// CorruptionError reports a record that could not be read
+type CorruptionError struct {
+	Offset Offset
+	Err    error
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("corrupt record at %d:%d - %s", e.Offset.FileNum, e.Offset.Pos, e.Err)
+}
+
+// NewInspector returns an Inspector for the queue with the given name in
+// dataPath. Records outside the message size bounds are treated as corrupt,
+// as the queue itself would.
+func NewInspector(name string, dataPath string, minMsgSize int32, maxMsgSize int32) *Inspector {
+	d := &diskQueue{
+		name:       name,
+		dataPath:   dataPath,
+		minMsgSize: minMsgSize,
+		maxMsgSize: maxMsgSize,
+		consumers:  make(map[string]*cursor),
+		logf:       discardLog,
+	}
+	d.cursor = *newCursor(d, "")
+	return &Inspector{d: d}
+}
+
+// load reads the metadata of the queue and its consumers
+func (i *Inspector) load() error {
+	err := i.d.retrieveMetaData()
+	if err != nil {
+		return err
+	}
+	i.d.consumers = make(map[string]*cursor)
+	return i.d.retrieveConsumers()
+}
+
+// save writes back the metadata of the queue and its consumers
+func (i *Inspector) save() error {
+	err := i.d.persistMetaData()
+	if err != nil {
+		return err
+	}
+	return i.d.persistConsumers()
+}
+
+// Meta returns the persisted state of the queue
+//读取元数据
+func (i *Inspector) Meta() (*Meta, error) {
+	err := i.load()
+	if err != nil {
+		return nil, err
+	}
+
+	d := i.d
+	m := &Meta{
+		Depth: d.depth,
+		Read:  Offset{FileNum: d.ackFileNum, Pos: d.ackPos},
+		Write: Offset{FileNum: d.writeFileNum, Pos: d.writePos},
+	}
+	for name, c := range d.consumers {
+		m.Consumers = append(m.Consumers, ConsumerMeta{
+			Name:  name,
+			Depth: c.depth,
+			Read:  Offset{FileNum: c.ackFileNum, Pos: c.ackPos},
+		})
+	}
+	sort.Slice(m.Consumers, func(a, b int) bool {
+		return m.Consumers[a].Name < m.Consumers[b].Name
+	})
+	return m, nil
+}
+
+// Segments returns the data files of the queue, oldest first
+//列出所有数据文件
+func (i *Inspector) Segments() ([]Segment, error) {
+	prefix := i.d.name + ".diskqueue."
+	const suffix = ".dat"
+	matches, err := filepath.Glob(path.Join(i.d.dataPath, prefix+"*"+suffix))
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []Segment
+	for _, fn := range matches {
+		fileNum, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(path.Base(fn), prefix), suffix), 10, 64)
+		if err != nil {
+			// metadata files share the prefix
+			continue
+		}
+		if fn != i.d.fileName(fileNum) {
+			continue
+		}
+
+		f, err := os.Open(fn)
+		if err != nil {
+			return nil, err
+		}
+		version, flags, err := readFileHeader(f)
+		fi, statErr := f.Stat()
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		if statErr != nil {
+			return nil, statErr
+		}
+		segments = append(segments, Segment{
+			FileNum:     fileNum,
+			Path:        fn,
+			Size:        fi.Size(),
+			Version:     version,
+			Compression: fileCompression(flags),
+		})
+	}
+	sort.Slice(segments, func(a, b int) bool {
+		return segments[a].FileNum < segments[b].FileNum
+	})
+	return segments, nil
+}
+
+// Scan calls fn for every message from the given offset up to the persisted
+// write position, which is what the queue would deliver. It stops at the
+// first corrupt record with a *CorruptionError, or at the first error fn
+// returns.
+//遍历消息
+func (i *Inspector) Scan(from Offset, fn func(Record) error) error {
+	err := i.load()
+	if err != nil {
+		return err
+	}
+	return i.scan(from, fn)
+}
+
+// Count returns the number of messages from the given offset up to the
+// persisted write position
+func (i *Inspector) Count(from Offset) (int64, error) {
+	err := i.load()
+	if err != nil {
+		return 0, err
+	}
+	return i.count(from)
+}
+
+// scan is Scan with the metadata already loaded
+func (i *Inspector) scan(from Offset, fn func(Record) error) error {
+	segments, err := i.Segments()
+	if err != nil {
+		return err
+	}
+
+	d := i.d
+	for _, s := range segments {
+		if s.FileNum < from.FileNum || s.FileNum > d.writeFileNum {
+			continue
+		}
+		pos := int64(0)
+		if s.FileNum == from.FileNum {
+			pos = from.Pos
+		}
+		limit := int64(-1)
+		if s.FileNum == d.writeFileNum {
+			limit = d.writePos
+		}
+		_, err = i.walk(s.FileNum, pos, limit, fn)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (i *Inspector) count(from Offset) (int64, error) {
+	var n int64
+	err := i.scan(from, func(Record) error {
+		n++
+		return nil
+	})
+	return n, err
+}
+
+// Start returns the offset of the oldest message still on disk
+func (i *Inspector) Start() (Offset, error) {
+	segments, err := i.Segments()
+	if err != nil {
+		return Offset{}, err
+	}
+	if len(segments) == 0 {
+		return i.End()
+	}
+	return Offset{FileNum: segments[0].FileNum}, nil
+}
+
+// End returns the persisted write position
+func (i *Inspector) End() (Offset, error) {
+	err := i.load()
+	if err != nil {
+		return Offset{}, err
+	}
+	return Offset{FileNum: i.d.writeFileNum, Pos: i.d.writePos}, nil
+}
+
+// Verify checks every record of every data file
+//校验所有数据文件
+func (i *Inspector) Verify() ([]SegmentReport, error) {
+	segments, err := i.Segments()
+	if err != nil {
+		return nil, err
+	}
+
+	reports := make([]SegmentReport, 0, len(segments))
+	for _, s := range segments {
+		r := SegmentReport{Segment: s}
+		r.ValidBytes, r.Err = i.walk(s.FileNum, 0, -1, func(Record) error {
+			r.Records++
+			return nil
+		})
+		reports = append(reports, r)
+	}
+	return reports, nil
+}
+
+// TruncateTail cuts the newest data file after its last intact record, e.g.
+// after a crash in the middle of a write, and pulls the persisted positions
+// back within it. It returns the number of bytes removed.
+//截断最新数据文件尾部损坏的部分
+func (i *Inspector) TruncateTail() (int64, error) {
+	err := i.load()
+	if err != nil {
+		return 0, err
+	}
+	segments, err := i.Segments()
+	if err != nil {
+		return 0, err
+	}
+	if len(segments) == 0 {
+		return 0, nil
+	}
+
+	s := segments[len(segments)-1]
+	end, err := i.walk(s.FileNum, 0, -1, nil)
+	if err == nil {
+		return 0, nil
+	}
+	if _, ok := err.(*CorruptionError); !ok {
+		return 0, err
+	}
+	err = os.Truncate(s.Path, end)
+	if err != nil {
+		return 0, err
+	}
+
+	d := i.d
+	clamp := func(c *cursor) {
+		if c.ackFileNum == s.FileNum && c.ackPos > end {
+			c.ackPos = end
+		}
+	}
+	if d.writeFileNum == s.FileNum && d.writePos > end {
+		d.writePos = end
+	}
+	clamp(&d.cursor)
+	for _, c := range d.consumers {
+		clamp(c)
+	}
+	err = i.recount()
+	if err != nil {
+		return 0, err
+	}
+	return s.Size - end, i.save()
+}
+
+// ResetCursor moves the committed read position of the queue's own reader,
+// e.g. to Start to replay everything still on disk or to End to skip it all.
+// Messages it put aside until they are due are forgotten; those after to are
+// put aside again when read.
+//重置读位置
+func (i *Inspector) ResetCursor(to Offset) error {
+	err := i.load()
+	if err != nil {
+		return err
+	}
+	i.d.ackFileNum = to.FileNum
+	i.d.ackPos = to.Pos
+	i.d.held = nil
+	err = i.recount()
+	if err != nil {
+		return err
+	}
+	return i.save()
+}
+
+// recount sets the depth of every cursor to the number of messages between
+// its committed position and the write position, and those it holds
+func (i *Inspector) recount() error {
+	cursors := []*cursor{&i.d.cursor}
+	for _, c := range i.d.consumers {
+		cursors = append(cursors, c)
+	}
+	for _, c := range cursors {
+		depth, err := i.count(Offset{FileNum: c.ackFileNum, Pos: c.ackPos})
+		if err != nil {
+			return err
+		}
+		c.depth = depth + int64(c.heldCount())
+	}
+	return nil
+}
+
+// walk calls fn, if not nil, for each record of a data file from pos up to
+// limit, or the end of the file if limit is negative. It returns the end of
+// the last intact record.
+func (i *Inspector) walk(fileNum int64, pos int64, limit int64, fn func(Record) error) (int64, error) {
+	d := i.d
+	f, err := os.Open(d.fileName(fileNum))
+	if err != nil {
+		return 0, err
+	}
+	version, flags, err := readFileHeader(f)
+	f.Close()
+	if err != nil {
+		return 0, err
+	}
+	data, err := ioutil.ReadFile(d.fileName(fileNum))
+	if err != nil {
+		return 0, err
+	}
+	if limit >= 0 && limit < int64(len(data)) {
+		data = data[:limit]
+	}
+
+	compression := fileCompression(flags)
+	if version >= formatV2 && pos < fileHeaderSize {
+		pos = fileHeaderSize
+	}
+	headers := flags&flagRecordHeader != 0
+	maxBody := d.maxMsgSize
+	if headers {
+		maxBody += recordHeaderSize
+	}
+	minSize, maxSize := storedSizeBounds(compression, headers, d.minMsgSize, d.maxMsgSize)
+	corrupt := func(err error) (int64, error) {
+		return pos, &CorruptionError{Offset: Offset{FileNum: fileNum, Pos: pos}, Err: err}
+	}
+
+	var inflate decompressor
+	for pos < int64(len(data)) {
+		var n int64
+		var payload []byte
+		if version >= formatV2 {
+			size, ok := validRecord(data[pos:], minSize, maxSize)
+			if !ok {
+				return corrupt(fmt.Errorf("invalid record"))
+			}
+			n = int64(size)
+			payload = data[pos+8 : pos+n]
+		} else {
+			if int64(len(data))-pos < 4 {
+				return corrupt(fmt.Errorf("short record"))
+			}
+			size := int32(binary.BigEndian.Uint32(data[pos:]))
+			if size < minSize || size > maxSize || pos+4+int64(size) > int64(len(data)) {
+				return corrupt(fmt.Errorf("invalid message size (%d)", size))
+			}
+			n = 4 + int64(size)
+			payload = data[pos+4 : pos+n]
+		}
+
+		body, err := inflate.decompress(compression, payload, maxBody)
+		if err != nil {
+			return corrupt(err)
+		}
+		var h recordHeader
+		if headers {
+			h, body, err = splitRecordHeader(body)
+			if err != nil {
+				return corrupt(err)
+			}
+		}
+		if fn != nil {
+			err = fn(Record{
+				Offset:    Offset{FileNum: fileNum, Pos: pos},
+				Body:      body,
+				Timestamp: unixTime(h.enqueued),
+				Expiry:    unixTime(h.expiry),
+				NotBefore: unixTime(h.notBefore),
+			})
+			if err != nil {
+				return pos, err
+			}
+		}
+		pos += n
+	}
+	return pos, nil
+}
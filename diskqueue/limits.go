@@ -0,0 +1,220 @@
+package diskqueue
+
+import (
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// OverflowPolicy decides what happens to a write that would take the queue
+// over its limits
+//超出限制时的处理策略
+type OverflowPolicy int
+
+const (
+	// OverflowReject fails the write with ErrQueueFull
+	OverflowReject OverflowPolicy = iota
+	// OverflowBlock waits for readers to make room, up to the overflow
+	// timeout, before failing with ErrQueueFull
+	OverflowBlock
+	// OverflowDropOldest removes the oldest data files, unread or not, until
+	// the write fits. The file being written is never dropped, so a write
+	// that does not fit alongside it still fails with ErrQueueFull.
+	OverflowDropOldest
+)
+
+// ErrQueueFull is returned by Put and PutBatch when a write would take the
+// queue over its size or depth limit
+var ErrQueueFull = errors.New("queue full")
+
+// waitForRoom runs put, and with OverflowBlock retries it each time readers
+// make room until it no longer fails with ErrQueueFull or the timeout passes
+func (d *diskQueue) waitForRoom(put func() error) error {
+	if d.overflow != OverflowBlock {
+		return put()
+	}
+
+	var timeout <-chan time.Time
+	if d.overflowTimeout > 0 {
+		timer := time.NewTimer(d.overflowTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	for {
+		// take the channel before trying so that room made in between is
+		// not missed
+		freed := d.spaceFreed()
+		err := put()
+		if err != ErrQueueFull {
+			return err
+		}
+
+		select {
+		case <-freed:
+		case <-timeout:
+			return ErrQueueFull
+		case <-d.exitChan:
+			return errors.New("exiting")
+		}
+	}
+}
+
+// spaceFreed returns a channel that is closed the next time room is made
+func (d *diskQueue) spaceFreed() <-chan struct{} {
+	d.spaceMu.Lock()
+	defer d.spaceMu.Unlock()
+	if d.spaceChan == nil {
+		d.spaceChan = make(chan struct{})
+	}
+	return d.spaceChan
+}
+
+// notifySpace wakes up writers blocked by OverflowBlock
+func (d *diskQueue) notifySpace() {
+	if d.overflow != OverflowBlock {
+		return
+	}
+	d.spaceMu.Lock()
+	if d.spaceChan != nil {
+		close(d.spaceChan)
+		d.spaceChan = nil
+	}
+	d.spaceMu.Unlock()
+}
+
+// makeRoom checks that n more messages of size bytes in total fit within
+// the limits, dropping the oldest data files if the policy allows
+//检查写入是否超出限制，必要时删除最早的文件
+func (d *diskQueue) makeRoom(n int64, size int64) error {
+	for d.exceeds(n, size) {
+		if d.overflow != OverflowDropOldest || d.oldestFileNum >= d.writeFileNum {
+			return ErrQueueFull
+		}
+		d.dropOldestFile()
+	}
+	return nil
+}
+
+func (d *diskQueue) exceeds(n int64, size int64) bool {
+	if d.maxBytes > 0 && atomic.LoadInt64(&d.diskBytes)+size > d.maxBytes {
+		return true
+	}
+	return d.maxDepth > 0 && d.backlog()+n > d.maxDepth
+}
+
+// backlog returns the depth of the slowest cursor
+func (d *diskQueue) backlog() int64 {
+	depth := atomic.LoadInt64(&d.depth)
+	for _, c := range d.consumers {
+		if cd := atomic.LoadInt64(&c.depth); cd > depth {
+			depth = cd
+		}
+	}
+	return depth
+}
+
+// dropOldestFile moves every cursor past the oldest data file and removes it
+func (d *diskQueue) dropOldestFile() {
+	fileNum := d.oldestFileNum
+	d.logf(WARN, "DISKQUEUE(%s) over limit, dropping %s", d.name, d.fileName(fileNum))
+
+	if !d.consumersOnly {
+		d.cursor.dropFile(fileNum)
+	}
+	for _, c := range d.consumers {
+		c.dropFile(fileNum)
+	}
+	d.removeConsumedFiles()
+	d.needSync = true
+}
+
+// dropFile moves the cursor past the given data file, forgetting anything
+// it has not acknowledged there
+func (c *cursor) dropFile(fileNum int64) {
+	held := c.dropHeld(fileNum)
+	if c.ackFileNum > fileNum {
+		atomic.AddInt64(&c.depth, -held)
+		return
+	}
+
+	// everything after the committed position counts towards the depth
+	dropped := c.dq.countRecords(fileNum, c.ackPos)
+
+	n := 0
+	for n < len(c.inFlight) && c.inFlight[n].offset.FileNum <= fileNum {
+		delete(c.inFlightIndex, c.inFlight[n].offset)
+		c.inFlight[n] = nil
+		n++
+	}
+	c.inFlight = c.inFlight[n:]
+
+	if c.readFileNum <= fileNum {
+		c.closeFile()
+		c.readFileNum = fileNum + 1
+		c.readPos = 0
+		c.nextReadFileNum = c.readFileNum
+		c.nextReadPos = 0
+	}
+	if len(c.inFlight) == 0 {
+		c.ackFileNum = c.readFileNum
+		c.ackPos = c.readPos
+	} else {
+		c.ackFileNum = c.inFlight[0].offset.FileNum
+		c.ackPos = c.inFlight[0].offset.Pos
+	}
+	atomic.AddInt64(&c.depth, -dropped-held)
+}
+
+// countRecords returns the number of records in a data file from pos on
+func (d *diskQueue) countRecords(fileNum int64, pos int64) int64 {
+	data, err := ioutil.ReadFile(d.fileName(fileNum))
+	if err != nil {
+		return 0
+	}
+
+	version := formatV1
+	if len(data) >= fileHeaderSize && string(data[:len(fileMagic)]) == string(fileMagic) {
+		version = int(data[3])
+		if pos < fileHeaderSize {
+			pos = fileHeaderSize
+		}
+	}
+
+	var n int64
+	overhead := recordOverhead(version)
+	for pos+overhead <= int64(len(data)) {
+		size := int64(int32(binary.BigEndian.Uint32(data[pos : pos+4])))
+		if size < 0 {
+			break
+		}
+		pos += overhead + size
+		n++
+	}
+	return n
+}
+
+// removeDataFile removes a data file and stops counting it towards the
+// disk usage
+func (d *diskQueue) removeDataFile(fileNum int64) error {
+	fn := d.fileName(fileNum)
+	size := d.dataFileSize(fileNum)
+	err := os.Remove(fn)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	atomic.AddInt64(&d.diskBytes, -size)
+	d.notifySpace()
+	return nil
+}
+
+func (d *diskQueue) dataFileSize(fileNum int64) int64 {
+	fi, err := os.Stat(d.fileName(fileNum))
+	if err != nil {
+		return 0
+	}
+	return fi.Size()
+}
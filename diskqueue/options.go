@@ -0,0 +1,114 @@
+package diskqueue
+
+import (
+	"time"
+)
+
+// defaults used by Open for anything not set by an Option
+const (
+	defaultMaxBytesPerFile = 100 * 1024 * 1024
+	defaultMinMsgSize      = 0
+	defaultMaxMsgSize      = 1024 * 1024
+	defaultSyncEvery       = 2500
+	defaultSyncTimeout     = 2 * time.Second
+)
+
+// Option configures a queue created by Open
+//队列的配置项
+type Option func(*diskQueue)
+
+// WithMaxBytesPerFile sets the size at which data files are rolled. It
+// cannot change once the queue has been created on disk.
+func WithMaxBytesPerFile(n int64) Option {
+	return func(d *diskQueue) {
+		d.maxBytesPerFile = n
+	}
+}
+
+// WithMsgSize sets the bounds on the size of a message; anything outside
+// them is rejected by Put and treated as corruption when read
+func WithMsgSize(min int32, max int32) Option {
+	return func(d *diskQueue) {
+		d.minMsgSize = min
+		d.maxMsgSize = max
+	}
+}
+
+// WithSync sets the sync policy: data and metadata are fsynced after every
+// n writes or reads, and every timeout while there is activity
+//同步策略：每n条或每隔timeout同步一次
+func WithSync(every int64, timeout time.Duration) Option {
+	return func(d *diskQueue) {
+		d.syncEvery = every
+		d.syncTimeout = timeout
+	}
+}
+
+// WithReadTimeout makes the ioLoop wake up every interval even when idle to
+// retry any consumers still waiting for data. Zero, the default, disables it.
+//读超时，空闲时也定期重试读取
+func WithReadTimeout(interval time.Duration) Option {
+	return func(d *diskQueue) {
+		d.readTimeout = interval
+	}
+}
+
+// WithCompression sets the compression of data files created from now on
+//新数据文件的压缩方式
+func WithCompression(c Compression) Option {
+	return func(d *diskQueue) {
+		d.compression = c
+	}
+}
+
+// WithRecordHeader gives every message written to data files created from
+// now on a header with its enqueue time, and lets PutWithOptions set an
+// expiry or a time it becomes visible
+//新数据文件的消息带记录头，支持过期和延迟消息
+func WithRecordHeader() Option {
+	return func(d *diskQueue) {
+		d.recordHeader = true
+	}
+}
+
+// WithLimits caps the bytes taken up by the data files and the number of
+// unread messages. Zero means no limit. What happens to a write over either
+// limit is set by WithOverflow.
+//磁盘占用和深度的上限
+func WithLimits(maxBytes int64, maxDepth int64) Option {
+	return func(d *diskQueue) {
+		d.maxBytes = maxBytes
+		d.maxDepth = maxDepth
+	}
+}
+
+// WithOverflow sets the policy for writes over the limits. timeout is how
+// long OverflowBlock waits for room; zero waits indefinitely.
+//超出限制时的策略
+func WithOverflow(policy OverflowPolicy, timeout time.Duration) Option {
+	return func(d *diskQueue) {
+		d.overflow = policy
+		d.overflowTimeout = timeout
+	}
+}
+
+// WithConsumersOnly is for queues that are only read by named consumers:
+// the queue's own reader is left out, so that it neither holds on to data
+// files nor counts towards the depth limit. ReadChan then never delivers
+// anything, and Get and ReadBatch fail.
+//只有命名消费者读取，不使用队列自身的读游标
+func WithConsumersOnly() Option {
+	return func(d *diskQueue) {
+		d.consumersOnly = true
+	}
+}
+
+// WithLogger sets the function log messages are sent to. By default they
+// are discarded.
+func WithLogger(logf AppLogFunc) Option {
+	return func(d *diskQueue) {
+		d.logf = logf
+	}
+}
+
+func discardLog(lvl LogLevel, f string, args ...interface{}) {}
@@ -0,0 +1,217 @@
+package diskqueue
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// laneWait is how long the reader waits for the lane it picked before it
+// takes whichever lane has a message first; a lane can have a depth but
+// nothing to deliver, e.g. while its messages are not due yet
+const laneWait = 10 * time.Millisecond
+
+// PriorityQueue is a queue with a fixed number of priority levels, lane 0
+// being the most urgent. Each lane is a queue of its own, with its own chain
+// of data files named after the lane, and a single reader drains them by
+// weighted round robin, so lower lanes slow down but never starve.
+//带优先级的队列，每个优先级一条独立的队列，按权重轮询读取
+type PriorityQueue struct {
+	name    string
+	lanes   []*diskQueue
+	weights []int
+	current []int // smooth weighted round robin state
+
+	readChan  chan []byte
+	notify    chan struct{} // wakes the reader after a Put
+	exitChan  chan int
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// NewPriority opens a queue with one lane per weight, in order of priority.
+// A lane with weight w is read w times as often as one with weight 1 while
+// both have messages. opts apply to every lane.
+//创建优先级队列，weights为每个优先级的权重
+func NewPriority(name string, dataPath string, weights []int, opts ...Option) (*PriorityQueue, error) {
+	if len(weights) == 0 {
+		return nil, errors.New("no priority levels")
+	}
+	for i, w := range weights {
+		if w <= 0 {
+			return nil, fmt.Errorf("invalid weight %d for lane %d", w, i)
+		}
+	}
+
+	q := &PriorityQueue{
+		name:     name,
+		weights:  weights,
+		current:  make([]int, len(weights)),
+		readChan: make(chan []byte),
+		notify:   make(chan struct{}, 1),
+		exitChan: make(chan int),
+	}
+	for i := range weights {
+		q.lanes = append(q.lanes, Open(laneName(name, i), dataPath, opts...).(*diskQueue))
+	}
+
+	q.wg.Add(1)
+	go q.readLoop()
+	return q, nil
+}
+
+// laneName returns the name of the queue backing a lane
+func laneName(name string, lane int) string {
+	return fmt.Sprintf("%s.lane%d", name, lane)
+}
+
+// Put writes a []byte to the lane of the given priority
+func (q *PriorityQueue) Put(priority int, data []byte) error {
+	if priority < 0 || priority >= len(q.lanes) {
+		return fmt.Errorf("invalid priority %d", priority)
+	}
+	err := q.lanes[priority].Put(data)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// ReadChan returns the channel messages of all lanes are delivered on
+func (q *PriorityQueue) ReadChan() <-chan []byte {
+	return q.readChan
+}
+
+// Depth returns the total depth of all lanes
+func (q *PriorityQueue) Depth() int64 {
+	var depth int64
+	for _, l := range q.lanes {
+		depth += l.Depth()
+	}
+	return depth
+}
+
+// LaneDepths returns the depth of each lane, in order of priority
+//获取每个优先级的深度
+func (q *PriorityQueue) LaneDepths() []int64 {
+	depths := make([]int64, len(q.lanes))
+	for i, l := range q.lanes {
+		depths[i] = l.Depth()
+	}
+	return depths
+}
+
+// Close stops the reader and closes every lane. A message taken from a lane
+// but not yet received from ReadChan is delivered again after a restart.
+// Calling it again returns the result of the first call.
+func (q *PriorityQueue) Close() error {
+	q.closeOnce.Do(func() {
+		close(q.exitChan)
+
+		for _, l := range q.lanes {
+			if err := l.Close(); err != nil {
+				q.closeErr = err
+			}
+		}
+		q.wg.Wait()
+	})
+	return q.closeErr
+}
+
+// Empty destructively clears every lane
+func (q *PriorityQueue) Empty() error {
+	for _, l := range q.lanes {
+		err := l.Empty()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// next picks the lane to read from by smooth weighted round robin among
+// the lanes with messages, or returns -1 if they are all empty
+func (q *PriorityQueue) next() int {
+	best, total := -1, 0
+	for i, l := range q.lanes {
+		if l.Depth() <= 0 {
+			continue
+		}
+		q.current[i] += q.weights[i]
+		total += q.weights[i]
+		if best < 0 || q.current[i] > q.current[best] {
+			best = i
+		}
+	}
+	if best >= 0 {
+		q.current[best] -= total
+	}
+	return best
+}
+
+// readLoop moves messages from the lanes to readChan. Each is only
+// acknowledged in its lane once received from readChan.
+func (q *PriorityQueue) readLoop() {
+	defer q.wg.Done()
+
+	// every lane, then notify and exitChan
+	cases := make([]reflect.SelectCase, 0, len(q.lanes)+2)
+	for _, l := range q.lanes {
+		cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(l.getChan)})
+	}
+	cases = append(cases,
+		reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(q.notify)},
+		reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(q.exitChan)})
+
+	timer := time.NewTimer(laneWait)
+	defer timer.Stop()
+
+	for {
+		lane := q.next()
+		var m *Message
+		if lane >= 0 {
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(laneWait)
+			select {
+			case m = <-q.lanes[lane].getChan:
+			case <-timer.C:
+			case <-q.exitChan:
+				return
+			}
+		}
+
+		if m == nil {
+			//选中的优先级没有可投递的消息，等任意一个优先级
+			chosen, v, ok := reflect.Select(cases)
+			if chosen >= len(q.lanes) || !ok {
+				select {
+				case <-q.exitChan:
+					return
+				default:
+				}
+				continue
+			}
+			lane, m = chosen, v.Interface().(*Message)
+		}
+
+		select {
+		case q.readChan <- m.Body:
+			q.lanes[lane].Ack(m.Offset)
+		case <-q.exitChan:
+			return
+		}
+	}
+}
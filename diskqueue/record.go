@@ -0,0 +1,115 @@
+package diskqueue
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// On-disk format
+//
+// Version 1 data files, written before the format was versioned, are a bare
+// sequence of records, each a 4 byte big-endian size followed by the payload.
+//
+// Version 2 data files start with an 8 byte header:
+//
+//	[3 byte magic][1 byte version][1 byte flags][3 bytes reserved]
+//
+// followed by records of a 4 byte big-endian size, a 4 byte big-endian
+// CRC32C (Castagnoli) of the size and payload, and the payload itself.
+// The low bits of the flags byte hold the file's Compression, which applies
+// to the payload of every record in it, and flagRecordHeader marks files
+// whose messages start with a record header.
+//
+// The first byte of the magic has its top bit set, so read as a version 1
+// size it would be negative and can never be mistaken for a valid record.
+const (
+	formatV1 = 1
+	formatV2 = 2
+
+	fileHeaderSize = 8
+)
+
+var (
+	fileMagic = []byte{0xd1, 'd', 'q'}
+	crcTable  = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// fileHeader returns the header written at the start of every new data file.
+func fileHeader(flags byte) []byte {
+	h := make([]byte, fileHeaderSize)
+	copy(h, fileMagic)
+	h[3] = formatV2
+	h[4] = flags
+	return h
+}
+
+// readFileHeader returns the format version and flags of an open data file.
+// Files without a header are version 1.
+func readFileHeader(f *os.File) (int, byte, error) {
+	h := make([]byte, fileHeaderSize)
+	n, err := f.ReadAt(h, 0)
+	if err != nil && err != io.EOF {
+		return 0, 0, err
+	}
+	if n < len(fileMagic) || !bytes.Equal(h[:len(fileMagic)], fileMagic) {
+		return formatV1, 0, nil
+	}
+	if n < fileHeaderSize {
+		return 0, 0, io.ErrUnexpectedEOF
+	}
+	return int(h[3]), h[4], nil
+}
+
+// recordOverhead returns the number of bytes framing each record.
+func recordOverhead(version int) int64 {
+	if version >= formatV2 {
+		return 8
+	}
+	return 4
+}
+
+// recordChecksum returns the CRC32C of a record's size prefix and payload.
+func recordChecksum(size []byte, payload []byte) uint32 {
+	crc := crc32.Update(0, crcTable, size)
+	return crc32.Update(crc, crcTable, payload)
+}
+
+// appendRecord appends data to buf as a version 2 record.
+func appendRecord(buf *bytes.Buffer, data []byte) {
+	var hdr [8]byte
+	binary.BigEndian.PutUint32(hdr[:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(hdr[4:], recordChecksum(hdr[:4], data))
+	buf.Write(hdr[:])
+	buf.Write(data)
+}
+
+// validRecord reports whether a complete, intact version 2 record within the
+// size bounds starts at the beginning of data, and if so its total length.
+func validRecord(data []byte, minMsgSize, maxMsgSize int32) (int, bool) {
+	if len(data) < 8 {
+		return 0, false
+	}
+	size := int32(binary.BigEndian.Uint32(data[:4]))
+	if size < minMsgSize || size > maxMsgSize || int64(len(data)) < 8+int64(size) {
+		return 0, false
+	}
+	payload := data[8 : 8+size]
+	if binary.BigEndian.Uint32(data[4:8]) != recordChecksum(data[:4], payload) {
+		return 0, false
+	}
+	return 8 + int(size), true
+}
+
+// findRecord scans data for the first offset at which a valid version 2
+// record starts. It is used to resynchronise after a corrupt record.
+func findRecord(data []byte, minMsgSize, maxMsgSize int32) (int, bool) {
+	for off := 0; off+8 <= len(data); off++ {
+		if _, ok := validRecord(data[off:], minMsgSize, maxMsgSize); ok {
+			return off, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,358 @@
+package diskqueue
+
+import (
+	"container/heap"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Record headers
+//
+// Data files created while WithRecordHeader is set have flagRecordHeader set
+// in their file header, and the message of every record in them, before
+// compression, starts with a 24 byte header of three big-endian int64 unix
+// nanosecond times: when it was enqueued, when it expires and when it becomes
+// visible. The last two are zero when unset.
+//
+// A record that has expired by the time it is read is skipped and counted by
+// Expired. A record that is not visible yet is put aside, and delivered once
+// it is due. Only its offset and times are kept, in memory and with the
+// metadata of the cursor, so the committed position moves on past it and
+// after a restart it is still delivered when due, without the messages
+// after it being delivered again. It counts towards the depth, and its data
+// file is kept, until it is delivered, or acknowledged if handed out by Get.
+//记录头：入队时间、过期时间和可见时间
+const (
+	flagRecordHeader = 0x04
+
+	recordHeaderSize = 24
+)
+
+var errNoRecordHeader = errors.New("record headers not enabled, see WithRecordHeader")
+
+// PutOptions are the per-message settings stored in the record header
+type PutOptions struct {
+	TTL       time.Duration // expire this long after being enqueued, 0 for never
+	NotBefore time.Time     // hold back until then, zero to deliver at once
+}
+
+func (o PutOptions) scheduled() bool {
+	return o.TTL > 0 || !o.NotBefore.IsZero()
+}
+
+// recordHeader is the decoded header of a record, in unix nanoseconds
+type recordHeader struct {
+	enqueued  int64
+	expiry    int64
+	notBefore int64
+}
+
+func newRecordHeader(now time.Time, opts PutOptions) recordHeader {
+	h := recordHeader{enqueued: now.UnixNano()}
+	if opts.TTL > 0 {
+		h.expiry = h.enqueued + int64(opts.TTL)
+	}
+	if !opts.NotBefore.IsZero() {
+		h.notBefore = opts.NotBefore.UnixNano()
+	}
+	return h
+}
+
+func (h recordHeader) appendTo(b []byte) []byte {
+	var buf [recordHeaderSize]byte
+	binary.BigEndian.PutUint64(buf[0:], uint64(h.enqueued))
+	binary.BigEndian.PutUint64(buf[8:], uint64(h.expiry))
+	binary.BigEndian.PutUint64(buf[16:], uint64(h.notBefore))
+	return append(b, buf[:]...)
+}
+
+// splitRecordHeader separates the header from the message of a record
+func splitRecordHeader(data []byte) (recordHeader, []byte, error) {
+	if len(data) < recordHeaderSize {
+		return recordHeader{}, nil, errors.New("short record header")
+	}
+	h := recordHeader{
+		enqueued:  int64(binary.BigEndian.Uint64(data[0:])),
+		expiry:    int64(binary.BigEndian.Uint64(data[8:])),
+		notBefore: int64(binary.BigEndian.Uint64(data[16:])),
+	}
+	return h, data[recordHeaderSize:], nil
+}
+
+// unixTime converts a header time, leaving zero as the zero time
+func unixTime(ns int64) time.Time {
+	if ns == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ns)
+}
+
+func (h recordHeader) expired(now int64) bool {
+	return h.expiry != 0 && now >= h.expiry
+}
+
+// PutWithOptions writes a []byte to the queue with an expiry or a time it
+// becomes visible. It fails unless the queue was opened with
+// WithRecordHeader.
+//带过期时间或延迟时间推入数据
+func (d *diskQueue) PutWithOptions(data []byte, opts PutOptions) error {
+	if opts.scheduled() && !d.recordHeader {
+		return errNoRecordHeader
+	}
+	return d.waitForRoom(func() error {
+		d.RLock()
+		defer d.RUnlock()
+
+		if d.exitFlag == 1 {
+			return errors.New("exiting")
+		}
+
+		d.writeBatchChan <- writeRequest{batch: [][]byte{data}, opts: opts}
+		return <-d.writeResponseChan
+	})
+}
+
+// Expired returns the number of expired messages the queue's own reader has
+// skipped since it was opened
+//获取跳过的过期消息数量
+func (d *diskQueue) Expired() int64 {
+	return atomic.LoadInt64(&d.expired)
+}
+
+// heldMsg is a message read before it is due
+type heldMsg struct {
+	offset Offset
+	header recordHeader
+	m      *Message // read back once due
+}
+
+// heldQueue is a min-heap of held messages by due time
+type heldQueue []heldMsg
+
+func (q heldQueue) Len() int            { return len(q) }
+func (q heldQueue) Less(i, j int) bool  { return q[i].header.notBefore < q[j].header.notBefore }
+func (q heldQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *heldQueue) Push(x interface{}) { *q = append(*q, x.(heldMsg)) }
+func (q *heldQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	x := old[n-1]
+	old[n-1] = heldMsg{}
+	*q = old[:n-1]
+	return x
+}
+
+// message wraps the record just read, with its offset and enqueue time
+func (c *cursor) message(data []byte) *Message {
+	return &Message{
+		Body:      data,
+		Offset:    Offset{FileNum: c.readFileNum, Pos: c.recordPos()},
+		Timestamp: unixTime(c.header.enqueued),
+	}
+}
+
+// schedule deals with the record just read if it should not be delivered
+// yet: an expired one is skipped and a future one put aside. It returns
+// true if m is to be delivered now, in which case the caller moves forward.
+func (c *cursor) schedule(m *Message, now time.Time) bool {
+	h := c.header
+	if h.expired(now.UnixNano()) {
+		c.moveForward(true)
+		atomic.AddInt64(&c.expired, 1)
+		return false
+	}
+	if h.notBefore > now.UnixNano() {
+		//还没到时间，只记下位置，已确认的位置可以越过它
+		heap.Push(&c.held, heldMsg{offset: m.Offset, header: h})
+		atomic.AddInt64(&c.depth, 1)
+		c.moveForward(true)
+		c.dq.needSync = true
+		return false
+	}
+	return true
+}
+
+// due returns the held message that is due first if it is due by now,
+// reading it back from its data file, and dropping any that expired while
+// held. It stays held until popHeld.
+func (c *cursor) due(now time.Time) *Message {
+	for len(c.held) > 0 {
+		top := &c.held[0]
+		if top.header.notBefore > now.UnixNano() {
+			return nil
+		}
+		if top.header.expired(now.UnixNano()) {
+			heap.Pop(&c.held)
+			c.releaseHeld()
+			atomic.AddInt64(&c.expired, 1)
+			continue
+		}
+		if top.m == nil {
+			m, err := c.readHeld(top.offset)
+			if err != nil {
+				c.dq.logf(ERROR, "DISKQUEUE(%s) failed to read held message at %d of %s - %s",
+					c.logName(), top.offset.Pos, c.dq.fileName(top.offset.FileNum), err)
+				heap.Pop(&c.held)
+				c.releaseHeld()
+				continue
+			}
+			top.m = m
+		}
+		return top.m
+	}
+	return nil
+}
+
+// readHeld reads back the record of a held message
+func (c *cursor) readHeld(offset Offset) (*Message, error) {
+	r := newCursor(c.dq, c.name)
+	r.reset(offset.FileNum, offset.Pos)
+	defer r.closeFile()
+	data, err := r.readOne()
+	if err != nil {
+		return nil, err
+	}
+	m := r.message(data)
+	if m.Offset != offset {
+		return nil, fmt.Errorf("no record at %d", offset.Pos)
+	}
+	return m, nil
+}
+
+// popHeld takes the message returned by due out of the held messages. It is
+// done with if acked, or else kept until passed to ack.
+func (c *cursor) popHeld(acked bool) {
+	h := heap.Pop(&c.held).(heldMsg)
+	if acked {
+		c.releaseHeld()
+		return
+	}
+	h.m = nil
+	c.heldOut[h.offset] = h
+}
+
+// releaseHeld stops counting a held message that is done with, and releases
+// its data file if nothing else needs it
+func (c *cursor) releaseHeld() {
+	atomic.AddInt64(&c.depth, -1)
+	c.dq.needSync = true
+	c.dq.notifySpace()
+	c.dq.removeConsumedFiles()
+}
+
+// heldCount returns the number of held messages, including those handed out
+// by Get and not acknowledged yet
+func (c *cursor) heldCount() int {
+	return len(c.held) + len(c.heldOut)
+}
+
+// retainFileNum returns the oldest data file the cursor still needs
+func (c *cursor) retainFileNum() int64 {
+	fileNum := c.ackFileNum
+	for _, h := range c.held {
+		if h.offset.FileNum < fileNum {
+			fileNum = h.offset.FileNum
+		}
+	}
+	for offset := range c.heldOut {
+		if offset.FileNum < fileNum {
+			fileNum = offset.FileNum
+		}
+	}
+	return fileNum
+}
+
+// heldLines returns the held messages as persisted after the metadata of the
+// cursor, one "fileNum,pos,notBefore,expiry" line each. Those handed out by
+// Get are held again after a restart.
+func (c *cursor) heldLines() string {
+	var b strings.Builder
+	write := func(h heldMsg) {
+		fmt.Fprintf(&b, "%d,%d,%d,%d\n", h.offset.FileNum, h.offset.Pos, h.header.notBefore, h.header.expiry)
+	}
+	for _, h := range c.held {
+		write(h)
+	}
+	for _, h := range c.heldOut {
+		write(h)
+	}
+	return b.String()
+}
+
+// scanHeld reads the held messages persisted by heldLines
+func scanHeld(r io.Reader) heldQueue {
+	var held heldQueue
+	for {
+		var h heldMsg
+		_, err := fmt.Fscanf(r, "%d,%d,%d,%d\n",
+			&h.offset.FileNum, &h.offset.Pos, &h.header.notBefore, &h.header.expiry)
+		if err != nil {
+			break
+		}
+		held = append(held, h)
+	}
+	heap.Init(&held)
+	return held
+}
+
+// nextDue returns when the first held message is due
+func (c *cursor) nextDue() (time.Time, bool) {
+	if len(c.held) == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(0, c.held[0].header.notBefore), true
+}
+
+// dropHeld forgets the held messages up to and including the given file,
+// returning how many there were
+func (c *cursor) dropHeld(fileNum int64) int64 {
+	kept := c.held[:0]
+	for _, h := range c.held {
+		if h.offset.FileNum > fileNum {
+			kept = append(kept, h)
+		}
+	}
+	dropped := int64(len(c.held) - len(kept))
+	for i := len(kept); i < len(c.held); i++ {
+		c.held[i] = heldMsg{}
+	}
+	c.held = kept
+	heap.Init(&c.held)
+
+	for offset := range c.heldOut {
+		if offset.FileNum <= fileNum {
+			delete(c.heldOut, offset)
+			dropped++
+		}
+	}
+	return dropped
+}
+
+// dueWait returns how long until the ioLoop next has a held message to
+// deliver, or false if there is none. Held messages that are already due
+// only count while someone is waiting for them, so that the ioLoop does not
+// wake up over and over for nobody.
+func (d *diskQueue) dueWait(offering bool) (time.Duration, bool) {
+	now := time.Now()
+	var next time.Time
+	found := false
+	consider := func(t time.Time) {
+		if !found || t.Before(next) {
+			next, found = t, true
+		}
+	}
+	if t, ok := d.cursor.nextDue(); ok && !offering {
+		consider(t)
+	}
+	for _, c := range d.consumers {
+		if t, ok := c.nextDue(); ok && (len(c.waiting) > 0 || t.After(now)) {
+			consider(t)
+		}
+	}
+	return next.Sub(now), found
+}
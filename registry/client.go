@@ -0,0 +1,387 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"twist/core/middleware/interceptor"
+)
+
+// Balancer picks one address out of those of an application's instances
+type Balancer int
+
+const (
+	RoundRobin Balancer = iota
+	Random
+)
+
+// DefaultRetryInterval is how long a Client waits after a failed request,
+// or a fetch of an application without instances
+const DefaultRetryInterval = time.Second
+
+var errClientClosed = errors.New("client closed")
+
+// Client talks to the registry servers at nodes: it keeps its instance
+// registered and renewed until Close, and a local cache of the instances of
+// watched applications, fresh by long-polling.
+// 注册中心客户端
+type Client struct {
+	env           string
+	nodes         []string
+	node          uint32 //当前使用的节点
+	httpClient    *http.Client
+	renewInterval time.Duration
+	retryInterval time.Duration
+	pollTimeout   time.Duration
+
+	lock       sync.RWMutex
+	instance   *Instance //注册的实例
+	unregister func()    //取消interceptor.OnClose
+	apps       map[string]*watchedApp
+
+	ctx       context.Context
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+}
+
+type watchedApp struct {
+	next      uint64     //轮询下标
+	data      *FetchData //本地缓存
+	callbacks []func(*FetchData)
+	deliver   sync.Mutex //回调按顺序执行
+}
+
+// ClientOption configures a Client
+type ClientOption func(*Client)
+
+// WithRenewInterval sets how often the registered instance is renewed
+func WithRenewInterval(d time.Duration) ClientOption {
+	return func(c *Client) {
+		c.renewInterval = d
+	}
+}
+
+// WithRetryInterval sets how long to wait after a failed request
+func WithRetryInterval(d time.Duration) ClientOption {
+	return func(c *Client) {
+		c.retryInterval = d
+	}
+}
+
+// WithPollTimeout sets the poll timeout of the servers, after which the
+// client gives up on an unanswered poll
+func WithPollTimeout(d time.Duration) ClientOption {
+	return func(c *Client) {
+		c.pollTimeout = d
+	}
+}
+
+// NewClient returns a Client for the env of the registry servers at nodes,
+// base URLs such as "http://127.0.0.1:7171"
+func NewClient(env string, nodes []string, opts ...ClientOption) (*Client, error) {
+	if env == "" || len(nodes) == 0 {
+		return nil, fmt.Errorf("invalid env %q or nodes %v", env, nodes)
+	}
+	c := &Client{
+		env:           env,
+		nodes:         nodes,
+		renewInterval: RenewInterval,
+		retryInterval: DefaultRetryInterval,
+		pollTimeout:   DefaultPollTimeout,
+		apps:          make(map[string]*watchedApp),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	// polls may take pollTimeout before they are even answered
+	c.httpClient = &http.Client{Timeout: c.pollTimeout + 10*time.Second}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	return c, nil
+}
+
+// Register registers the instance described by req, in the client's env,
+// renews it every renew interval, registering it again if the registry lost
+// it, and cancels it on Close, which runs as soon as interceptor.Reload gets
+// a stop signal
+// 注册实例，定时续约，退出时下线
+func (c *Client) Register(req *RequestRegister) (*Instance, error) {
+	r := *req
+	r.Env = c.env
+	instance := NewInstance(&r)
+
+	c.lock.Lock()
+	if c.instance != nil {
+		c.lock.Unlock()
+		return nil, errors.New("already registered")
+	}
+	c.instance = instance
+	c.lock.Unlock()
+
+	err := c.register(instance)
+	if err != nil {
+		c.lock.Lock()
+		c.instance = nil
+		c.lock.Unlock()
+		return nil, err
+	}
+
+	c.wg.Add(1)
+	go c.renewLoop(instance)
+	unregister := interceptor.OnClose(c.Close)
+	c.lock.Lock()
+	c.unregister = unregister
+	c.lock.Unlock()
+	return copyInstance(instance), nil
+}
+
+func (c *Client) register(instance *Instance) error {
+	form := url.Values{
+		"env":            {instance.Env},
+		"appid":          {instance.AppID},
+		"hostname":       {instance.Hostname},
+		"addrs":          instance.Addrs,
+		"status":         {strconv.FormatUint(uint64(instance.Status), 10)},
+		"version":        {instance.Version},
+		"lease_duration": {strconv.FormatInt(instance.LeaseDuration, 10)},
+	}
+	return c.do(c.ctx, http.MethodPost, "/discovery/register", form, nil)
+}
+
+func (c *Client) renewLoop(instance *Instance) {
+	defer c.wg.Done()
+	ticker := time.NewTicker(c.renewInterval)
+	defer ticker.Stop()
+	form := url.Values{
+		"env":      {instance.Env},
+		"appid":    {instance.AppID},
+		"hostname": {instance.Hostname},
+	}
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.ctx.Done():
+			return
+		}
+		err := c.do(c.ctx, http.MethodPost, "/discovery/renew", form, nil)
+		if err == ErrNotFound {
+			// evicted, or the registry restarted
+			// 被剔除或注册中心重启，重新注册
+			err = c.register(instance)
+		}
+		if err != nil && c.ctx.Err() == nil {
+			log.Printf("registry renew %s of %s: %v", instance.Hostname, instance.AppID, err)
+		}
+	}
+}
+
+// Watch keeps the instances of appid in the local cache, calling fn, if not
+// nil, with every new set of instances, in order. fn runs on the polling
+// goroutine, or right away with the cached instances if there are any, and
+// must not call Watch for appid itself.
+// 订阅应用的实例变化
+func (c *Client) Watch(appid string, fn func(*FetchData)) {
+	c.lock.Lock()
+	app, ok := c.apps[appid]
+	if !ok {
+		app = &watchedApp{}
+		c.apps[appid] = app
+	}
+	c.lock.Unlock()
+
+	// no update is delivered between adding fn and calling it
+	app.deliver.Lock()
+	c.lock.Lock()
+	if fn != nil {
+		app.callbacks = append(app.callbacks, fn)
+	}
+	data := app.data
+	c.lock.Unlock()
+	if fn != nil && data != nil {
+		fn(data)
+	}
+	app.deliver.Unlock()
+
+	if !ok {
+		c.wg.Add(1)
+		go c.pollLoop(appid, app)
+	}
+}
+
+func (c *Client) pollLoop(appid string, app *watchedApp) {
+	defer c.wg.Done()
+	var latestTimestamp int64
+	for {
+		q := url.Values{
+			"env":              {c.env},
+			"appid":            {appid},
+			"latest_timestamp": {strconv.FormatInt(latestTimestamp, 10)},
+		}
+		data := new(FetchData)
+		err := c.do(c.ctx, http.MethodGet, "/discovery/poll", q, data)
+		if c.ctx.Err() != nil {
+			return
+		}
+		switch err {
+		case nil:
+			latestTimestamp = data.LatestTimestamp
+			c.update(app, data)
+			continue
+		case ErrNotModified:
+			continue
+		case ErrNotFound:
+			// no instances: polls are answered at once, so wait a little
+			// 没有实例时不会阻塞，稍等再查
+			latestTimestamp = 0
+			c.update(app, &FetchData{Instances: []*Instance{}})
+		default:
+			log.Printf("registry poll %s: %v", appid, err)
+		}
+		select {
+		case <-time.After(c.retryInterval):
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
+
+// update stores data as the cached instances of app and, if they changed,
+// calls its callbacks
+func (c *Client) update(app *watchedApp, data *FetchData) {
+	app.deliver.Lock()
+	defer app.deliver.Unlock()
+	c.lock.Lock()
+	if app.data != nil && len(app.data.Instances) == 0 && len(data.Instances) == 0 {
+		c.lock.Unlock()
+		return
+	}
+	app.data = data
+	callbacks := app.callbacks
+	c.lock.Unlock()
+
+	for _, fn := range callbacks {
+		fn(data)
+	}
+}
+
+// Fetch returns the cached instances of a watched appid, false if it is not
+// watched or not fetched yet
+func (c *Client) Fetch(appid string) (*FetchData, bool) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	app, ok := c.apps[appid]
+	if !ok || app.data == nil {
+		return nil, false
+	}
+	return app.data, true
+}
+
+// Pick returns one address of the cached instances of a watched appid,
+// ErrNotFound if there are none
+// 从实例地址中选取一个
+func (c *Client) Pick(appid string, balancer Balancer) (string, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	app, ok := c.apps[appid]
+	if !ok || app.data == nil {
+		return "", ErrNotFound
+	}
+	var addrs []string
+	for _, instance := range app.data.Instances {
+		addrs = append(addrs, instance.Addrs...)
+	}
+	if len(addrs) == 0 {
+		return "", ErrNotFound
+	}
+	if balancer == Random {
+		return addrs[rand.Intn(len(addrs))], nil
+	}
+	next := atomic.AddUint64(&app.next, 1) - 1
+	return addrs[next%uint64(len(addrs))], nil
+}
+
+// Close stops watching and renewing and cancels the registered instance.
+// Cached instances stay available.
+func (c *Client) Close() {
+	c.closeOnce.Do(func() {
+		c.cancel()
+		c.wg.Wait()
+
+		c.lock.RLock()
+		instance, unregister := c.instance, c.unregister
+		c.lock.RUnlock()
+		if unregister != nil {
+			unregister()
+		}
+		if instance == nil {
+			return
+		}
+		form := url.Values{
+			"env":      {instance.Env},
+			"appid":    {instance.AppID},
+			"hostname": {instance.Hostname},
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), c.retryInterval+5*time.Second)
+		defer cancel()
+		err := c.do(ctx, http.MethodPost, "/discovery/cancel", form, nil)
+		if err != nil {
+			log.Printf("registry cancel %s of %s: %v", instance.Hostname, instance.AppID, err)
+		}
+	})
+}
+
+// do sends a request to the current node, moving on to the next one after
+// a failure to reach it, and decodes a successful answer into out
+func (c *Client) do(ctx context.Context, method, path string, params url.Values, out interface{}) error {
+	node := c.nodes[atomic.LoadUint32(&c.node)%uint32(len(c.nodes))]
+	var req *http.Request
+	var err error
+	if method == http.MethodGet {
+		req, err = http.NewRequestWithContext(ctx, method, node+path+"?"+params.Encode(), nil)
+	} else {
+		req, err = http.NewRequestWithContext(ctx, method, node+path, strings.NewReader(params.Encode()))
+		if req != nil {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		atomic.AddUint32(&c.node, 1)
+		if ctx.Err() != nil {
+			return errClientClosed
+		}
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		if out == nil {
+			return nil
+		}
+		return json.NewDecoder(resp.Body).Decode(out)
+	case http.StatusNotModified:
+		return ErrNotModified
+	case http.StatusNotFound:
+		return ErrNotFound
+	}
+	var errResp ErrorResponse
+	json.NewDecoder(resp.Body).Decode(&errResp)
+	atomic.AddUint32(&c.node, 1)
+	return fmt.Errorf("%s %s: %d %s", method, path, resp.StatusCode, errResp.Message)
+}
@@ -0,0 +1,120 @@
+package registry
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// waitInstances waits for a callback with n instances
+func waitInstances(t *testing.T, changes <-chan *FetchData, n int) *FetchData {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case data := <-changes:
+			if len(data.Instances) == n {
+				return data
+			}
+		case <-timeout:
+			t.Fatalf("no change to %d instances", n)
+		}
+	}
+}
+
+func newTestClient(t *testing.T, url string) *Client {
+	c, err := NewClient("dev", []string{url},
+		WithRenewInterval(20*time.Millisecond),
+		WithRetryInterval(20*time.Millisecond),
+		WithPollTimeout(200*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestClient(t *testing.T) {
+	r := NewRegistry(WithEvictInterval(20*time.Millisecond), WithSelfProtectThreshold(0))
+	defer r.Close()
+	ts := httptest.NewServer(NewServer(r, 200*time.Millisecond))
+	defer ts.Close()
+
+	watcher := newTestClient(t, ts.URL)
+	defer watcher.Close()
+	changes := make(chan *FetchData, 16)
+	watcher.Watch("provider", func(data *FetchData) { changes <- data })
+	if _, err := watcher.Pick("provider", RoundRobin); err != ErrNotFound {
+		t.Fatalf("pick before any instance: %v", err)
+	}
+
+	a := newTestClient(t, ts.URL)
+	defer a.Close()
+	_, err := a.Register(&RequestRegister{
+		AppId:         "provider",
+		Hostname:      "a",
+		Addrs:         []string{"http://a:8000", "http://a:8001"},
+		Status:        1,
+		LeaseDuration: 100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitInstances(t, changes, 1)
+
+	// a later watcher gets the cached instances first
+	later := make(chan *FetchData, 16)
+	watcher.Watch("provider", func(data *FetchData) { later <- data })
+	if data := <-later; len(data.Instances) != 1 {
+		t.Fatalf("%d cached instances", len(data.Instances))
+	}
+
+	// round robin over every address
+	// 轮询所有地址
+	first, _ := watcher.Pick("provider", RoundRobin)
+	second, _ := watcher.Pick("provider", RoundRobin)
+	third, _ := watcher.Pick("provider", RoundRobin)
+	if first == second || first != third {
+		t.Fatalf("picked %s, %s, %s", first, second, third)
+	}
+	if addr, err := watcher.Pick("provider", Random); err != nil || (addr != "http://a:8000" && addr != "http://a:8001") {
+		t.Fatalf("random pick %s: %v", addr, err)
+	}
+
+	b := newTestClient(t, ts.URL)
+	b.Register(&RequestRegister{AppId: "provider", Hostname: "b", Addrs: []string{"http://b:8000"}, Status: 1})
+	waitInstances(t, changes, 2)
+
+	// renewals outlive the lease, and a lost instance registers again
+	time.Sleep(300 * time.Millisecond)
+	if data, _ := watcher.Fetch("provider"); len(data.Instances) != 2 {
+		t.Fatalf("%d instances after renewals", len(data.Instances))
+	}
+	cancelled, _ := r.Cancel("dev", "provider", "a")
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		in, err := r.Renew("dev", "provider", "a")
+		if err == nil && in.RegTimestamp > cancelled.RegTimestamp {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("lost instance not registered again")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	waitInstances(t, changes, 2)
+
+	b.Close()
+	data := waitInstances(t, changes, 1)
+	if data.Instances[0].Hostname != "a" {
+		t.Fatalf("left %s", data.Instances[0].Hostname)
+	}
+	if _, err := b.Register(&RequestRegister{AppId: "provider", Hostname: "b"}); err == nil {
+		t.Fatal("registered after close")
+	}
+
+	a.Close()
+	waitInstances(t, changes, 0)
+	if _, err := watcher.Pick("provider", RoundRobin); err != ErrNotFound {
+		t.Fatalf("pick without instances: %v", err)
+	}
+}
@@ -0,0 +1,78 @@
+package registry
+
+import (
+	"sync"
+	"time"
+)
+
+// Guard decides on self-preservation, Eureka style: it counts the renewals
+// of every window and compares the last window's count with the renewals
+// the registered instances should have sent in it. Falling short means
+// either many instances died at once or the registry lost touch with them,
+// and as the latter is far more likely, expiry is no longer trusted.
+// 自我保护，续约数低于预期时不再剔除实例
+type Guard struct {
+	renewCount     int64   //当前窗口的续约数
+	lastRenewCount int64   //上一个窗口的续约数
+	needRenewCount int64   //注册的实例数
+	perInstance    float64 //每个实例在一个窗口内应续约的次数
+	threshold      float64
+	lock           sync.RWMutex
+}
+
+func newGuard(threshold float64, window time.Duration) *Guard {
+	return &Guard{
+		threshold:   threshold,
+		perInstance: float64(window) / float64(RenewInterval),
+	}
+}
+
+// incrNeed expects the renewals of one more instance
+func (gd *Guard) incrNeed() {
+	gd.lock.Lock()
+	defer gd.lock.Unlock()
+	gd.needRenewCount++
+}
+
+// decrNeed expects the renewals of one instance less
+func (gd *Guard) decrNeed() {
+	gd.lock.Lock()
+	defer gd.lock.Unlock()
+	if gd.needRenewCount > 0 {
+		gd.needRenewCount--
+	}
+}
+
+// setNeed resets the number of instances renewals are expected from
+func (gd *Guard) setNeed(count int64) {
+	gd.lock.Lock()
+	defer gd.lock.Unlock()
+	gd.needRenewCount = count
+}
+
+// incrCount counts a renewal
+func (gd *Guard) incrCount() {
+	gd.lock.Lock()
+	defer gd.lock.Unlock()
+	gd.renewCount++
+}
+
+// storeLastCount closes the current window
+func (gd *Guard) storeLastCount() {
+	gd.lock.Lock()
+	defer gd.lock.Unlock()
+	gd.lastRenewCount = gd.renewCount
+	gd.renewCount = 0
+}
+
+// selfProtectStatus reports whether the last window fell short of the
+// expected renewals
+func (gd *Guard) selfProtectStatus() bool {
+	gd.lock.RLock()
+	defer gd.lock.RUnlock()
+	if gd.threshold <= 0 || gd.needRenewCount == 0 {
+		return false
+	}
+	need := float64(gd.needRenewCount) * gd.perInstance * gd.threshold
+	return float64(gd.lastRenewCount) < need
+}
@@ -1,13 +1,46 @@
-package main
+// Package registry is an in-memory service registry: instances register
+// with a lease they keep alive by renewing, and are evicted once it expires.
+// 服务注册中心
+package registry
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log"
+	"math/rand"
 	"sync"
 	"time"
 )
 
+const (
+	// RenewInterval is how often instances are expected to renew
+	RenewInterval = 30 * time.Second
+	// DefaultLeaseDuration is the lease of an instance registered without
+	// one: it is evicted after missing three renewals
+	DefaultLeaseDuration = 3 * RenewInterval
+	// CheckEvictInterval is how often expired instances are looked for
+	CheckEvictInterval = 60 * time.Second
+	// ProtectedEvictDuration is how long an instance may go without renewing
+	// before it is evicted even in self-preservation mode
+	ProtectedEvictDuration = time.Hour
+	// SelfProtectThreshold is the share of expected renewals below which the
+	// registry stops trusting expiry and enters self-preservation
+	SelfProtectThreshold = 0.85
+	// ResetGuardNeedCountInterval is how often the expected renewals are
+	// recounted from the registered instances
+	ResetGuardNeedCountInterval = 15 * time.Minute
+)
+
+var (
+	// ErrNotFound is returned for an unknown application or instance, or an
+	// application without instances of the requested status
+	ErrNotFound = errors.New("NotFound")
+	// ErrNotModified is returned by Fetch when nothing changed since the
+	// caller's latest timestamp
+	ErrNotModified = errors.New("NotModified")
+)
+
 type Instance struct {
 	Env             string   `json:"env"`
 	AppID           string   `json:"appid"`
@@ -20,18 +53,47 @@ type Instance struct {
 	RenewTimestamp  int64    `json:"renew_timestamp"`
 	DirtyTimestamp  int64    `json:"dirty_timestamp"`
 	LatestTimestamp int64    `json:"latest_timestamp"`
+	LeaseDuration   int64    `json:"lease_duration"` //租约时长，纳秒
 }
 
+// Application holds the instances of an appid in an env. It is kept once
+// all of them are gone, so that its latestTimestamp never goes back.
 type Application struct {
 	appid           string
 	instances       map[string]*Instance
-	latestTimestamp int64
+	latestTimestamp int64         //最近一次变化的时间，按注册中心的时钟单调递增
+	changed         chan struct{} //latestTimestamp变化时关闭并替换
 	lock            sync.RWMutex
 }
 
 type Registry struct {
 	apps map[string]*Application
 	lock sync.RWMutex
+	gd   *Guard
+
+	evictInterval time.Duration
+	resetInterval time.Duration
+	threshold     float64
+	exitChan      chan struct{}
+	closeOnce     sync.Once
+}
+
+// Option configures a Registry
+type Option func(*Registry)
+
+// WithEvictInterval sets how often expired instances are evicted
+func WithEvictInterval(d time.Duration) Option {
+	return func(r *Registry) {
+		r.evictInterval = d
+	}
+}
+
+// WithSelfProtectThreshold sets the share of expected renewals below which
+// the registry enters self-preservation, 0 to never enter it
+func WithSelfProtectThreshold(threshold float64) Option {
+	return func(r *Registry) {
+		r.threshold = threshold
+	}
 }
 
 type RequestRegister struct {
@@ -42,17 +104,39 @@ type RequestRegister struct {
 	Status          uint32
 	Version         string
 	LatestTimestamp int64
+	LeaseDuration   time.Duration //0为DefaultLeaseDuration
 }
 
-func NewRegistry() *Registry {
+// NewRegistry returns a Registry and starts its evictor, stopped by Close
+func NewRegistry(opts ...Option) *Registry {
 	registry := &Registry{
-		apps: make(map[string]*Application),
+		apps:          make(map[string]*Application),
+		evictInterval: CheckEvictInterval,
+		resetInterval: ResetGuardNeedCountInterval,
+		threshold:     SelfProtectThreshold,
+		exitChan:      make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(registry)
 	}
+	registry.gd = newGuard(registry.threshold, registry.evictInterval)
+	go registry.evictTask()
 	return registry
 }
 
+// Close stops the evictor
+func (r *Registry) Close() {
+	r.closeOnce.Do(func() {
+		close(r.exitChan)
+	})
+}
+
 func NewInstance(req *RequestRegister) *Instance {
 	now := time.Now().UnixNano()
+	lease := req.LeaseDuration
+	if lease <= 0 {
+		lease = DefaultLeaseDuration
+	}
 	instance := &Instance{
 		Env:             req.Env,
 		AppID:           req.AppId,
@@ -65,6 +149,7 @@ func NewInstance(req *RequestRegister) *Instance {
 		RenewTimestamp:  now,
 		DirtyTimestamp:  now,
 		LatestTimestamp: now,
+		LeaseDuration:   int64(lease),
 	}
 	return instance
 }
@@ -73,31 +158,35 @@ func NewApplication(appid string) *Application {
 	return &Application{
 		appid:     appid,
 		instances: make(map[string]*Instance),
+		changed:   make(chan struct{}),
 	}
 }
 
 // 服务注册
-func (r *Registry) Register(instance *Instance, latestTimestamp int64) (*Application, error) {
+// Register adds or replaces instance and returns a copy of the one stored,
+// which is the older one if instance is dirtier.
+func (r *Registry) Register(instance *Instance) (*Instance, error) {
+	if instance.LeaseDuration <= 0 {
+		instance.LeaseDuration = int64(DefaultLeaseDuration)
+	}
 	key := getKey(instance.AppID, instance.Env)
-	r.lock.RLock()
+	r.lock.Lock()
 	app, ok := r.apps[key]
-	r.lock.RUnlock()
 	if !ok {
 		app = NewApplication(instance.AppID)
+		r.apps[key] = app
 	}
-	_, isNew := app.AddInstance(instance, latestTimestamp)
+	r.lock.Unlock()
+	stored, isNew := app.AddInstance(instance)
 	if isNew {
-		// TODO
+		r.gd.incrNeed()
 	}
 
 	log.Println("action register...")
-	r.lock.Lock()
-	r.apps[key] = app
-	r.lock.Unlock()
-	return app, nil
+	return stored, nil
 }
 
-func (app *Application) AddInstance(in *Instance, latestTimestamp int64) (*Instance, bool) {
+func (app *Application) AddInstance(in *Instance) (*Instance, bool) {
 	app.lock.Lock()
 	defer app.lock.Unlock()
 	appIns, ok := app.instances[in.Hostname]
@@ -109,14 +198,21 @@ func (app *Application) AddInstance(in *Instance, latestTimestamp int64) (*Insta
 		}
 	}
 	app.instances[in.Hostname] = in
-	app.upLatestTimestamp(latestTimestamp)
-	returnIns := new(Instance)
-	*returnIns = *in
-	return returnIns, !ok
+	app.upLatestTimestamp()
+	return copyInstance(in), !ok
 }
 
-func (app *Application) upLatestTimestamp(latestTimestamp int64) {
+// upLatestTimestamp moves latestTimestamp forward to now, by the registry's
+// clock, or by one if the clock did not move on, so that fetchers holding
+// the previous one always see the change
+func (app *Application) upLatestTimestamp() {
+	latestTimestamp := time.Now().UnixNano()
+	if latestTimestamp <= app.latestTimestamp {
+		latestTimestamp = app.latestTimestamp + 1
+	}
 	app.latestTimestamp = latestTimestamp
+	close(app.changed)
+	app.changed = make(chan struct{})
 }
 
 func getKey(appid string, env string) string {
@@ -124,8 +220,8 @@ func getKey(appid string, env string) string {
 }
 
 type FetchData struct {
-	Instances       []*Instance
-	LatestTimestamp int64
+	Instances       []*Instance `json:"instances"`
+	LatestTimestamp int64       `json:"latest_timestamp"`
 }
 
 func (r *Registry) getApplication(appid, env string) (*Application, bool) {
@@ -140,17 +236,49 @@ func (r *Registry) getApplication(appid, env string) (*Application, bool) {
 func (r *Registry) Fetch(env, appid string, status uint32, latestTime int64) (*FetchData, error) {
 	app, ok := r.getApplication(appid, env)
 	if !ok {
-		return nil, errors.New("NotFound")
+		return nil, ErrNotFound
 	}
 	return app.GetInstance(status, latestTime)
 }
 
+// 长轮询服务发现
+// Poll is Fetch, except that instead of ErrNotModified it waits until the
+// application changes, or ctx is done, which returns ErrNotModified.
+func (r *Registry) Poll(ctx context.Context, env, appid string, status uint32, latestTime int64) (*FetchData, error) {
+	for {
+		app, ok := r.getApplication(appid, env)
+		if !ok {
+			return nil, ErrNotFound
+		}
+		fetchData, changed, err := app.watch(status, latestTime)
+		if err != ErrNotModified {
+			return fetchData, err
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil, ErrNotModified
+		}
+	}
+}
+
+// watch is GetInstance that also returns a channel closed on the next change
+func (app *Application) watch(status uint32, latestTime int64) (*FetchData, <-chan struct{}, error) {
+	app.lock.RLock()
+	defer app.lock.RUnlock()
+	fetchData, err := app.getInstance(status, latestTime)
+	return fetchData, app.changed, err
+}
+
 func (app *Application) GetInstance(status uint32, latestTime int64) (*FetchData, error) {
 	app.lock.RLock()
 	defer app.lock.RUnlock()
-	fmt.Println(latestTime, app.latestTimestamp)
+	return app.getInstance(status, latestTime)
+}
+
+func (app *Application) getInstance(status uint32, latestTime int64) (*FetchData, error) {
 	if latestTime >= app.latestTimestamp {
-		return nil, errors.New("NotModified")
+		return nil, ErrNotModified
 	}
 	fetchData := FetchData{
 		Instances:       make([]*Instance, 0),
@@ -165,7 +293,7 @@ func (app *Application) GetInstance(status uint32, latestTime int64) (*FetchData
 		}
 	}
 	if !exists {
-		return nil, errors.New("NotFound")
+		return nil, ErrNotFound
 	}
 	return &fetchData, nil
 }
@@ -181,25 +309,21 @@ func copyInstance(src *Instance) *Instance {
 }
 
 // 服务下线
-func (r *Registry) Cancel(env, appid, hostname string, latestTimestamp int64) (*Instance, error) {
+func (r *Registry) Cancel(env, appid, hostname string) (*Instance, error) {
 	log.Println("action cancel...")
 	app, ok := r.getApplication(appid, env)
 	if !ok {
-		return nil, errors.New("NotFound")
+		return nil, ErrNotFound
 	}
-	instance, ok, insLen := app.Cancel(hostname, latestTimestamp)
+	instance, ok, _ := app.Cancel(hostname)
 	if !ok {
-		return nil, errors.New("NotFound")
-	}
-	if insLen == 0 {
-		r.lock.Lock()
-		delete(r.apps, getKey(appid, env))
-		r.lock.Unlock()
+		return nil, ErrNotFound
 	}
+	r.gd.decrNeed()
 	return instance, nil
 }
 
-func (app *Application) Cancel(hostname string, latestTimestamp int64) (*Instance, bool, int) {
+func (app *Application) Cancel(hostname string) (*Instance, bool, int) {
 	newInstance := new(Instance)
 	app.lock.Lock()
 	defer app.lock.Unlock()
@@ -208,8 +332,8 @@ func (app *Application) Cancel(hostname string, latestTimestamp int64) (*Instanc
 		return nil, ok, 0
 	}
 	delete(app.instances, hostname)
-	appIn.LatestTimestamp = latestTimestamp
-	app.upLatestTimestamp(latestTimestamp)
+	app.upLatestTimestamp()
+	appIn.LatestTimestamp = app.latestTimestamp
 	*newInstance = *appIn
 	return newInstance, true, len(app.instances)
 }
@@ -218,12 +342,13 @@ func (app *Application) Cancel(hostname string, latestTimestamp int64) (*Instanc
 func (r *Registry) Renew(env, appid, hostname string) (*Instance, error) {
 	app, ok := r.getApplication(appid, env)
 	if !ok {
-		return nil, errors.New("NotFound")
+		return nil, ErrNotFound
 	}
 	in, ok := app.Renew(hostname)
 	if !ok {
-		return nil, errors.New("NotFound")
+		return nil, ErrNotFound
 	}
+	r.gd.incrCount()
 	return in, nil
 }
 
@@ -238,45 +363,93 @@ func (app *Application) Renew(hostname string) (*Instance, bool) {
 	return copyInstance(appIn), true
 }
 
-const (
-	CheckEvictInterval = 60
-)
+// GetInstanceLen returns the number of instances
+func (app *Application) GetInstanceLen() int {
+	app.lock.RLock()
+	defer app.lock.RUnlock()
+	return len(app.instances)
+}
+
+// GetAllInstances returns copies of all instances
+func (app *Application) GetAllInstances() []*Instance {
+	app.lock.RLock()
+	defer app.lock.RUnlock()
+	instances := make([]*Instance, 0, len(app.instances))
+	for _, instance := range app.instances {
+		instances = append(instances, copyInstance(instance))
+	}
+	return instances
+}
 
-func (r *Registry) evictTask()  {
-	ticker := time.Tick(CheckEvictInterval)
+// evictTask evicts expired instances every evictInterval, and recounts the
+// renewals the guard expects every resetInterval
+func (r *Registry) evictTask() {
+	ticker := time.NewTicker(r.evictInterval)
+	defer ticker.Stop()
+	resetTicker := time.NewTicker(r.resetInterval)
+	defer resetTicker.Stop()
 	for {
 		select {
-		case <-ticker:
+		case <-ticker.C:
+			r.gd.storeLastCount()
 			r.evict()
+		case <-resetTicker.C:
+			var count int64
+			for _, app := range r.getAllApplications() {
+				count += int64(app.GetInstanceLen())
+			}
+			r.gd.setNeed(count)
+		case <-r.exitChan:
+			return
 		}
 	}
 }
 
-func (r *Registry) evict()  {
-
-}
-
-func (r *Registry) getAllApplications()  {
+// 剔除过期实例
+// evict cancels the instances whose lease expired. In self-preservation,
+// when fewer renewals arrived than expected, only those silent for longer
+// than ProtectedEvictDuration go, as a network partition looks the same as
+// many instances dying at once. It never evicts more than the share of
+// instances the self-preservation threshold allows to be lost at once,
+// picked at random when there are more.
+func (r *Registry) evict() {
+	protectStatus := r.gd.selfProtectStatus()
+	now := time.Now().UnixNano()
+	var expiredInstances []*Instance
+	var registryLen int
+	for _, app := range r.getAllApplications() {
+		for _, instance := range app.GetAllInstances() {
+			registryLen++
+			delta := now - instance.RenewTimestamp
+			if (!protectStatus && delta > instance.LeaseDuration) || delta > int64(ProtectedEvictDuration) {
+				expiredInstances = append(expiredInstances, instance)
+			}
+		}
+	}
 
+	evictionLimit := registryLen - int(float64(registryLen)*r.threshold)
+	expiredLen := len(expiredInstances)
+	if expiredLen > evictionLimit {
+		expiredLen = evictionLimit
+	}
+	if expiredLen == 0 {
+		return
+	}
+	rand.Shuffle(len(expiredInstances), func(i, j int) {
+		expiredInstances[i], expiredInstances[j] = expiredInstances[j], expiredInstances[i]
+	})
+	for _, instance := range expiredInstances[:expiredLen] {
+		log.Printf("evict instance %s of %s, protect %v", instance.Hostname, instance.AppID, protectStatus)
+		r.Cancel(instance.Env, instance.AppID, instance.Hostname)
+	}
 }
 
-func main() {
-	var req = &RequestRegister{
-		Env:             "dev",
-		AppId:           "com.xx.testapp",
-		Hostname:        "myhost",
-		Addrs:           []string{"http://testapp.xx.com/myhost"},
-		Status:          1,
-		LatestTimestamp: time.Now().UnixNano(),
-	}
-	r := NewRegistry()
-	instance := NewInstance(req)
-	r.Register(instance, req.LatestTimestamp)
-	fetchData, err := r.Fetch(req.Env, req.AppId, req.Status, 0)
-	if err != nil {
-		fmt.Println(err)
-		return
+func (r *Registry) getAllApplications() []*Application {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	apps := make([]*Application, 0, len(r.apps))
+	for _, app := range r.apps {
+		apps = append(apps, app)
 	}
-	r.Cancel(req.Env, req.AppId, req.Hostname, 0)
-	log.Println(fetchData)
+	return apps
 }
@@ -0,0 +1,136 @@
+package registry
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func register(r *Registry, hostname string, lease time.Duration) *Instance {
+	req := &RequestRegister{
+		Env:           "dev",
+		AppId:         "com.xx.testapp",
+		Hostname:      hostname,
+		Addrs:         []string{"http://" + hostname},
+		Status:        1,
+		LeaseDuration: lease,
+	}
+	instance := NewInstance(req)
+	r.Register(instance)
+	return instance
+}
+
+func instanceCount(r *Registry) int {
+	data, err := r.Fetch("dev", "com.xx.testapp", 1, 0)
+	if err != nil {
+		return 0
+	}
+	return len(data.Instances)
+}
+
+func TestRegistryCancel(t *testing.T) {
+	r := NewRegistry()
+	defer r.Close()
+	register(r, "a", 0)
+	register(r, "b", 0)
+
+	data, err := r.Fetch("dev", "com.xx.testapp", 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data.Instances[0].LeaseDuration != int64(DefaultLeaseDuration) {
+		t.Fatalf("lease %d", data.Instances[0].LeaseDuration)
+	}
+
+	// a cancel shows up for fetchers
+	if _, err := r.Cancel("dev", "com.xx.testapp", "a"); err != nil {
+		t.Fatal(err)
+	}
+	changed, err := r.Fetch("dev", "com.xx.testapp", 1, data.LatestTimestamp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changed.Instances) != 1 || changed.LatestTimestamp <= data.LatestTimestamp {
+		t.Fatalf("%d instances at %d after %d", len(changed.Instances), changed.LatestTimestamp, data.LatestTimestamp)
+	}
+	if _, err := r.Fetch("dev", "com.xx.testapp", 1, changed.LatestTimestamp); err == nil || err.Error() != "NotModified" {
+		t.Fatalf("got %v, want NotModified", err)
+	}
+
+	r.Cancel("dev", "com.xx.testapp", "b")
+	if _, err := r.Fetch("dev", "com.xx.testapp", 1, 0); err == nil || err.Error() != "NotFound" {
+		t.Fatalf("got %v, want NotFound", err)
+	}
+
+	// registering again after all instances are gone is a change even to
+	// fetchers that saw the application before
+	// 全部下线后重新注册，旧的时间戳也能看到变化
+	register(r, "a", 0)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	again, err := r.Poll(ctx, "dev", "com.xx.testapp", 1, changed.LatestTimestamp)
+	if err != nil || len(again.Instances) != 1 || again.LatestTimestamp <= changed.LatestTimestamp {
+		t.Fatalf("poll after registering again: %v %+v", err, again)
+	}
+}
+
+func TestRegistryEvict(t *testing.T) {
+	r := NewRegistry(WithEvictInterval(20*time.Millisecond), WithSelfProtectThreshold(0))
+	defer r.Close()
+	register(r, "a", 50*time.Millisecond)
+	register(r, "b", time.Hour)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for instanceCount(r) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("expired instance not evicted")
+		}
+		if _, err := r.Renew("dev", "com.xx.testapp", "b"); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := r.Renew("dev", "com.xx.testapp", "a"); err == nil {
+		t.Fatal("evicted instance renewed")
+	}
+}
+
+func TestRegistrySelfProtect(t *testing.T) {
+	r := NewRegistry(WithEvictInterval(20 * time.Millisecond))
+	defer r.Close()
+	register(r, "a", 10*time.Millisecond)
+	register(r, "b", 10*time.Millisecond)
+
+	// nobody renews, which looks like a partition: nothing is evicted
+	// 没有续约，进入自我保护，不剔除
+	time.Sleep(200 * time.Millisecond)
+	if n := instanceCount(r); n != 2 {
+		t.Fatalf("%d instances left, want 2", n)
+	}
+	if !r.gd.selfProtectStatus() {
+		t.Fatal("not self protecting")
+	}
+}
+
+func TestGuard(t *testing.T) {
+	gd := newGuard(0.85, time.Minute)
+	if gd.selfProtectStatus() {
+		t.Fatal("protecting without instances")
+	}
+	// 10 instances renewing every 30s should renew 20 times a minute
+	gd.setNeed(10)
+	for i := 0; i < 17; i++ {
+		gd.incrCount()
+	}
+	gd.storeLastCount()
+	if gd.selfProtectStatus() {
+		t.Fatal("protecting at 17 of 20 renewals")
+	}
+	for i := 0; i < 16; i++ {
+		gd.incrCount()
+	}
+	gd.storeLastCount()
+	if !gd.selfProtectStatus() {
+		t.Fatal("not protecting at 16 of 20 renewals")
+	}
+}
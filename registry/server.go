@@ -0,0 +1,231 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// DefaultPollTimeout is how long a poll waits for a change before
+// answering 304 Not Modified
+const DefaultPollTimeout = 30 * time.Second
+
+// Server exposes a Registry over HTTP, discovery style. Parameters are
+// passed as query or form values, and answers are JSON:
+//
+//	POST /discovery/register  env, appid, hostname, addrs..., status, version, lease_duration
+//	POST /discovery/renew     env, appid, hostname
+//	POST /discovery/cancel    env, appid, hostname
+//	GET  /discovery/fetch     env, appid, status, latest_timestamp
+//	GET  /discovery/poll      env, appid, status, latest_timestamp
+//
+// register, renew and cancel answer the Instance, fetch and poll the
+// FetchData. ErrNotFound is 404 and ErrNotModified a 304 without a body;
+// other errors carry a JSON {"code", "message"} body. Timestamps and the
+// lease duration are in nanoseconds, status defaults to 1. latest_timestamp
+// is that of the last FetchData seen, changes are stamped by the server.
+// 注册中心的HTTP接口
+type Server struct {
+	r           *Registry
+	mux         *http.ServeMux
+	pollTimeout time.Duration
+}
+
+// ErrorResponse is the body of an error answer
+type ErrorResponse struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// NewServer returns a Server for r. Polls wait at most pollTimeout, or
+// DefaultPollTimeout if it is not positive.
+func NewServer(r *Registry, pollTimeout time.Duration) *Server {
+	if pollTimeout <= 0 {
+		pollTimeout = DefaultPollTimeout
+	}
+	s := &Server{
+		r:           r,
+		mux:         http.NewServeMux(),
+		pollTimeout: pollTimeout,
+	}
+	s.mux.HandleFunc("/discovery/register", s.post(s.register))
+	s.mux.HandleFunc("/discovery/renew", s.post(s.renew))
+	s.mux.HandleFunc("/discovery/cancel", s.post(s.cancel))
+	s.mux.HandleFunc("/discovery/fetch", s.get(s.fetch))
+	s.mux.HandleFunc("/discovery/poll", s.get(s.poll))
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.mux.ServeHTTP(w, req)
+}
+
+type handlerFunc func(req *http.Request) (interface{}, error)
+
+// errBadRequest wraps invalid parameters
+type errBadRequest struct {
+	msg string
+}
+
+func (e *errBadRequest) Error() string {
+	return e.msg
+}
+
+func (s *Server) post(h handlerFunc) http.HandlerFunc {
+	return s.handle(http.MethodPost, h)
+}
+
+func (s *Server) get(h handlerFunc) http.HandlerFunc {
+	return s.handle(http.MethodGet, h)
+}
+
+func (s *Server) handle(method string, h handlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != method {
+			w.Header().Set("Allow", method)
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		data, err := h(req)
+		var bad *errBadRequest
+		switch {
+		case err == nil:
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(data)
+		case err == ErrNotModified:
+			w.WriteHeader(http.StatusNotModified)
+		case err == ErrNotFound:
+			writeError(w, http.StatusNotFound, err.Error())
+		case errors.As(err, &bad):
+			writeError(w, http.StatusBadRequest, err.Error())
+		default:
+			writeError(w, http.StatusInternalServerError, err.Error())
+		}
+	}
+}
+
+func writeError(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(ErrorResponse{Code: code, Message: msg})
+}
+
+// params reads the required env, appid and, if withHost, hostname
+func params(req *http.Request, withHost bool) (env, appid, hostname string, err error) {
+	env = req.FormValue("env")
+	appid = req.FormValue("appid")
+	hostname = req.FormValue("hostname")
+	if env == "" || appid == "" || (withHost && hostname == "") {
+		err = &errBadRequest{msg: "env, appid and hostname are required"}
+	}
+	return
+}
+
+// intParam parses an optional integer parameter
+func intParam(req *http.Request, name string, def int64) (int64, error) {
+	v := req.FormValue(name)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0, &errBadRequest{msg: "invalid " + name}
+	}
+	return n, nil
+}
+
+func statusParam(req *http.Request) (uint32, error) {
+	status, err := intParam(req, "status", 1)
+	if err != nil {
+		return 0, err
+	}
+	if status <= 0 || status > 1<<32-1 {
+		return 0, &errBadRequest{msg: "invalid status"}
+	}
+	return uint32(status), nil
+}
+
+func (s *Server) register(req *http.Request) (interface{}, error) {
+	env, appid, hostname, err := params(req, true)
+	if err != nil {
+		return nil, err
+	}
+	req.ParseForm()
+	addrs := req.Form["addrs"]
+	if len(addrs) == 0 {
+		return nil, &errBadRequest{msg: "addrs are required"}
+	}
+	status, err := statusParam(req)
+	if err != nil {
+		return nil, err
+	}
+	lease, err := intParam(req, "lease_duration", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	instance := NewInstance(&RequestRegister{
+		Env:           env,
+		AppId:         appid,
+		Hostname:      hostname,
+		Addrs:         addrs,
+		Status:        status,
+		Version:       req.FormValue("version"),
+		LeaseDuration: time.Duration(lease),
+	})
+	// instance is renewed from now on, so answer the copy
+	return s.r.Register(instance)
+}
+
+func (s *Server) renew(req *http.Request) (interface{}, error) {
+	env, appid, hostname, err := params(req, true)
+	if err != nil {
+		return nil, err
+	}
+	return s.r.Renew(env, appid, hostname)
+}
+
+func (s *Server) cancel(req *http.Request) (interface{}, error) {
+	env, appid, hostname, err := params(req, true)
+	if err != nil {
+		return nil, err
+	}
+	return s.r.Cancel(env, appid, hostname)
+}
+
+func (s *Server) fetch(req *http.Request) (interface{}, error) {
+	env, appid, _, err := params(req, false)
+	if err != nil {
+		return nil, err
+	}
+	status, err := statusParam(req)
+	if err != nil {
+		return nil, err
+	}
+	latestTimestamp, err := intParam(req, "latest_timestamp", 0)
+	if err != nil {
+		return nil, err
+	}
+	return s.r.Fetch(env, appid, status, latestTimestamp)
+}
+
+func (s *Server) poll(req *http.Request) (interface{}, error) {
+	env, appid, _, err := params(req, false)
+	if err != nil {
+		return nil, err
+	}
+	status, err := statusParam(req)
+	if err != nil {
+		return nil, err
+	}
+	latestTimestamp, err := intParam(req, "latest_timestamp", 0)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), s.pollTimeout)
+	defer cancel()
+	return s.r.Poll(ctx, env, appid, status, latestTimestamp)
+}
@@ -0,0 +1,140 @@
+package registry
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func postForm(t *testing.T, base, path string, form url.Values) *http.Response {
+	t.Helper()
+	resp, err := http.PostForm(base+path, form)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func getFetch(t *testing.T, base, path string, latestTimestamp int64) (*FetchData, int) {
+	t.Helper()
+	q := url.Values{"env": {"dev"}, "appid": {"com.xx.testapp"}, "latest_timestamp": {strconv.FormatInt(latestTimestamp, 10)}}
+	resp, err := http.Get(base + path + "?" + q.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, resp.StatusCode
+	}
+	var data FetchData
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		t.Fatal(err)
+	}
+	return &data, resp.StatusCode
+}
+
+func TestServer(t *testing.T) {
+	r := NewRegistry()
+	defer r.Close()
+	ts := httptest.NewServer(NewServer(r, 100*time.Millisecond))
+	defer ts.Close()
+
+	if _, code := getFetch(t, ts.URL, "/discovery/fetch", 0); code != http.StatusNotFound {
+		t.Fatalf("fetch unknown app: %d", code)
+	}
+
+	form := url.Values{
+		"env":            {"dev"},
+		"appid":          {"com.xx.testapp"},
+		"hostname":       {"a"},
+		"addrs":          {"http://a:8000", "grpc://a:9000"},
+		"lease_duration": {strconv.FormatInt(int64(time.Minute), 10)},
+	}
+	resp := postForm(t, ts.URL, "/discovery/register", form)
+	var instance Instance
+	json.NewDecoder(resp.Body).Decode(&instance)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || len(instance.Addrs) != 2 || instance.LeaseDuration != int64(time.Minute) || instance.Status != 1 {
+		t.Fatalf("register: %d %+v", resp.StatusCode, instance)
+	}
+
+	data, code := getFetch(t, ts.URL, "/discovery/fetch", 0)
+	if code != http.StatusOK || len(data.Instances) != 1 || data.Instances[0].Hostname != "a" {
+		t.Fatalf("fetch: %d %+v", code, data)
+	}
+	if _, code := getFetch(t, ts.URL, "/discovery/fetch", data.LatestTimestamp); code != http.StatusNotModified {
+		t.Fatalf("fetch unchanged: %d", code)
+	}
+
+	// poll times out without a change, and returns as soon as one happens
+	// 长轮询等到变化才返回
+	if _, code := getFetch(t, ts.URL, "/discovery/poll", data.LatestTimestamp); code != http.StatusNotModified {
+		t.Fatalf("poll unchanged: %d", code)
+	}
+	polled := make(chan *FetchData, 1)
+	go func() {
+		data, _ := getFetch(t, ts.URL, "/discovery/poll", data.LatestTimestamp)
+		polled <- data
+	}()
+	time.Sleep(20 * time.Millisecond)
+	form.Set("hostname", "b")
+	postForm(t, ts.URL, "/discovery/register", form).Body.Close()
+	select {
+	case changed := <-polled:
+		if changed == nil || len(changed.Instances) != 2 || changed.LatestTimestamp <= data.LatestTimestamp {
+			t.Fatalf("poll: %+v", changed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("poll did not return")
+	}
+
+	// the answer to a register is not touched by renewals
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				r.Renew("dev", "com.xx.testapp", "b")
+			}
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		postForm(t, ts.URL, "/discovery/register", form).Body.Close()
+	}
+	close(stop)
+	<-done
+
+	renew := url.Values{"env": {"dev"}, "appid": {"com.xx.testapp"}, "hostname": {"a"}}
+	if resp := postForm(t, ts.URL, "/discovery/renew", renew); resp.StatusCode != http.StatusOK {
+		t.Fatalf("renew: %d", resp.StatusCode)
+	}
+	if resp := postForm(t, ts.URL, "/discovery/cancel", renew); resp.StatusCode != http.StatusOK {
+		t.Fatalf("cancel: %d", resp.StatusCode)
+	}
+	resp = postForm(t, ts.URL, "/discovery/renew", renew)
+	var errResp ErrorResponse
+	json.NewDecoder(resp.Body).Decode(&errResp)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound || errResp.Code != http.StatusNotFound || errResp.Message != "NotFound" {
+		t.Fatalf("renew cancelled: %d %+v", resp.StatusCode, errResp)
+	}
+
+	if resp := postForm(t, ts.URL, "/discovery/register", url.Values{"env": {"dev"}}); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("register without appid: %d", resp.StatusCode)
+	}
+	resp, err := http.Get(ts.URL + "/discovery/register")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("GET register: %d", resp.StatusCode)
+	}
+}
@@ -63,7 +63,7 @@ func (job *Job) Start() {
 			if task.JobName == "" || task.Spec == "" || task.TaskFunc == nil {
 				continue
 			}
-			if err := cronObj.AddJob(task.Spec, task); err != nil {
+			if _, err := cronObj.AddJob(task.Spec, task); err != nil {
 				log.Printf("AddJob %v", err)
 
 			}